@@ -1,68 +1,182 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
-    "log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-    "github.com/joho/godotenv"
+	"github.com/jinzhu/gorm"
 	"github.com/mattmac4241/grouper-api/service"
 )
 
 func main() {
-    err := godotenv.Load()
-    if err != nil {
-      log.Fatal("Error loading .env file")
-    }
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	printConfig := flag.Bool("print-config", false, "prints the effective config with secrets redacted and exits")
+	flag.Usage = usage
+	flag.Parse()
+
+	cfg, err := service.LoadConfig(*configPath)
+	if *printConfig {
+		service.PrintConfig(os.Stdout, cfg)
+	}
+	logger := service.NewLogger(os.Stdout, cfg.LogLevel)
+	if err != nil {
+		fatal(logger, "Invalid config", err)
+	}
+	if *printConfig {
+		return
+	}
+	if flag.Arg(0) == "migrate" {
+		migrate(logger, cfg, flag.Args()[1:])
+		return
+	}
 
+	deps, err := service.NewDependencies(cfg, logger)
+	if err != nil {
+		fatal(logger, "Failed to start", err)
+	}
+	defer deps.Close()
+
+	warnAboutPendingMigrations(logger, deps.DB)
+
+	server, err := service.NewServer(cfg, deps)
+	if err != nil {
+		fatal(logger, "Failed to build the server", err)
+	}
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		fatal(logger, "Failed to listen", err)
+	}
 
-    dbname := os.Getenv("DBNAME")
-    user := os.Getenv("DBUSER")
-    password := os.Getenv("DBPASSWORD")
-    host := os.Getenv("DBHOST")
-	redisAddress := os.Getenv("REDIS_ADDRESS")
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("Shutting down", "signal", sig.String())
+		server.Drain()
+		time.Sleep(time.Duration(cfg.Health.DrainDelay))
+		stop()
+	}()
 
-	service.REDIS, _ = service.InitRedisClient(redisAddress, "")
-	service.DB = service.InitDatabase(host, user, dbname, password)
-	defer service.CloseDatabase()
-	defer service.REDIS.Close()
+	deps.Catalog.PublishService(context.Background())
+	go service.ListenForRevocations(ctx, deps.Cache, cfg.Tokens, logger)
 
-	handleFlags()
+	if cfg.MetricsPort != "" {
+		metricsListener, err := net.Listen("tcp", ":"+cfg.MetricsPort)
+		if err != nil {
+			fatal(logger, "Failed to listen for metrics", err)
+		}
+		go service.Serve(ctx, &http.Server{Handler: server.MetricsHandler()}, metricsListener, time.Duration(cfg.ShutdownTimeout))
+	}
 
-	port := os.Getenv("PORT")
-	if len(port) == 0 {
-		port = "3000"
+	logger.Info("Listening", "address", listener.Addr().String())
+	err = service.Serve(ctx, &http.Server{Handler: server}, listener, time.Duration(cfg.ShutdownTimeout))
+	stop()
+	deps.Catalog.DeregisterService(context.Background())
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("Shutdown did not finish cleanly", "error", err)
 	}
-	publish()
-	server := service.NewServer()
-	server.Run(":" + port)
 }
 
-func publish() {
-	serviceClient := service.CatalogWebClient{
-        RootURL: os.Getenv("PUBLISH_URL"),
-    }
-	serviceClient.PublishService()
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate [-yes] up|down|status|to VERSION]\n", os.Args[0])
+	flag.PrintDefaults()
+}
 
-func handleFlags() {
-	createPTR := flag.Bool("create", false, "creates the models")
-	migratePTR := flag.Bool("migrate", false, "migrates the models")
-	deletePTR := flag.Bool("delete", false, "deletes the models")
-	flag.Parse()
+// migrate runs the migrate subcommand, rollbacks and migrations that delete or
+// change rows drop data so they have to be confirmed on stdin unless -yes is
+// given
+func migrate(logger *slog.Logger, cfg service.Config, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "rolls back and changes rows without asking for confirmation")
+	flags.Parse(args)
+	command, args := flags.Arg(0), flags.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	var version int
+	switch {
+	case command == "to" && len(args) == 1:
+		var err error
+		version, err = strconv.Atoi(args[0])
+		if err != nil {
+			fatal(logger, "Invalid version", err)
+		}
+	case (command == "up" || command == "down" || command == "status") && len(args) == 0:
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	db, err := service.InitDatabase(cfg.Database)
+	if err != nil {
+		fatal(logger, "Failed to connect", err)
+	}
+	defer db.Close()
+	migrator, err := service.NewMigrator(db.DB(), logger)
+	if err != nil {
+		fatal(logger, "Invalid migrations", err)
+	}
+	migrator.Confirm = func(steps []service.MigrationStep) bool {
+		if *yes {
+			return true
+		}
+		fmt.Fprintf(os.Stderr, "This drops or changes data in %s:\n", cfg.Database.Name)
+		service.PrintMigrationSteps(os.Stderr, steps)
+		fmt.Fprint(os.Stderr, "Type yes to continue: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		return strings.TrimSpace(answer) == "yes"
+	}
 
-	if *deletePTR == true {
-		fmt.Println("DELETE MODELS")
-		service.DropModels()
+	ctx := context.Background()
+	switch command {
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		err = migrator.Down(ctx)
+	case "to":
+		err = migrator.To(ctx, version)
+	case "status":
+		var statuses []service.MigrationStatus
+		statuses, err = migrator.Status(ctx)
+		if err == nil {
+			err = service.PrintMigrationStatus(os.Stdout, statuses)
+		}
 	}
-	if *createPTR == true {
-		fmt.Println("CREATE MODELS")
-		service.CreateModels()
+	if err != nil {
+		db.Close()
+		fatal(logger, "Failed to migrate", err)
+	}
+}
+
+// warnAboutPendingMigrations doesn't stop the server, so a new build can be
+// rolled out before or after its migrations are applied
+func warnAboutPendingMigrations(logger *slog.Logger, db *gorm.DB) {
+	migrator, err := service.NewMigrator(db.DB(), logger)
+	if err != nil {
+		fatal(logger, "Invalid migrations", err)
 	}
-	if *migratePTR == true {
-		fmt.Println("MIGRATE MODELS")
-		service.MigrateModels()
+	pending, err := migrator.Pending(context.Background())
+	if err != nil {
+		logger.Warn("Failed to check for pending migrations", "error", err)
+	} else if pending > 0 {
+		logger.Warn("The schema is behind, run migrate up", "pending", pending)
 	}
 }
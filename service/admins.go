@@ -0,0 +1,265 @@
+package service
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+    "github.com/unrolled/render"
+)
+
+func getGroupAdminsHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canReadGroup(repo, group, Principal{UserID: userID})
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        admins, err := repo.getGroupAdmins(group.ID, page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get group admins")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, pageOf(admins, page))
+    }
+}
+
+func postGroupAdminHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        targetID, err := strconv.ParseUint(vars["userID"], 10, 32)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse user id.")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        member, err := repo.isGroupMember(group.ID, uint(targetID))
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !member {
+            formatter.JSON(w, http.StatusBadRequest, "User is not a member of this group.")
+            return
+        }
+
+        admin, err = repo.isGroupAdmin(group.ID, uint(targetID))
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if admin {
+            formatter.JSON(w, http.StatusConflict, "User is already an admin of this group.")
+            return
+        }
+
+        err = repo.promoteGroupAdmin(group.ID, uint(targetID), userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to promote admin.")
+            return
+        }
+        formatter.JSON(w, http.StatusCreated, "Admin succesfully promoted.")
+    }
+}
+
+func deleteGroupAdminHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        targetID, err := strconv.ParseUint(vars["userID"], 10, 32)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse user id.")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        admin, err = repo.isGroupAdmin(group.ID, uint(targetID))
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusNotFound, "User is not an admin of this group.")
+            return
+        }
+
+        if group.OwnerID == uint(targetID) {
+            formatter.JSON(w, http.StatusConflict, "Owner can't be demoted, transfer ownership first.")
+            return
+        }
+
+        err = repo.demoteGroupAdmin(group.ID, uint(targetID), userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to demote admin.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Admin succesfully demoted.")
+    }
+}
+
+func postGroupOwnerHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var transfer struct {
+            UserID uint `json:"user_id"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &transfer)
+        if err != nil || transfer.UserID == 0 {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse ownership transfer.")
+            return
+        }
+
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        if group.OwnerID != userID {
+            formatter.JSON(w, http.StatusForbidden, "Only the owner can transfer the group.")
+            return
+        }
+        if transfer.UserID == userID {
+            formatter.JSON(w, http.StatusBadRequest, "User already owns this group.")
+            return
+        }
+
+        member, err := repo.isGroupMember(group.ID, transfer.UserID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !member {
+            formatter.JSON(w, http.StatusBadRequest, "User is not a member of this group.")
+            return
+        }
+
+        err = repo.transferGroupOwnership(group.ID, transfer.UserID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to transfer ownership.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Ownership succesfully transferred.")
+    }
+}
+
+func getGroupAdminEventsHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        events, err := repo.getGroupAdminEvents(group.ID, page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get admin history")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, pageOf(events, page))
+    }
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gorilla/mux"
+    "github.com/jinzhu/gorm"
+    "github.com/unrolled/render"
+)
+
+const (
+    //apiKeyHeader is where callers send api keys, keeping them apart from
+    //user tokens in Authorization
+    apiKeyHeader = "X-API-Key"
+    apiKeyPrefix = "gk_"
+)
+
+//apiKeyResponse shows the scopes and groups of a key as lists, Key is only
+//set when the key is created since only its hash is kept
+type apiKeyResponse struct {
+    APIKey
+    Scopes      []string    `json:"scopes"`
+    GroupIDs    []uint      `json:"group_ids"`
+    Key         string      `json:"key,omitempty"`
+}
+
+//newAPIKeyResponse shows a stored key
+func newAPIKeyResponse(key APIKey) apiKeyResponse {
+    return apiKeyResponse{APIKey: key, Scopes: strings.Fields(key.Scopes), GroupIDs: parseGroupIDs(key.GroupIDs)}
+}
+
+//parseGroupIDs reads the space separated group ids granted to a key, ids
+//that don't parse are skipped
+func parseGroupIDs(value string) []uint {
+    groupIDs := []uint{}
+    for _, field := range strings.Fields(value) {
+        id, err := strconv.ParseUint(field, 10, 32)
+        if err == nil {
+            groupIDs = append(groupIDs, uint(id))
+        }
+    }
+    return groupIDs
+}
+
+//formatGroupIDs is the reverse of parseGroupIDs
+func formatGroupIDs(groupIDs []uint) string {
+    fields := make([]string, len(groupIDs))
+    for i, id := range groupIDs {
+        fields[i] = strconv.FormatUint(uint64(id), 10)
+    }
+    return strings.Join(fields, " ")
+}
+
+//newAPIKey returns a random key along with the hash that gets stored
+func newAPIKey() (string, string, error) {
+    b := make([]byte, 32)
+    _, err := rand.Read(b)
+    if err != nil {
+        return "", "", err
+    }
+    key := apiKeyPrefix + hex.EncodeToString(b)
+    return key, hashAPIKey(key), nil
+}
+
+func hashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+//principalForAPIKey looks up the bot a key belongs to
+func principalForAPIKey(repo repository, key string) (Principal, error) {
+    if !strings.HasPrefix(key, apiKeyPrefix) {
+        return Principal{}, errInvalidToken
+    }
+    apiKey, err := repo.getAPIKeyByHash(hashAPIKey(key))
+    if err == gorm.ErrRecordNotFound {
+        return Principal{}, errInvalidToken
+    }
+    if err != nil {
+        return Principal{}, errAuthUnavailable
+    }
+    return Principal{
+        BotID:    apiKey.ID,
+        Name:     apiKey.Name,
+        Scopes:   strings.Fields(apiKey.Scopes),
+        GroupIDs: parseGroupIDs(apiKey.GroupIDs),
+    }, nil
+}
+
+func getAPIKeysHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        keys, err := repo.getAPIKeys(page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get api keys.")
+            return
+        }
+
+        response := pageOf(keys, page)
+        items := []apiKeyResponse{}
+        for _, key := range response.Items.([]APIKey) {
+            items = append(items, newAPIKeyResponse(key))
+        }
+        response.Items = items
+        formatter.JSON(w, http.StatusOK, response)
+    }
+}
+
+func postAPIKeyHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var body struct {
+            Name        string      `json:"name"`
+            Scopes      []string    `json:"scopes"`
+            GroupIDs    []uint      `json:"group_ids"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &body)
+        if err != nil || strings.TrimSpace(body.Name) == "" || len(body.Scopes) == 0 {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse api key.")
+            return
+        }
+        for _, scope := range body.Scopes {
+            if !validScope(scope) {
+                formatter.JSON(w, http.StatusBadRequest, "Unknown scope "+scope+".")
+                return
+            }
+        }
+        for _, groupID := range body.GroupIDs {
+            _, err = repo.getGroup(strconv.FormatUint(uint64(groupID), 10))
+            if err != nil {
+                formatter.JSON(w, http.StatusBadRequest, "Unknown group "+strconv.FormatUint(uint64(groupID), 10)+".")
+                return
+            }
+        }
+
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        key, hash, err := newAPIKey()
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to create api key.")
+            return
+        }
+
+        apiKey, err := repo.addAPIKey(APIKey{
+            Name:      strings.TrimSpace(body.Name),
+            Prefix:    key[:len(apiKeyPrefix)+8],
+            KeyHash:   hash,
+            Scopes:    strings.Join(body.Scopes, " "),
+            GroupIDs:  formatGroupIDs(body.GroupIDs),
+            CreatorID: caller.UserID,
+        })
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to create api key.")
+            return
+        }
+        response := newAPIKeyResponse(apiKey)
+        response.Key = key
+        formatter.JSON(w, http.StatusCreated, response)
+    }
+}
+
+func deleteAPIKeyHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        err := repo.revokeAPIKey(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "API key not found")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "API key succesfully revoked.")
+    }
+}
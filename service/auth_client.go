@@ -1,39 +1,231 @@
 package service
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
+    "io"
     "io/ioutil"
+    "log/slog"
     "net/http"
+    "net/url"
+    "time"
+
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+var (
+    //errInvalidToken is returned when the auth service doesn't know the token
+    errInvalidToken = errors.New("Invalid token")
+    //errAuthUnavailable is returned when the auth service can't be reached
+    errAuthUnavailable = errors.New("Auth service unavailable")
+)
+
+const (
+    defaultAuthTimeout = 2 * time.Second
+    //maxAuthResponseSize caps how much of a response body is read
+    maxAuthResponseSize = 1 << 20
+
+    //AuthModeRemote asks the auth service about every uncached token
+    AuthModeRemote = "remote"
+    //AuthModeJWT verifies signed tokens locally
+    AuthModeJWT = "jwt"
 )
 
 type authClient interface {
-    getUserIDFromToken(key string) (token Token, err error)
+    getUserIDFromToken(ctx context.Context, key string) (token Token, err error)
 }
 
+//newAuthClient builds the client the middleware verifies tokens with, calls
+//to a remote auth service are recorded with the metrics, logger and tracer
+//of deps
+func newAuthClient(cfg AuthConfig, deps Dependencies) (authClient, error) {
+    switch cfg.Mode {
+    case AuthModeRemote:
+        client := newAuthWebClient(cfg)
+        client.metrics = deps.Metrics
+        client.logger = deps.Logger
+        client.tracer = deps.Tracer
+        return client, nil
+    case AuthModeJWT:
+        return newJWTClient(cfg.JWT.Algorithm, cfg.JWT.KeyFile, cfg.JWT.JWKSFile, cfg.JWT.Issuer, cfg.JWT.Audience)
+    }
+    return nil, fmt.Errorf("Unknown auth mode %q", cfg.Mode)
+}
+
+//authHTTPClient is shared by auth clients that aren't given their own, so
+//connections to the auth service are reused between requests
+var authHTTPClient = &http.Client{Timeout: defaultAuthTimeout}
+
 type authtWebClient struct {
-    rootURL string
+    rootURL     string
+    httpClient  *http.Client
+    //retries is how many more attempts are made after a transient failure
+    retries     int
+    backoff     time.Duration
+    breaker     *circuitBreaker
+    metrics     *Metrics
+    logger      *slog.Logger
+    tracer      trace.Tracer
+}
+
+func newAuthWebClient(cfg AuthConfig) authtWebClient {
+    timeout := time.Duration(cfg.Timeout)
+    if timeout <= 0 {
+        timeout = defaultAuthTimeout
+    }
+    return authtWebClient{
+        rootURL:    cfg.URL,
+        httpClient: &http.Client{Timeout: timeout},
+        retries:    cfg.Retries,
+        backoff:    time.Duration(cfg.RetryBackoff),
+        breaker:    newCircuitBreaker(cfg.BreakerThreshold, time.Duration(cfg.BreakerCooldown)),
+        logger:     slog.Default(),
+    }
+}
+
+//getUserIDFromToken asks the auth service about the token, transient failures
+//are retried with exponential backoff and fail fast while the breaker is open.
+//Once ctx is done the error of ctx is returned, a caller going away says
+//nothing about the auth service so it isn't retried or held against it
+func (client authtWebClient) getUserIDFromToken(ctx context.Context, key string) (token Token, err error) {
+    if err = ctx.Err(); err != nil {
+        client.metrics.observeAuthResult(authOutcome(err))
+        return token, err
+    }
+    if !client.breaker.allow() {
+        client.metrics.observeAuthResult("circuit_open")
+        return token, errAuthUnavailable
+    }
+
+    for attempt := 0; ; attempt++ {
+        start := time.Now()
+        token, err = client.fetchToken(ctx, key)
+        if err != nil && ctx.Err() != nil {
+            err = ctx.Err()
+        }
+        client.metrics.observeAuthRequest(authOutcome(err), start)
+        if err != errAuthUnavailable || attempt >= client.retries {
+            break
+        }
+        if !client.wait(ctx, attempt) {
+            err = ctx.Err()
+            break
+        }
+    }
+
+    switch {
+    case err == errAuthUnavailable:
+        client.breaker.failure()
+    case ctx.Err() != nil:
+        client.breaker.release()
+    default:
+        client.breaker.success()
+    }
+    client.metrics.observeAuthResult(authOutcome(err))
+    return token, err
 }
 
-func (client authtWebClient) getUserIDFromToken(key string) (token Token, err error) {
-    httpclient := &http.Client{}
+//wait sleeps out the backoff before the next attempt, it returns false when
+//ctx is done first
+func (client authtWebClient) wait(ctx context.Context, attempt int) bool {
+    timer := time.NewTimer(client.backoff * time.Duration(1<<uint(attempt)))
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+//ping checks the auth service answers, any response below 500 will do since
+//there is no token to ask about
+func (client authtWebClient) ping(ctx context.Context) error {
+    httpclient := client.httpClient
+    if httpclient == nil {
+        httpclient = authHTTPClient
+    }
 
-    tokenURL := fmt.Sprintf("%s/%s", client.rootURL, key)
-    req, _ := http.NewRequest("GET", tokenURL, nil)
+    req, err := http.NewRequestWithContext(ctx, "GET", client.rootURL, nil)
+    if err != nil {
+        return err
+    }
+    setRequestID(ctx, req)
+    ctx, span := startClientSpan(ctx, client.tracer, "auth.ping", req)
+    resp, err := httpclient.Do(req.WithContext(ctx))
+    endClientSpan(span, resp, err)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= http.StatusInternalServerError {
+        return fmt.Errorf("Auth service answered %d", resp.StatusCode)
+    }
+    return nil
+}
 
-    resp, err := httpclient.Do(req)
+//authSpanError only fails the span of a call when the auth service couldn't
+//answer, rejected tokens are a normal outcome
+func authSpanError(err error) error {
+    if err == errInvalidToken {
+        return nil
+    }
+    return err
+}
 
+//fetchToken makes a single call to the auth service
+func (client authtWebClient) fetchToken(ctx context.Context, key string) (token Token, err error) {
+    httpclient := client.httpClient
+    if httpclient == nil {
+        httpclient = authHTTPClient
+    }
+
+    tokenURL := fmt.Sprintf("%s/%s", client.rootURL, url.PathEscape(key))
+    req, err := http.NewRequestWithContext(ctx, "GET", tokenURL, nil)
     if err != nil {
-        fmt.Printf("Errored when sending request to the server: %s\n", err.Error())
-        return
+        return token, errInvalidToken
     }
+    req.Header.Set("Accept", "application/json")
+    setRequestID(ctx, req)
+    logger := loggerFor(ctx, client.logger)
+    ctx, span := startClientSpan(ctx, client.tracer, "auth.getToken", req)
+    defer func() {
+        endClientSpan(span, nil, authSpanError(err))
+    }()
 
+    resp, err := httpclient.Do(req.WithContext(ctx))
+    if err != nil {
+        logger.Warn("Failed to reach the auth service", "error", err)
+        return token, errAuthUnavailable
+    }
     defer resp.Body.Close()
-    payload, _ := ioutil.ReadAll(resp.Body)
+    span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+    switch {
+    case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound:
+        return token, errInvalidToken
+    case resp.StatusCode >= http.StatusInternalServerError:
+        return token, errAuthUnavailable
+    case resp.StatusCode != http.StatusOK:
+        logger.Warn("Unexpected status from the auth service", "status", resp.StatusCode)
+        return token, errInvalidToken
+    }
+
+    payload, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAuthResponseSize))
+    if err != nil {
+        return token, errAuthUnavailable
+    }
     err = json.Unmarshal(payload, &token)
     if err != nil {
-        fmt.Println("Failed to unmarshal server response")
+        logger.Warn("Failed to unmarshal auth service response", "error", err)
+        return token, errInvalidToken
+    }
+    if token.UserID == 0 {
+        return token, errInvalidToken
     }
 
-    return token, err
+    return token, nil
 }
@@ -0,0 +1,119 @@
+package service
+
+import (
+    "strconv"
+)
+
+//canReadGroup reports if the caller may see the posts and comments of a
+//group, public groups are open to everyone while private groups are members
+//only. Bots aren't members of anything, they need the group granted to
+//their api key instead
+func canReadGroup(repo repository, group Group, caller Principal) (bool, error) {
+    if !group.Private {
+        return true, nil
+    }
+    if caller.isBot() {
+        return caller.grantedGroup(group.ID), nil
+    }
+    return repo.isGroupMember(group.ID, caller.UserID)
+}
+
+//canWriteGroup reports if the caller may post into a group, which requires
+//membership or a grant whether or not the group is private
+func canWriteGroup(repo repository, groupID uint, caller Principal) (bool, error) {
+    if caller.isBot() {
+        return caller.grantedGroup(groupID), nil
+    }
+    return repo.isGroupMember(groupID, caller.UserID)
+}
+
+//canReadPost reports if the caller may see a post and its comments, posts
+//whose group can't be found are treated as unreadable
+func canReadPost(repo repository, post Post, caller Principal) (bool, error) {
+    group, err := repo.getGroup(strconv.FormatUint(uint64(post.GroupID), 10))
+    if err != nil {
+        return false, nil
+    }
+    return canReadGroup(repo, group, caller)
+}
+
+//readableGroups is the groups the caller may list, private groups are left
+//to their members and the bots granted them
+func readableGroups(caller Principal) groupAccess {
+    if caller.isBot() {
+        return groupAccess{groupIDs: caller.GroupIDs, all: caller.hasScope(scopeAdmin)}
+    }
+    return groupAccess{userID: caller.UserID}
+}
+
+//readableGroupIDs narrows the requested group ids down to the ones the caller
+//may read, unknown groups are dropped
+func readableGroupIDs(repo repository, groupIDs []string, caller Principal) ([]string, error) {
+    readable := []string{}
+    for _, id := range groupIDs {
+        group, err := repo.getGroup(id)
+        if err != nil {
+            continue
+        }
+        ok, err := canReadGroup(repo, group, caller)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            readable = append(readable, id)
+        }
+    }
+    return readable, nil
+}
+
+//readablePostIDs narrows the requested post ids down to the ones the caller
+//may read, unknown posts are dropped
+func readablePostIDs(repo repository, postIDs []string, caller Principal) ([]string, error) {
+    readable := []string{}
+    for _, id := range postIDs {
+        post, err := repo.getPost(id)
+        if err != nil {
+            continue
+        }
+        ok, err := canReadPost(repo, post, caller)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            readable = append(readable, id)
+        }
+    }
+    return readable, nil
+}
+
+//canReadComment reports if the caller may see a comment, which follows the
+//post it belongs to
+func canReadComment(repo repository, comment Comment, caller Principal) (bool, error) {
+    post, err := repo.getPost(strconv.FormatUint(uint64(comment.PostID), 10))
+    if err != nil {
+        return false, nil
+    }
+    return canReadPost(repo, post, caller)
+}
+
+//canRemovePost reports if the user may delete a post, which authors can do
+//for their own posts and admins for any post in their group
+func canRemovePost(repo repository, post Post, userID uint) (bool, error) {
+    if post.UserID == userID {
+        return true, nil
+    }
+    return repo.isGroupAdmin(post.GroupID, userID)
+}
+
+//canRemoveComment reports if the user may delete a comment, which authors can
+//do for their own comments and admins for any comment in their group
+func canRemoveComment(repo repository, comment Comment, userID uint) (bool, error) {
+    if comment.UserID == userID {
+        return true, nil
+    }
+    post, err := repo.getPost(strconv.FormatUint(uint64(comment.PostID), 10))
+    if err != nil {
+        return false, nil
+    }
+    return repo.isGroupAdmin(post.GroupID, userID)
+}
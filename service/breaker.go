@@ -0,0 +1,79 @@
+package service
+
+import (
+    "sync"
+    "time"
+)
+
+//circuitBreaker stops calling a dependency after threshold failures in a row,
+//once cooldown has passed a single trial call is let through and its result
+//decides whether the breaker closes again
+type circuitBreaker struct {
+    threshold   int
+    cooldown    time.Duration
+    now         func() time.Time
+
+    mu          sync.Mutex
+    failures    int
+    openedAt    time.Time
+    trial       bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+    return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+//allow reports if a call may go ahead
+func (b *circuitBreaker) allow() bool {
+    if b == nil || b.threshold <= 0 {
+        return true
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.failures < b.threshold {
+        return true
+    }
+    if b.trial || b.now().Sub(b.openedAt) < b.cooldown {
+        return false
+    }
+    b.trial = true
+    return true
+}
+
+//success closes the breaker
+func (b *circuitBreaker) success() {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.failures = 0
+    b.trial = false
+}
+
+//release gives up a trial call without deciding on it, for calls the caller
+//abandoned, the next call after it becomes the trial
+func (b *circuitBreaker) release() {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.trial = false
+}
+
+//failure counts a failed call, opening the breaker at the threshold or again
+//after a failed trial
+func (b *circuitBreaker) failure() {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.failures++
+    if b.trial || b.failures == b.threshold {
+        b.openedAt = b.now()
+    }
+    b.trial = false
+}
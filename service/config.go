@@ -0,0 +1,501 @@
+package service
+
+import (
+    "bytes"
+    "encoding"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/joho/godotenv"
+    "gopkg.in/yaml.v2"
+)
+
+const redacted = "[redacted]"
+
+//Config holds every setting of the service, it is loaded once at startup
+//from defaults, an optional config file, an optional .env file and the
+//environment, in increasing order of precedence
+type Config struct {
+    Port            string          `json:"port" yaml:"port" env:"PORT"`
+    LogLevel        string          `json:"log_level" yaml:"log_level" env:"LOG_LEVEL"`
+    //MetricsPort serves /metrics on its own port when set, so it can be kept
+    //off the public network
+    MetricsPort     string          `json:"metrics_port" yaml:"metrics_port" env:"METRICS_PORT"`
+    URL             string          `json:"url" yaml:"url" env:"URL"`
+    PublishURL      string          `json:"publish_url" yaml:"publish_url" env:"PUBLISH_URL"`
+    //StartupTimeout is how long to keep retrying postgres and redis at
+    //startup, 0 fails on the first attempt
+    StartupTimeout  Duration        `json:"startup_timeout" yaml:"startup_timeout" env:"STARTUP_TIMEOUT"`
+    //ShutdownTimeout is how long in-flight requests get to finish on shutdown
+    ShutdownTimeout Duration        `json:"shutdown_timeout" yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+    Database        DatabaseConfig  `json:"database" yaml:"database"`
+    Redis           RedisConfig     `json:"redis" yaml:"redis"`
+    Auth            AuthConfig      `json:"auth" yaml:"auth"`
+    Tokens          TokenConfig     `json:"tokens" yaml:"tokens"`
+    RateLimits      RateLimitConfig `json:"rate_limits" yaml:"rate_limits"`
+    Health          HealthConfig    `json:"health" yaml:"health"`
+    Tracing         TracingConfig   `json:"tracing" yaml:"tracing"`
+    MaxCommentDepth int             `json:"max_comment_depth" yaml:"max_comment_depth" env:"COMMENT_MAX_DEPTH"`
+    ReactionTypes   []string        `json:"reaction_types" yaml:"reaction_types" env:"REACTION_TYPES"`
+}
+
+//DatabaseConfig is where postgres lives
+type DatabaseConfig struct {
+    Host        string  `json:"host" yaml:"host" env:"DBHOST"`
+    User        string  `json:"user" yaml:"user" env:"DBUSER"`
+    Name        string  `json:"name" yaml:"name" env:"DBNAME"`
+    Password    string  `json:"password" yaml:"password" env:"DBPASSWORD"`
+    SSLMode     string  `json:"ssl_mode" yaml:"ssl_mode" env:"DBSSLMODE"`
+}
+
+//RedisConfig is where redis lives
+type RedisConfig struct {
+    Address     string  `json:"address" yaml:"address" env:"REDIS_ADDRESS"`
+    Password    string  `json:"password" yaml:"password" env:"REDIS_PASSWORD"`
+}
+
+//AuthConfig selects how the middleware verifies tokens, the timeout, retry
+//and breaker settings only apply to the remote mode
+type AuthConfig struct {
+    Mode                string      `json:"mode" yaml:"mode" env:"AUTH_MODE"`
+    URL                 string      `json:"url" yaml:"url" env:"AUTH_URL"`
+    Timeout             Duration    `json:"timeout" yaml:"timeout" env:"AUTH_TIMEOUT"`
+    Retries             int         `json:"retries" yaml:"retries" env:"AUTH_RETRIES"`
+    RetryBackoff        Duration    `json:"retry_backoff" yaml:"retry_backoff" env:"AUTH_RETRY_BACKOFF"`
+    BreakerThreshold    int         `json:"breaker_threshold" yaml:"breaker_threshold" env:"AUTH_BREAKER_THRESHOLD"`
+    BreakerCooldown     Duration    `json:"breaker_cooldown" yaml:"breaker_cooldown" env:"AUTH_BREAKER_COOLDOWN"`
+    JWT                 JWTConfig   `json:"jwt" yaml:"jwt"`
+}
+
+//JWTConfig is used by the jwt auth mode
+type JWTConfig struct {
+    Algorithm   string  `json:"algorithm" yaml:"algorithm" env:"JWT_ALGORITHM"`
+    KeyFile     string  `json:"key_file" yaml:"key_file" env:"JWT_KEY_FILE"`
+    JWKSFile    string  `json:"jwks_file" yaml:"jwks_file" env:"JWT_JWKS_FILE"`
+    Issuer      string  `json:"issuer" yaml:"issuer" env:"JWT_ISSUER"`
+    Audience    string  `json:"audience" yaml:"audience" env:"JWT_AUDIENCE"`
+}
+
+//TokenConfig controls caching and revocation of tokens
+type TokenConfig struct {
+    NegativeTTL         Duration    `json:"negative_ttl" yaml:"negative_ttl" env:"TOKEN_NEGATIVE_TTL"`
+    RevokedTTL          Duration    `json:"revoked_ttl" yaml:"revoked_ttl" env:"TOKEN_REVOKED_TTL"`
+    RevocationSecret    string      `json:"revocation_secret" yaml:"revocation_secret" env:"REVOCATION_SECRET"`
+    RevocationChannel   string      `json:"revocation_channel" yaml:"revocation_channel" env:"REVOCATION_CHANNEL"`
+}
+
+//RateLimitConfig holds limits written like 60/1m, Routes overrides them for
+//single routes keyed like "POST /api/posts"
+type RateLimitConfig struct {
+    Reads           string      `json:"reads" yaml:"reads" env:"RATE_LIMIT_READS"`
+    Writes          string      `json:"writes" yaml:"writes" env:"RATE_LIMIT_WRITES"`
+    Routes          RouteLimits `json:"routes" yaml:"routes" env:"RATE_LIMIT_ROUTES"`
+    //AuthFailures is how many requests an ip can make that fail
+    //authentication before it is turned away without a lookup
+    AuthFailures    string      `json:"auth_failures" yaml:"auth_failures" env:"RATE_LIMIT_AUTH_FAILURES"`
+    TrustProxy      bool        `json:"trust_proxy" yaml:"trust_proxy" env:"TRUST_PROXY"`
+}
+
+//HealthConfig controls the /healthz and /readyz probes
+type HealthConfig struct {
+    //Timeout is how long each dependency gets to answer a probe
+    Timeout     Duration    `json:"timeout" yaml:"timeout" env:"HEALTH_TIMEOUT"`
+    //CheckAuth adds the auth service to the probes in the remote auth mode
+    CheckAuth   bool        `json:"check_auth" yaml:"check_auth" env:"HEALTH_CHECK_AUTH"`
+    //DrainDelay is how long readiness fails before shutting down, so load
+    //balancers stop sending requests first
+    DrainDelay  Duration    `json:"drain_delay" yaml:"drain_delay" env:"HEALTH_DRAIN_DELAY"`
+}
+
+//TracingConfig selects where spans are exported to
+type TracingConfig struct {
+    //Exporter is none, otlp or stdout
+    Exporter    string  `json:"exporter" yaml:"exporter" env:"TRACING_EXPORTER"`
+    //Endpoint is the url of the OTLP/HTTP collector, the OTEL_EXPORTER_OTLP
+    //variables are used when it is empty
+    Endpoint    string  `json:"endpoint" yaml:"endpoint" env:"TRACING_OTLP_ENDPOINT"`
+    //File is written to by the stdout exporter instead of stdout when set
+    File        string  `json:"file" yaml:"file" env:"TRACING_FILE"`
+    //SampleRatio is the share of new traces that are recorded, requests
+    //that come with a trace follow the sampling decision of the caller
+    SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+    ServiceName string  `json:"service_name" yaml:"service_name" env:"TRACING_SERVICE_NAME"`
+}
+
+//Duration is a time.Duration written like 30s in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+    value, err := time.ParseDuration(string(text))
+    *d = Duration(value)
+    return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+    return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+    var text string
+    err := unmarshal(&text)
+    if err != nil {
+        return err
+    }
+    return d.UnmarshalText([]byte(text))
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+    return time.Duration(d).String(), nil
+}
+
+//RouteLimits maps routes to limits, in the environment it is written like
+//"POST /api/posts=10/1m;POST /api/comments=30/1m"
+type RouteLimits map[string]string
+
+func (r *RouteLimits) UnmarshalText(text []byte) error {
+    routes := RouteLimits{}
+    for _, entry := range strings.Split(string(text), ";") {
+        if strings.TrimSpace(entry) == "" {
+            continue
+        }
+        parts := strings.SplitN(entry, "=", 2)
+        if len(parts) != 2 {
+            return fmt.Errorf("%q should look like POST /api/posts=10/1m", entry)
+        }
+        routes[strings.Join(strings.Fields(parts[0]), " ")] = strings.TrimSpace(parts[1])
+    }
+    *r = routes
+    return nil
+}
+
+//DefaultConfig is used for anything not set elsewhere
+func DefaultConfig() Config {
+    return Config{
+        Port:            "3000",
+        LogLevel:        "info",
+        ShutdownTimeout: Duration(15 * time.Second),
+        Database: DatabaseConfig{
+            SSLMode: "disable",
+        },
+        Auth: AuthConfig{
+            Mode:             AuthModeRemote,
+            Timeout:          Duration(2 * time.Second),
+            Retries:          2,
+            RetryBackoff:     Duration(100 * time.Millisecond),
+            BreakerThreshold: 5,
+            BreakerCooldown:  Duration(30 * time.Second),
+        },
+        Tokens: TokenConfig{
+            NegativeTTL:       Duration(30 * time.Second),
+            RevokedTTL:        Duration(24 * time.Hour),
+            RevocationChannel: "tokens:revoked",
+        },
+        RateLimits: RateLimitConfig{
+            Reads:  "300/1m",
+            Writes: "60/1m",
+            Routes: RouteLimits{
+                "POST /api/posts":    "10/1m",
+                "POST /api/comments": "30/1m",
+            },
+            AuthFailures: "20/1m",
+        },
+        Health: HealthConfig{
+            Timeout:    Duration(2 * time.Second),
+            DrainDelay: Duration(5 * time.Second),
+        },
+        Tracing: TracingConfig{
+            Exporter:    TracingExporterNone,
+            SampleRatio: 1,
+            ServiceName: "grouper-api",
+        },
+        MaxCommentDepth: 5,
+        ReactionTypes:   []string{"like", "love", "laugh", "wow", "sad", "angry"},
+    }
+}
+
+//ConfigErrors lists every problem found with a config
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+    return "Invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+//LoadConfig builds the config, path may name a YAML or JSON file and a
+//missing .env file is fine
+func LoadConfig(path string) (Config, error) {
+    cfg := DefaultConfig()
+
+    if path != "" {
+        err := loadConfigFile(path, &cfg)
+        if err != nil {
+            return cfg, err
+        }
+    }
+
+    err := godotenv.Load()
+    if err != nil && !os.IsNotExist(err) {
+        return cfg, err
+    }
+
+    problems := applyEnv(reflect.ValueOf(&cfg).Elem(), os.LookupEnv)
+    problems = append(problems, cfg.validate()...)
+    if len(problems) > 0 {
+        return cfg, problems
+    }
+    return cfg, nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".json":
+        // like yaml below unknown keys are checked before cfg is touched
+        decoder := json.NewDecoder(bytes.NewReader(data))
+        decoder.DisallowUnknownFields()
+        err = decoder.Decode(&Config{})
+        if err == nil {
+            err = json.Unmarshal(data, cfg)
+        }
+    case ".yaml", ".yml":
+        // check for unknown keys against an empty config, strict decoding
+        // also rejects keys already set in maps by the defaults
+        err = yaml.UnmarshalStrict(data, &Config{})
+        if err == nil {
+            err = yaml.Unmarshal(data, cfg)
+        }
+    default:
+        return fmt.Errorf("Config file %s should be .json, .yaml or .yml", path)
+    }
+    if err != nil {
+        return fmt.Errorf("Failed to read config file %s: %s", path, err)
+    }
+    return nil
+}
+
+//applyEnv sets every field with an env tag whose variable is set, returning
+//a problem for each value that can't be parsed
+func applyEnv(v reflect.Value, lookup func(string) (string, bool)) ConfigErrors {
+    var problems ConfigErrors
+    for i := 0; i < v.NumField(); i++ {
+        field := v.Field(i)
+        name := v.Type().Field(i).Tag.Get("env")
+        if name == "" {
+            if field.Kind() == reflect.Struct {
+                problems = append(problems, applyEnv(field, lookup)...)
+            }
+            continue
+        }
+
+        value, ok := lookup(name)
+        if !ok || value == "" {
+            continue
+        }
+
+        var err error
+        if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+            err = unmarshaler.UnmarshalText([]byte(value))
+        } else {
+            switch field.Kind() {
+            case reflect.String:
+                field.SetString(value)
+            case reflect.Int:
+                var n int
+                n, err = strconv.Atoi(value)
+                field.SetInt(int64(n))
+            case reflect.Bool:
+                var b bool
+                b, err = strconv.ParseBool(value)
+                field.SetBool(b)
+            case reflect.Float64:
+                var f float64
+                f, err = strconv.ParseFloat(value, 64)
+                field.SetFloat(f)
+            case reflect.Slice:
+                items := []string{}
+                for _, item := range strings.Split(value, ",") {
+                    if item = strings.TrimSpace(item); item != "" {
+                        items = append(items, item)
+                    }
+                }
+                field.Set(reflect.ValueOf(items))
+            }
+        }
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: %q is not valid", name, value))
+        }
+    }
+    return problems
+}
+
+//validate reports every missing or invalid setting
+func (cfg Config) validate() ConfigErrors {
+    var problems ConfigErrors
+    problem := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    if port, err := strconv.Atoi(cfg.Port); err != nil || port <= 0 || port > 65535 {
+        problem("port: %q is not a valid port", cfg.Port)
+    }
+    if !validLogLevel(cfg.LogLevel) {
+        problem("log_level (LOG_LEVEL): %q should be debug, info, warn or error", cfg.LogLevel)
+    }
+    if cfg.MetricsPort != "" {
+        if port, err := strconv.Atoi(cfg.MetricsPort); err != nil || port <= 0 || port > 65535 {
+            problem("metrics_port: %q is not a valid port", cfg.MetricsPort)
+        } else if cfg.MetricsPort == cfg.Port {
+            problem("metrics_port: has to differ from port")
+        }
+    }
+    if cfg.StartupTimeout < 0 {
+        problem("startup_timeout (STARTUP_TIMEOUT) can't be negative")
+    }
+    if cfg.ShutdownTimeout <= 0 {
+        problem("shutdown_timeout (SHUTDOWN_TIMEOUT) should be positive")
+    }
+    if cfg.Database.Host == "" {
+        problem("database.host (DBHOST) is required")
+    }
+    if cfg.Database.User == "" {
+        problem("database.user (DBUSER) is required")
+    }
+    if cfg.Database.Name == "" {
+        problem("database.name (DBNAME) is required")
+    }
+    if cfg.Redis.Address == "" {
+        problem("redis.address (REDIS_ADDRESS) is required")
+    }
+
+    switch cfg.Auth.Mode {
+    case AuthModeRemote:
+        if cfg.Auth.URL == "" {
+            problem("auth.url (AUTH_URL) is required in the remote auth mode")
+        }
+    case AuthModeJWT:
+        if cfg.Auth.JWT.Algorithm != jwtHS256 && cfg.Auth.JWT.Algorithm != jwtRS256 {
+            problem("auth.jwt.algorithm (JWT_ALGORITHM) should be %s or %s", jwtHS256, jwtRS256)
+        }
+        if cfg.Auth.JWT.KeyFile == "" && cfg.Auth.JWT.JWKSFile == "" {
+            problem("auth.jwt.key_file (JWT_KEY_FILE) or auth.jwt.jwks_file (JWT_JWKS_FILE) is required in the jwt auth mode")
+        }
+    default:
+        problem("auth.mode (AUTH_MODE) should be %s or %s", AuthModeRemote, AuthModeJWT)
+    }
+    if cfg.Auth.Timeout <= 0 {
+        problem("auth.timeout (AUTH_TIMEOUT) should be positive")
+    }
+    if cfg.Auth.Retries < 0 {
+        problem("auth.retries (AUTH_RETRIES) can't be negative")
+    }
+    if cfg.Auth.RetryBackoff < 0 {
+        problem("auth.retry_backoff (AUTH_RETRY_BACKOFF) can't be negative")
+    }
+    if cfg.Auth.BreakerThreshold < 0 {
+        problem("auth.breaker_threshold (AUTH_BREAKER_THRESHOLD) can't be negative")
+    }
+    if cfg.Auth.BreakerCooldown <= 0 {
+        problem("auth.breaker_cooldown (AUTH_BREAKER_COOLDOWN) should be positive")
+    }
+
+    if cfg.Tokens.NegativeTTL < 0 {
+        problem("tokens.negative_ttl (TOKEN_NEGATIVE_TTL) can't be negative")
+    }
+    if cfg.Tokens.RevokedTTL <= 0 {
+        problem("tokens.revoked_ttl (TOKEN_REVOKED_TTL) should be positive")
+    }
+    if cfg.Tokens.RevocationChannel == "" {
+        problem("tokens.revocation_channel (REVOCATION_CHANNEL) is required")
+    }
+
+    if _, err := parseRateLimit(cfg.RateLimits.Reads); err != nil {
+        problem("rate_limits.reads (RATE_LIMIT_READS): %s", err)
+    }
+    if _, err := parseRateLimit(cfg.RateLimits.Writes); err != nil {
+        problem("rate_limits.writes (RATE_LIMIT_WRITES): %s", err)
+    }
+    if _, err := parseRateLimit(cfg.RateLimits.AuthFailures); err != nil {
+        problem("rate_limits.auth_failures (RATE_LIMIT_AUTH_FAILURES): %s", err)
+    }
+    routes := make([]string, 0, len(cfg.RateLimits.Routes))
+    for route := range cfg.RateLimits.Routes {
+        routes = append(routes, route)
+    }
+    sort.Strings(routes)
+    for _, route := range routes {
+        if _, err := parseRateLimit(cfg.RateLimits.Routes[route]); err != nil {
+            problem("rate_limits.routes (RATE_LIMIT_ROUTES) %s: %s", route, err)
+        }
+    }
+
+    if cfg.Health.Timeout <= 0 {
+        problem("health.timeout (HEALTH_TIMEOUT) should be positive")
+    }
+    if cfg.Health.DrainDelay < 0 {
+        problem("health.drain_delay (HEALTH_DRAIN_DELAY) can't be negative")
+    }
+
+    switch cfg.Tracing.Exporter {
+    case TracingExporterNone, TracingExporterOTLP, TracingExporterStdout:
+    default:
+        problem("tracing.exporter (TRACING_EXPORTER): %q should be none, otlp or stdout", cfg.Tracing.Exporter)
+    }
+    if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+        problem("tracing.sample_ratio (TRACING_SAMPLE_RATIO) should be between 0 and 1")
+    }
+    if cfg.Tracing.Exporter != TracingExporterNone && cfg.Tracing.ServiceName == "" {
+        problem("tracing.service_name (TRACING_SERVICE_NAME) is required when tracing is on")
+    }
+
+    if cfg.MaxCommentDepth < 0 {
+        problem("max_comment_depth (COMMENT_MAX_DEPTH) can't be negative")
+    }
+    if len(cfg.ReactionTypes) == 0 {
+        problem("reaction_types (REACTION_TYPES) needs at least one type")
+    }
+    return problems
+}
+
+//rateLimitOptions turns the validated limits into what the limiter uses
+func (cfg RateLimitConfig) rateLimitOptions() RateLimitOptions {
+    options := RateLimitOptions{Routes: make(map[string]RateLimit), TrustProxy: cfg.TrustProxy}
+    options.Reads, _ = parseRateLimit(cfg.Reads)
+    options.Writes, _ = parseRateLimit(cfg.Writes)
+    options.AuthFailures, _ = parseRateLimit(cfg.AuthFailures)
+    for route, value := range cfg.Routes {
+        options.Routes[route], _ = parseRateLimit(value)
+    }
+    return options
+}
+
+//Redacted returns a copy of the config with secrets hidden
+func (cfg Config) Redacted() Config {
+    for _, secret := range []*string{&cfg.Database.Password, &cfg.Redis.Password, &cfg.Tokens.RevocationSecret} {
+        if *secret != "" {
+            *secret = redacted
+        }
+    }
+    return cfg
+}
+
+//PrintConfig writes the config as YAML with secrets redacted
+func PrintConfig(w io.Writer, cfg Config) error {
+    out, err := yaml.Marshal(cfg.Redacted())
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(out)
+    return err
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestApplyEnv(t *testing.T) {
+    cfg := DefaultConfig()
+    env := map[string]string{
+        "PORT":                 "8080",
+        "DBHOST":               "db",
+        "AUTH_TIMEOUT":         "5s",
+        "AUTH_RETRIES":         "4",
+        "TRUST_PROXY":          "true",
+        "REACTION_TYPES":       "up, down",
+        "RATE_LIMIT_ROUTES":    "POST /api/posts=5/1m",
+        "JWT_KEY_FILE":         "",
+        "TRACING_SAMPLE_RATIO": "0.25",
+    }
+    lookup := func(name string) (string, bool) {
+        value, ok := env[name]
+        return value, ok
+    }
+
+    problems := applyEnv(reflect.ValueOf(&cfg).Elem(), lookup)
+    if len(problems) != 0 {
+        t.Fatalf("Unexpected problems %v", problems)
+    }
+    if cfg.Port != "8080" || cfg.Database.Host != "db" || cfg.Auth.Retries != 4 || !cfg.RateLimits.TrustProxy {
+        t.Errorf("Env was not applied: %+v", cfg)
+    }
+    if time.Duration(cfg.Auth.Timeout) != 5*time.Second {
+        t.Errorf("Expected a 5s timeout, got %v", time.Duration(cfg.Auth.Timeout))
+    }
+    if cfg.Tracing.SampleRatio != 0.25 {
+        t.Errorf("Expected a 0.25 sample ratio, got %v", cfg.Tracing.SampleRatio)
+    }
+    if strings.Join(cfg.ReactionTypes, ",") != "up,down" {
+        t.Errorf("Unexpected reaction types %v", cfg.ReactionTypes)
+    }
+    if len(cfg.RateLimits.Routes) != 1 || cfg.RateLimits.Routes["POST /api/posts"] != "5/1m" {
+        t.Errorf("Unexpected routes %v", cfg.RateLimits.Routes)
+    }
+
+    env = map[string]string{"AUTH_RETRIES": "many", "AUTH_TIMEOUT": "soon"}
+    problems = applyEnv(reflect.ValueOf(&cfg).Elem(), lookup)
+    if len(problems) != 2 {
+        t.Errorf("Expected a problem for each bad value, got %v", problems)
+    }
+}
+
+func TestConfigValidateReportsEverything(t *testing.T) {
+    cfg := DefaultConfig()
+    cfg.Port = "http"
+    cfg.Auth.Mode = AuthModeJWT
+    cfg.RateLimits.Reads = "lots"
+    cfg.Tracing.Exporter = "zipkin"
+    cfg.Tracing.SampleRatio = 2
+
+    problems := cfg.validate()
+    expected := []string{"port", "database.host", "database.user", "database.name", "redis.address",
+        "auth.jwt.algorithm", "auth.jwt.key_file", "rate_limits.reads", "tracing.exporter", "tracing.sample_ratio"}
+    if len(problems) != len(expected) {
+        t.Errorf("Expected %d problems, got %v", len(expected), problems)
+    }
+    for i, field := range expected {
+        if i < len(problems) && !strings.HasPrefix(problems[i], field) {
+            t.Errorf("Expected problem %d to be about %s, got %s", i, field, problems[i])
+        }
+    }
+
+    cfg = DefaultConfig()
+    cfg.Database = DatabaseConfig{Host: "db", User: "user", Name: "grouper", SSLMode: "disable"}
+    cfg.Redis.Address = "redis:6379"
+    cfg.Auth.URL = "http://auth"
+    if problems := cfg.validate(); len(problems) != 0 {
+        t.Errorf("Expected a valid config, got %v", problems)
+    }
+}
+
+func TestLoadConfigFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "config")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    yamlPath := filepath.Join(dir, "config.yaml")
+    ioutil.WriteFile(yamlPath, []byte(`
+port: "4000"
+database:
+  host: db
+  password: hunter2
+auth:
+  timeout: 750ms
+rate_limits:
+  routes:
+    POST /api/posts: 1/1s
+`), 0600)
+
+    cfg := DefaultConfig()
+    err = loadConfigFile(yamlPath, &cfg)
+    if err != nil {
+        t.Fatalf("Failed to load yaml: %s", err)
+    }
+    if cfg.Port != "4000" || cfg.Database.Host != "db" || time.Duration(cfg.Auth.Timeout) != 750*time.Millisecond {
+        t.Errorf("Unexpected config %+v", cfg)
+    }
+    if cfg.RateLimits.Routes["POST /api/posts"] != "1/1s" || cfg.RateLimits.Reads != "300/1m" {
+        t.Errorf("Expected the file to only override what it sets, got %+v", cfg.RateLimits)
+    }
+
+    jsonPath := filepath.Join(dir, "config.json")
+    ioutil.WriteFile(jsonPath, []byte(`{"redis": {"address": "cache:6379"}, "tokens": {"negative_ttl": "1m"}}`), 0600)
+    err = loadConfigFile(jsonPath, &cfg)
+    if err != nil {
+        t.Fatalf("Failed to load json: %s", err)
+    }
+    if cfg.Redis.Address != "cache:6379" || time.Duration(cfg.Tokens.NegativeTTL) != time.Minute {
+        t.Errorf("Unexpected config %+v", cfg)
+    }
+
+    ioutil.WriteFile(yamlPath, []byte("prot: 4000\n"), 0600)
+    if err := loadConfigFile(yamlPath, &cfg); err == nil {
+        t.Error("Expected unknown keys to be rejected")
+    }
+    ioutil.WriteFile(jsonPath, []byte(`{"port": "5000", "redis": {"adress": "cache:6379"}}`), 0600)
+    if err := loadConfigFile(jsonPath, &cfg); err == nil {
+        t.Error("Expected unknown json keys to be rejected")
+    }
+    if cfg.Port != "4000" {
+        t.Errorf("Expected a rejected file to leave the config alone, got port %s", cfg.Port)
+    }
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+    cfg := DefaultConfig()
+    cfg.Database.Password = "hunter2"
+    cfg.Tokens.RevocationSecret = "shh"
+
+    var out bytes.Buffer
+    err := PrintConfig(&out, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "shh") {
+        t.Errorf("Secrets were printed:\n%s", out.String())
+    }
+    if !strings.Contains(out.String(), redacted) || !strings.Contains(out.String(), "timeout: 2s") {
+        t.Errorf("Unexpected output:\n%s", out.String())
+    }
+    if cfg.Database.Password != "hunter2" {
+        t.Error("Redacting should not change the config")
+    }
+}
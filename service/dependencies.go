@@ -0,0 +1,133 @@
+package service
+
+import (
+    "context"
+    "log/slog"
+    "time"
+
+    "github.com/jinzhu/gorm"
+    "go.opentelemetry.io/otel/trace"
+    "gopkg.in/redis.v4"
+)
+
+const (
+    //startupRetryWait is how long to wait between connection attempts at
+    //startup
+    startupRetryWait = time.Second
+    //tracingFlushTimeout is how long Close waits for spans to be exported
+    tracingFlushTimeout = 5 * time.Second
+)
+
+//Dependencies are the connections and clients a server is built on, so more
+//than one server can run in a process. Auth is built from the config when it
+//is nil
+type Dependencies struct {
+    DB          *gorm.DB
+    Cache       *redis.Client
+    Auth        authClient
+    Catalog     serviceCatalogClient
+    //Clock defaults to time.Now
+    Clock       func() time.Time
+    //Metrics is shared by the clients above and the server, NewServer makes
+    //its own when it is nil
+    Metrics     *Metrics
+    //Logger defaults to slog.Default
+    Logger      *slog.Logger
+    //Tracer defaults to one that records nothing
+    Tracer      trace.Tracer
+
+    tracing     *Tracing
+}
+
+//NewDependencies opens the database and redis connections and builds the
+//clients described by cfg, connecting is retried for cfg.StartupTimeout
+func NewDependencies(cfg Config, logger *slog.Logger) (Dependencies, error) {
+    tracing, err := NewTracing(cfg.Tracing)
+    if err != nil {
+        return Dependencies{}, err
+    }
+    deps := Dependencies{
+        Metrics: NewMetrics(),
+        Logger:  logger,
+        Tracer:  tracing.Tracer(),
+        Clock:   time.Now,
+        tracing: tracing,
+    }
+    deps.Catalog = CatalogWebClient{
+        RootURL:    cfg.PublishURL,
+        ServiceURL: cfg.URL,
+        Logger:     logger,
+        Tracer:     deps.Tracer,
+    }
+    deps.Auth, err = newAuthClient(cfg.Auth, deps)
+    if err != nil {
+        deps.Close()
+        return Dependencies{}, err
+    }
+
+    timeout := time.Duration(cfg.StartupTimeout)
+    err = retryUntilReady(logger, "postgres", timeout, startupRetryWait, func() (err error) {
+        deps.DB, err = InitDatabase(cfg.Database)
+        return err
+    })
+    if err != nil {
+        deps.Close()
+        return Dependencies{}, err
+    }
+    err = retryUntilReady(logger, "redis", timeout, startupRetryWait, func() (err error) {
+        deps.Cache, err = InitRedisClient(cfg.Redis.Address, cfg.Redis.Password)
+        return err
+    })
+    if err != nil {
+        deps.Close()
+        return Dependencies{}, err
+    }
+    return deps, nil
+}
+
+//retryUntilReady calls connect until it succeeds or timeout has passed,
+//a timeout of 0 gives up after the first attempt
+func retryUntilReady(logger *slog.Logger, name string, timeout, wait time.Duration, connect func() error) error {
+    deadline := time.Now().Add(timeout)
+    for {
+        err := connect()
+        if err == nil {
+            return nil
+        }
+        if time.Now().Add(wait).After(deadline) {
+            return err
+        }
+        logger.Warn("Waiting for dependency", "dependency", name, "error", err)
+        time.Sleep(wait)
+    }
+}
+
+//withDefaults fills in the logger, tracer and clock when they weren't given
+func (deps Dependencies) withDefaults() Dependencies {
+    if deps.Logger == nil {
+        deps.Logger = slog.Default()
+    }
+    if deps.Tracer == nil {
+        deps.Tracer = noopTracer
+    }
+    if deps.Clock == nil {
+        deps.Clock = time.Now
+    }
+    return deps
+}
+
+//Close flushes the spans left to export and closes the database and redis
+//connections
+func (deps Dependencies) Close() {
+    if deps.tracing != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+        defer cancel()
+        deps.tracing.Shutdown(ctx)
+    }
+    if deps.DB != nil {
+        deps.DB.Close()
+    }
+    if deps.Cache != nil {
+        deps.Cache.Close()
+    }
+}
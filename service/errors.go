@@ -0,0 +1,31 @@
+package service
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+const (
+    errCodeMissingToken      = "missing_token"
+    errCodeInvalidToken      = "invalid_token"
+    errCodeExpiredToken      = "expired_token"
+    errCodeRevokedToken      = "revoked_token"
+    errCodeAuthUnavailable   = "auth_unavailable"
+    errCodeInsufficientScope = "insufficient_scope"
+    errCodeUserRequired      = "user_required"
+    errCodeRateLimited       = "rate_limited"
+)
+
+//apiError is the body sent for errors clients need to tell apart, code is
+//stable and meant for machines while message is for people
+type apiError struct {
+    Code        string  `json:"code"`
+    Message     string  `json:"message"`
+}
+
+//writeError sends an apiError as json with the given status
+func writeError(w http.ResponseWriter, status int, code, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(apiError{Code: code, Message: message})
+}
@@ -5,6 +5,8 @@ import (
     "io/ioutil"
     "encoding/json"
     "strconv"
+    "strings"
+    "unicode/utf8"
 
     "github.com/gorilla/mux"
     "github.com/unrolled/render"
@@ -12,17 +14,31 @@ import (
 
 func getGroupsHandler(formatter *render.Render, repo repository) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
-        groups, err := repo.getGroups()
+        repo := repoFor(req, repo)
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        groups, err := repo.getGroups(readableGroups(caller), page)
         if err != nil {
             formatter.JSON(w, http.StatusInternalServerError, "Failed to get groups")
             return
         }
-        formatter.JSON(w, http.StatusOK, groups)
+        formatter.JSON(w, http.StatusOK, pageOf(groups, page))
     }
 }
 
 func getGroupHandler(formatter *render.Render, repo repository) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
         vars := mux.Vars(req)
         id := vars["id"]
         group, err := repo.getGroup(id)
@@ -30,45 +46,53 @@ func getGroupHandler(formatter *render.Render, repo repository) http.HandlerFunc
             formatter.JSON(w, http.StatusNotFound, "Group not found")
             return
         }
+
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canReadGroup(repo, group, caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
         formatter.JSON(w, http.StatusOK, group)
     }
 }
 
+//contentTooLong counts characters rather than bytes, like the varchar column
+func contentTooLong(content string) bool {
+    return utf8.RuneCountInString(content) > maxContentLength
+}
+
 func postGroupHandler(formatter *render.Render, repo repository) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
         var group Group
 
         payload, _ := ioutil.ReadAll(req.Body)
         err := json.Unmarshal(payload, &group)
-        if err != nil || (group == Group{}) {
+        if err != nil || strings.TrimSpace(group.Name) == "" {
             formatter.JSON(w, http.StatusBadRequest, "Failed to parse add group command.")
             return
         }
 
-        err = repo.addGroup(group)
-        if err != nil {
-            formatter.JSON(w, http.StatusInternalServerError, "Failed to create group.")
-            return
-        }
-
-        key := req.Header.Get("Authorization")
-        user, err := repo.redisGetValue(key)
+        userID, err := userIDFromRequest(req)
         if err != nil {
             formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
             return
         }
 
-        userID, _ := strconv.ParseUint(user, 10, 32)
-
-        err = repo.addGroupMember(group.ID, uint(userID))
+        group.OwnerID = userID
+        _, err = repo.createGroup(group)
         if err != nil {
-            formatter.JSON(w, http.StatusInternalServerError, "Failed to join group.")
-            return
-        }
-
-        err = repo.addGroupAdmin(group.ID, uint(userID))
-        if err != nil {
-            formatter.JSON(w, http.StatusInternalServerError, "Failed to join admin of group.")
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to create group.")
             return
         }
         formatter.JSON(w, http.StatusCreated, "Group succesfully created.")
@@ -77,6 +101,7 @@ func postGroupHandler(formatter *render.Render, repo repository) http.HandlerFun
 
 func postPostHandler(formatter *render.Render, repo repository) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
         var post Post
 
         payload, _ := ioutil.ReadAll(req.Body)
@@ -85,16 +110,35 @@ func postPostHandler(formatter *render.Render, repo repository) http.HandlerFunc
             formatter.JSON(w, http.StatusBadRequest, "Failed to parse post.")
             return
         }
+        if contentTooLong(post.Content) {
+            formatter.JSON(w, http.StatusBadRequest, "Content is too long.")
+            return
+        }
+
+        group, err := repo.getGroup(strconv.FormatUint(uint64(post.GroupID), 10))
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
 
-        key := req.Header.Get("Authorization")
-        user, err := repo.redisGetValue(key)
+        caller, err := callerFromRequest(req)
         if err != nil {
             formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
             return
         }
-        userID, _ := strconv.ParseUint(user, 10, 32)
 
-        post.UserID = uint(userID)
+        ok, err := canWriteGroup(repo, group.ID, caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        post.UserID = caller.UserID
+        post.BotID = caller.BotID
         err = repo.addPost(post)
         if err != nil {
             formatter.JSON(w, http.StatusInternalServerError, "Failed to create post.")
@@ -104,8 +148,9 @@ func postPostHandler(formatter *render.Render, repo repository) http.HandlerFunc
     }
 }
 
-func getPostHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+func getPostHandler(formatter *render.Render, repo repository, rules contentRules) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
         vars := mux.Vars(req)
         id := vars["id"]
         post, err := repo.getPost(id)
@@ -113,46 +158,142 @@ func getPostHandler(formatter *render.Render, repo repository) http.HandlerFunc
             formatter.JSON(w, http.StatusNotFound, "Post not found")
             return
         }
-        formatter.JSON(w, http.StatusOK, post)
+
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canReadPost(repo, post, caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        reactions, err := summarizeReactions(repo, rules, reactionTargetPost, post.ID, caller.UserID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get reactions.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, postResponse{Post: post, Reactions: reactions})
     }
 }
 
 func getPostsHandler(formatter *render.Render, repo repository) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
-        groups := req.URL.Query()["group"]
-        posts, err := repo.getPostsByGroup(groups)
+        repo := repoFor(req, repo)
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        groups, err := readableGroupIDs(repo, req.URL.Query()["group"], caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        posts, err := repo.getPostsByGroup(groups, page)
         if err != nil {
             formatter.JSON(w, http.StatusNotFound, "Failed to find posts")
+            return
         }
-        formatter.JSON(w, http.StatusOK, posts)
+
+        formatter.JSON(w, http.StatusOK, pageOf(posts, page))
     }
 }
 
 func getCommentsHandler(formatter *render.Render, repo repository) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
-        posts := req.URL.Query()["post"]
-        comments, err := repo.getCommentsByPost(posts)
+        repo := repoFor(req, repo)
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        posts, err := readablePostIDs(repo, req.URL.Query()["post"], caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        if req.URL.Query().Get("tree") == "true" {
+            threads, err := commentThreads(repo, posts, page)
+            if err != nil {
+                formatter.JSON(w, http.StatusNotFound, "Failed to find comments")
+                return
+            }
+            formatter.JSON(w, http.StatusOK, threads)
+            return
+        }
+
+        comments, err := repo.getCommentsByPost(posts, page)
         if err != nil {
             formatter.JSON(w, http.StatusNotFound, "Failed to find comments")
+            return
         }
-        formatter.JSON(w, http.StatusOK, comments)
+        formatter.JSON(w, http.StatusOK, pageOf(comments, page))
     }
 }
 
-func getCommentHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+func getCommentHandler(formatter *render.Render, repo repository, rules contentRules) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
         vars := mux.Vars(req)
         id := vars["id"]
         comment, err := repo.getComment(id)
         if err != nil {
             formatter.JSON(w, http.StatusNotFound, "Failed to find comment")
+            return
         }
-        formatter.JSON(w, http.StatusOK, comment)
+
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canReadComment(repo, comment, caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        reactions, err := summarizeReactions(repo, rules, reactionTargetComment, comment.ID, caller.UserID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get reactions.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, commentResponse{Comment: comment, Reactions: reactions})
     }
 }
 
-func postCommentHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+func postCommentHandler(formatter *render.Render, repo repository, rules contentRules) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
         var comment Comment
 
         payload, _ := ioutil.ReadAll(req.Body)
@@ -161,15 +302,50 @@ func postCommentHandler(formatter *render.Render, repo repository) http.HandlerF
             formatter.Text(w, http.StatusBadRequest, "Failed to parse comment.")
             return
         }
+        if contentTooLong(comment.Content) {
+            formatter.JSON(w, http.StatusBadRequest, "Content is too long.")
+            return
+        }
 
-        key := req.Header.Get("Authorization")
-        user, err := repo.redisGetValue(key)
+        caller, err := callerFromRequest(req)
         if err != nil {
             formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
             return
         }
-        userID, _ := strconv.ParseUint(user, 10, 32)
-        comment.UserID = uint(userID)
+
+        post, err := repo.getPost(strconv.FormatUint(uint64(comment.PostID), 10))
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Post not found.")
+            return
+        }
+
+        ok, err := canWriteGroup(repo, post.GroupID, caller)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        comment.Depth = 0
+        comment.Deleted = false
+        if comment.ParentID != 0 {
+            parent, err := repo.getComment(strconv.FormatUint(uint64(comment.ParentID), 10))
+            if err != nil || parent.PostID != comment.PostID || parent.Deleted {
+                formatter.JSON(w, http.StatusBadRequest, "Parent comment not found on this post.")
+                return
+            }
+            if parent.Depth + 1 > rules.maxCommentDepth {
+                formatter.JSON(w, http.StatusBadRequest, "Reply is nested too deeply.")
+                return
+            }
+            comment.Depth = parent.Depth + 1
+        }
+
+        comment.UserID = caller.UserID
+        comment.BotID = caller.BotID
         err = repo.addComment(comment)
         if err != nil {
             formatter.JSON(w, http.StatusInternalServerError, "Failed to create comment.")
@@ -179,6 +355,283 @@ func postCommentHandler(formatter *render.Render, repo repository) http.HandlerF
     }
 }
 
+func putGroupHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var update struct {
+            Name    *string `json:"name"`
+            Private *bool   `json:"private"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &update)
+        if err != nil || (update.Name == nil && update.Private == nil) || (update.Name != nil && strings.TrimSpace(*update.Name) == "") {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse group update.")
+            return
+        }
+
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        if update.Name != nil {
+            group.Name = *update.Name
+        }
+        if update.Private != nil {
+            group.Private = *update.Private
+        }
+
+        err = repo.updateGroup(group)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to update group.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, group)
+    }
+}
+
+func deleteGroupHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        err = repo.deleteGroup(group.ID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to delete group.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Group succesfully deleted.")
+    }
+}
+
+func putPostHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var update struct {
+            Title   *string `json:"title"`
+            Content *string `json:"content"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &update)
+        if err != nil || (update.Title == nil && update.Content == nil) {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse post update.")
+            return
+        }
+        if update.Content != nil && strings.TrimSpace(*update.Content) == "" {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse post update.")
+            return
+        }
+        if update.Content != nil && contentTooLong(*update.Content) {
+            formatter.JSON(w, http.StatusBadRequest, "Content is too long.")
+            return
+        }
+
+        vars := mux.Vars(req)
+        post, err := repo.getPost(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Post not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        if post.UserID != userID {
+            formatter.JSON(w, http.StatusForbidden, "Not the author of this post.")
+            return
+        }
+
+        if update.Title != nil {
+            post.Title = *update.Title
+        }
+        if update.Content != nil {
+            post.Content = *update.Content
+        }
+
+        err = repo.updatePost(post)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to update post.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, post)
+    }
+}
+
+func deletePostHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        post, err := repo.getPost(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Post not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canRemovePost(repo, post, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not allowed to delete this post.")
+            return
+        }
+
+        err = repo.deletePost(post.ID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to delete post.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Post succesfully deleted.")
+    }
+}
+
+func putCommentHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var update struct {
+            Content *string `json:"content"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &update)
+        if err != nil || update.Content == nil || strings.TrimSpace(*update.Content) == "" {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse comment update.")
+            return
+        }
+        if contentTooLong(*update.Content) {
+            formatter.JSON(w, http.StatusBadRequest, "Content is too long.")
+            return
+        }
+
+        vars := mux.Vars(req)
+        comment, err := repo.getComment(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Failed to find comment")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        if comment.Deleted {
+            formatter.JSON(w, http.StatusNotFound, "Failed to find comment")
+            return
+        }
+        if comment.UserID != userID {
+            formatter.JSON(w, http.StatusForbidden, "Not the author of this comment.")
+            return
+        }
+
+        comment.Content = *update.Content
+        err = repo.updateComment(comment)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to update comment.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, comment)
+    }
+}
+
+func deleteCommentHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        comment, err := repo.getComment(vars["id"])
+        if err != nil || comment.Deleted {
+            formatter.JSON(w, http.StatusNotFound, "Failed to find comment")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canRemoveComment(repo, comment, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not allowed to delete this comment.")
+            return
+        }
+
+        replies, err := repo.countReplies(comment.ID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to delete comment.")
+            return
+        }
+
+        // comments with replies leave a tombstone so the thread stays intact
+        if replies > 0 {
+            err = repo.tombstoneComment(comment.ID)
+        } else {
+            err = repo.deleteComment(comment.ID)
+        }
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to delete comment.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Comment succesfully deleted.")
+    }
+}
+
 func getPingHandler(formatter *render.Render) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
         formatter.JSON(w, http.StatusOK, "PING!")
@@ -8,13 +8,16 @@ import (
     "io/ioutil"
     "net/http"
     "net/http/httptest"
+    "sort"
     "strconv"
+    "strings"
     "time"
 
 
     "github.com/unrolled/render"
     "github.com/urfave/negroni"
     "github.com/gorilla/mux"
+    "github.com/jinzhu/gorm"
 )
 
 var (
@@ -29,16 +32,80 @@ type repoTest struct {
     comments        []Comment
     groupMembers    []GroupMember
     groupAdmins     []GroupAdmin
+    adminEvents     []GroupAdminEvent
+    invites         []GroupInvite
+    joinRequests    []GroupJoinRequest
+    reactions       []Reaction
+    apiKeys         []APIKey
+    hashes          map[string]map[string]int64
     redis           map[string]string
+    clock           func() time.Time
 }
 
-func (r *repoTest) addGroup(group Group) error {
+func (r *repoTest) now() time.Time {
+    if r.clock != nil {
+        return r.clock()
+    }
+    return time.Now()
+}
+
+func (r *repoTest) addGroup(group Group) (Group, error) {
+    if group.ID == 0 {
+        group.ID = uint(len(r.groups) + 1)
+    }
     r.groups = append(r.groups, group)
-    return nil
+    return group, nil
+}
+
+func (r *repoTest) createGroup(group Group) (Group, error) {
+    group, _ = r.addGroup(group)
+    r.addGroupMember(group.ID, group.OwnerID)
+    r.addGroupAdmin(group.ID, group.OwnerID)
+    return group, nil
+}
+
+//pageRows pages through rows the way the repository does, oldest first or
+//newest first, returning up to Limit+1 rows
+func pageRows[T pageRow](rows []T, page pageRequest, newest bool) []T {
+    sorted := append([]T{}, rows...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        a, b := sorted[i].position(), sorted[j].position()
+        if newest {
+            return (&b).after(a.CreatedAt, a.ID)
+        }
+        return (&a).after(b.CreatedAt, b.ID)
+    })
+
+    paged := []T{}
+    for _, row := range sorted {
+        position := row.position()
+        if page.After != nil && newest && !(&position).after(page.After.CreatedAt, page.After.ID) {
+            continue
+        }
+        if page.After != nil && !newest && !page.After.after(position.CreatedAt, position.ID) {
+            continue
+        }
+        paged = append(paged, row)
+    }
+    if len(paged) > page.Limit + 1 {
+        paged = paged[:page.Limit + 1]
+    }
+    return paged
 }
 
-func (r *repoTest) getGroups() ([]Group, error) {
-    return r.groups, nil
+func (r *repoTest) getGroups(access groupAccess, page pageRequest) ([]Group, error) {
+    groups := []Group{}
+    for _, group := range r.groups {
+        member, _ := r.isGroupMember(group.ID, access.userID)
+        granted := false
+        for _, id := range access.groupIDs {
+            granted = granted || id == group.ID
+        }
+        if !group.Private || access.all || member || granted {
+            groups = append(groups, group)
+        }
+    }
+    return pageRows(groups, page, false), nil
 }
 
 func (r *repoTest) getGroup(id string) (Group, error) {
@@ -53,21 +120,53 @@ func (r *repoTest) getGroup(id string) (Group, error) {
     return Group{}, errors.New("Group not found")
 }
 
+func (r *repoTest) updateGroup(group Group) error {
+    for i := range r.groups {
+        if r.groups[i].ID == group.ID {
+            r.groups[i] = group
+        }
+    }
+    return nil
+}
+
+func (r *repoTest) deleteGroup(groupID uint) error {
+    groups := []Group{}
+    for _, group := range r.groups {
+        if group.ID != groupID {
+            groups = append(groups, group)
+        }
+    }
+    r.groups = groups
+
+    for _, post := range r.posts {
+        if post.GroupID == groupID {
+            r.deletePost(post.ID)
+        }
+    }
+    return nil
+}
+
 func (r *repoTest) addPost(post Post) error {
     r.posts = append(r.posts, post)
     return nil
 }
 
-func (r *repoTest) getPostsByGroup(groupsIDs []string) ([]Post, error) {
-    var posts []Post
+func (r *repoTest) getPostsByGroup(groupsIDs []string, page pageRequest) ([]Post, error) {
+    posts := []Post{}
     for _, post := range r.posts {
         for _, group := range groupsIDs {
             groupID,_ := strconv.ParseUint(group, 10, 32)
-            if uint(groupID) == post.GroupID {
+            if uint(groupID) == post.GroupID && page.After.after(post.CreatedAt, post.ID) {
                 posts = append(posts, post)
             }
         }
     }
+    sort.SliceStable(posts, func(i, j int) bool {
+        return (&pageCursor{posts[i].CreatedAt, posts[i].ID}).after(posts[j].CreatedAt, posts[j].ID)
+    })
+    if len(posts) > page.Limit + 1 {
+        posts = posts[:page.Limit + 1]
+    }
     return posts, nil
 }
 
@@ -82,24 +181,88 @@ func (r *repoTest) getPost(id string) (Post, error) {
     return Post{}, errors.New("Post not found")
 }
 
+func (r *repoTest) updatePost(post Post) error {
+    for i := range r.posts {
+        if r.posts[i].ID == post.ID {
+            r.posts[i] = post
+        }
+    }
+    return nil
+}
+
+func (r *repoTest) deletePost(postID uint) error {
+    posts := []Post{}
+    for _, post := range r.posts {
+        if post.ID != postID {
+            posts = append(posts, post)
+        }
+    }
+    r.posts = posts
+
+    comments := []Comment{}
+    for _, comment := range r.comments {
+        if comment.PostID != postID {
+            comments = append(comments, comment)
+        }
+    }
+    r.comments = comments
+    return nil
+}
+
 func (r *repoTest) addComment(comment Comment) error {
     r.comments = append(r.comments, comment)
     return nil
 }
 
-func (r *repoTest) getCommentsByPost(postIDs []string) ([]Comment, error) {
-    var comments []Comment
+func (r *repoTest) getCommentsByPost(postIDs []string, page pageRequest) ([]Comment, error) {
+    comments := []Comment{}
     for _, comment := range r.comments {
         for _, post := range postIDs {
             postID,_ := strconv.ParseUint(post, 10, 32)
-            if uint(postID) == comment.PostID {
+            if uint(postID) == comment.PostID && page.After.after(comment.CreatedAt, comment.ID) {
                 comments = append(comments, comment)
             }
         }
     }
+    sort.SliceStable(comments, func(i, j int) bool {
+        return (&pageCursor{comments[i].CreatedAt, comments[i].ID}).after(comments[j].CreatedAt, comments[j].ID)
+    })
+    if len(comments) > page.Limit + 1 {
+        comments = comments[:page.Limit + 1]
+    }
     return comments, nil
 }
 
+func (r *repoTest) getTopLevelComments(postIDs []string, page pageRequest) ([]Comment, error) {
+    comments, _ := r.getCommentsByPost(postIDs, pageRequest{Limit: len(r.comments)})
+    roots := []Comment{}
+    for _, comment := range comments {
+        if comment.ParentID == 0 && page.After.after(comment.CreatedAt, comment.ID) {
+            roots = append(roots, comment)
+        }
+    }
+    if len(roots) > page.Limit + 1 {
+        roots = roots[:page.Limit + 1]
+    }
+    return roots, nil
+}
+
+func (r *repoTest) getCommentReplies(commentIDs []uint) ([]Comment, error) {
+    parents := make(map[uint]bool, len(commentIDs))
+    for _, id := range commentIDs {
+        parents[id] = true
+    }
+    replies := []Comment{}
+    // comments are stored oldest first, so parents are seen before replies
+    for _, comment := range r.comments {
+        if parents[comment.ParentID] {
+            parents[comment.ID] = true
+            replies = append(replies, comment)
+        }
+    }
+    return replies, nil
+}
+
 func (r *repoTest) getComment(id string) (Comment, error) {
     commentID,_ := strconv.ParseUint(id, 10, 32)
 
@@ -111,7 +274,50 @@ func (r *repoTest) getComment(id string) (Comment, error) {
     return Comment{}, errors.New("Comment not found")
 }
 
+func (r *repoTest) updateComment(comment Comment) error {
+    for i := range r.comments {
+        if r.comments[i].ID == comment.ID {
+            r.comments[i] = comment
+        }
+    }
+    return nil
+}
+
+func (r *repoTest) deleteComment(commentID uint) error {
+    comments := []Comment{}
+    for _, comment := range r.comments {
+        if comment.ID != commentID {
+            comments = append(comments, comment)
+        }
+    }
+    r.comments = comments
+    return nil
+}
+
+func (r *repoTest) countReplies(commentID uint) (int, error) {
+    count := 0
+    for _, comment := range r.comments {
+        if comment.ParentID == commentID {
+            count++
+        }
+    }
+    return count, nil
+}
+
+func (r *repoTest) tombstoneComment(commentID uint) error {
+    for i := range r.comments {
+        if r.comments[i].ID == commentID {
+            r.comments[i].Content = ""
+            r.comments[i].Deleted = true
+        }
+    }
+    return nil
+}
+
 func (r *repoTest) addGroupMember(groupID, userID uint) error {
+    if member, _ := r.isGroupMember(groupID, userID); member {
+        return nil
+    }
     groupMember := GroupMember{UserID: userID, GroupID: groupID}
     r.groupMembers = append(r.groupMembers, groupMember)
     return nil
@@ -123,6 +329,349 @@ func (r *repoTest) addGroupAdmin(groupID, userID uint) error {
     return nil
 }
 
+func (r *repoTest) isGroupMember(groupID, userID uint) (bool, error) {
+    for _, member := range r.groupMembers {
+        if member.GroupID == groupID && member.UserID == userID {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (r *repoTest) getMemberGroupIDs(userID uint) ([]uint, error) {
+    var groupIDs []uint
+    for _, member := range r.groupMembers {
+        if member.UserID == userID {
+            groupIDs = append(groupIDs, member.GroupID)
+        }
+    }
+    return groupIDs, nil
+}
+
+func (r *repoTest) getGroupMembers(groupID uint, page pageRequest) ([]GroupMember, error) {
+    members := []GroupMember{}
+    for _, member := range r.groupMembers {
+        if member.GroupID == groupID {
+            members = append(members, member)
+        }
+    }
+    return pageRows(members, page, false), nil
+}
+
+func (r *repoTest) removeGroupMember(groupID, userID uint) error {
+    members := []GroupMember{}
+    for _, member := range r.groupMembers {
+        if member.GroupID != groupID || member.UserID != userID {
+            members = append(members, member)
+        }
+    }
+    r.groupMembers = members
+    return nil
+}
+
+func (r *repoTest) isGroupAdmin(groupID, userID uint) (bool, error) {
+    for _, admin := range r.groupAdmins {
+        if admin.GroupID == groupID && admin.UserID == userID {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (r *repoTest) countGroupAdmins(groupID uint) (int, error) {
+    count := 0
+    for _, admin := range r.groupAdmins {
+        if admin.GroupID == groupID {
+            count++
+        }
+    }
+    return count, nil
+}
+
+func (r *repoTest) removeGroupAdmin(groupID, userID uint) error {
+    admins := []GroupAdmin{}
+    for _, admin := range r.groupAdmins {
+        if admin.GroupID != groupID || admin.UserID != userID {
+            admins = append(admins, admin)
+        }
+    }
+    r.groupAdmins = admins
+    return nil
+}
+
+func (r *repoTest) getGroupAdmins(groupID uint, page pageRequest) ([]GroupAdmin, error) {
+    admins := []GroupAdmin{}
+    for _, admin := range r.groupAdmins {
+        if admin.GroupID == groupID {
+            admins = append(admins, admin)
+        }
+    }
+    return pageRows(admins, page, false), nil
+}
+
+func (r *repoTest) promoteGroupAdmin(groupID, userID, actorID uint) error {
+    r.addGroupAdmin(groupID, userID)
+    event := GroupAdminEvent{GroupID: groupID, ActorID: actorID, UserID: userID, Action: adminActionPromote}
+    r.adminEvents = append(r.adminEvents, event)
+    return nil
+}
+
+func (r *repoTest) demoteGroupAdmin(groupID, userID, actorID uint) error {
+    r.removeGroupAdmin(groupID, userID)
+    event := GroupAdminEvent{GroupID: groupID, ActorID: actorID, UserID: userID, Action: adminActionDemote}
+    r.adminEvents = append(r.adminEvents, event)
+    return nil
+}
+
+func (r *repoTest) transferGroupOwnership(groupID, userID, actorID uint) error {
+    for i := range r.groups {
+        if r.groups[i].ID == groupID {
+            r.groups[i].OwnerID = userID
+        }
+    }
+    if admin, _ := r.isGroupAdmin(groupID, userID); !admin {
+        r.addGroupAdmin(groupID, userID)
+    }
+    event := GroupAdminEvent{GroupID: groupID, ActorID: actorID, UserID: userID, Action: adminActionTransfer}
+    r.adminEvents = append(r.adminEvents, event)
+    return nil
+}
+
+func (r *repoTest) getGroupAdminEvents(groupID uint, page pageRequest) ([]GroupAdminEvent, error) {
+    events := []GroupAdminEvent{}
+    for _, event := range r.adminEvents {
+        if event.GroupID == groupID {
+            events = append(events, event)
+        }
+    }
+    return pageRows(events, page, true), nil
+}
+
+func (r *repoTest) addGroupInvite(invite GroupInvite) (GroupInvite, error) {
+    if invite.ID == 0 {
+        invite.ID = uint(len(r.invites) + 1)
+    }
+    r.invites = append(r.invites, invite)
+    return invite, nil
+}
+
+func (r *repoTest) getGroupInvite(code string) (GroupInvite, error) {
+    for _, invite := range r.invites {
+        if invite.Code == code {
+            return invite, nil
+        }
+    }
+    return GroupInvite{}, errors.New("Invite not found")
+}
+
+func (r *repoTest) getGroupInvites(groupID uint, page pageRequest) ([]GroupInvite, error) {
+    invites := []GroupInvite{}
+    for _, invite := range r.invites {
+        if invite.GroupID == groupID {
+            invites = append(invites, invite)
+        }
+    }
+    return pageRows(invites, page, true), nil
+}
+
+func (r *repoTest) getUserInvites(userID uint, page pageRequest) ([]GroupInvite, error) {
+    invites := []GroupInvite{}
+    for _, invite := range r.invites {
+        if invite.InviteeID == userID && inviteUsable(invite, r.now()) {
+            invites = append(invites, invite)
+        }
+    }
+    return pageRows(invites, page, true), nil
+}
+
+func (r *repoTest) acceptGroupInvite(inviteID, groupID, userID uint) error {
+    for i := range r.invites {
+        if r.invites[i].ID == inviteID {
+            if r.invites[i].MaxUses != 0 && r.invites[i].Uses >= r.invites[i].MaxUses {
+                return errInviteUsedUp
+            }
+            r.invites[i].Uses++
+        }
+    }
+    return r.addGroupMember(groupID, userID)
+}
+
+func (r *repoTest) declineGroupInvite(inviteID uint) error {
+    now := r.now()
+    for i := range r.invites {
+        if r.invites[i].ID == inviteID {
+            r.invites[i].DeclinedAt = &now
+        }
+    }
+    return nil
+}
+
+func (r *repoTest) revokeGroupInvite(inviteID uint) error {
+    now := r.now()
+    for i := range r.invites {
+        if r.invites[i].ID == inviteID {
+            r.invites[i].RevokedAt = &now
+        }
+    }
+    return nil
+}
+
+func (r *repoTest) addAPIKey(key APIKey) (APIKey, error) {
+    key.ID = uint(len(r.apiKeys) + 1)
+    r.apiKeys = append(r.apiKeys, key)
+    return key, nil
+}
+
+func (r *repoTest) getAPIKeyByHash(hash string) (APIKey, error) {
+    for _, key := range r.apiKeys {
+        if key.KeyHash == hash && key.RevokedAt == nil {
+            return key, nil
+        }
+    }
+    return APIKey{}, gorm.ErrRecordNotFound
+}
+
+func (r *repoTest) getAPIKeys(page pageRequest) ([]APIKey, error) {
+    return pageRows(r.apiKeys, page, true), nil
+}
+
+func (r *repoTest) revokeAPIKey(id string) error {
+    now := r.now()
+    for i := range r.apiKeys {
+        if strconv.FormatUint(uint64(r.apiKeys[i].ID), 10) == id && r.apiKeys[i].RevokedAt == nil {
+            r.apiKeys[i].RevokedAt = &now
+            return nil
+        }
+    }
+    return gorm.ErrRecordNotFound
+}
+
+func (r *repoTest) addJoinRequest(request GroupJoinRequest) (GroupJoinRequest, error) {
+    if request.ID == 0 {
+        request.ID = uint(len(r.joinRequests) + 1)
+    }
+    r.joinRequests = append(r.joinRequests, request)
+    return request, nil
+}
+
+func (r *repoTest) getJoinRequest(id string) (GroupJoinRequest, error) {
+    requestID, _ := strconv.ParseUint(id, 10, 32)
+
+    for _, request := range r.joinRequests {
+        if request.ID == uint(requestID) {
+            return request, nil
+        }
+    }
+    return GroupJoinRequest{}, errors.New("Join request not found")
+}
+
+func (r *repoTest) hasPendingJoinRequest(groupID, userID uint) (bool, error) {
+    for _, request := range r.joinRequests {
+        if request.GroupID == groupID && request.UserID == userID && request.Status == joinRequestPending {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (r *repoTest) getJoinRequests(groupID uint, status string, page pageRequest) ([]GroupJoinRequest, error) {
+    requests := []GroupJoinRequest{}
+    for _, request := range r.joinRequests {
+        if request.GroupID == groupID && request.Status == status {
+            requests = append(requests, request)
+        }
+    }
+    return pageRows(requests, page, false), nil
+}
+
+func (r *repoTest) approveJoinRequest(requestID, reviewerID uint) error {
+    for i := range r.joinRequests {
+        if r.joinRequests[i].ID == requestID {
+            if r.joinRequests[i].Status != joinRequestPending {
+                return errJoinRequestReviewed
+            }
+            r.joinRequests[i].Status = joinRequestApproved
+            r.joinRequests[i].ReviewerID = reviewerID
+            return r.addGroupMember(r.joinRequests[i].GroupID, r.joinRequests[i].UserID)
+        }
+    }
+    return errors.New("Join request not found")
+}
+
+func (r *repoTest) rejectJoinRequest(requestID, reviewerID uint, reason string) error {
+    for i := range r.joinRequests {
+        if r.joinRequests[i].ID == requestID {
+            if r.joinRequests[i].Status != joinRequestPending {
+                return errJoinRequestReviewed
+            }
+            r.joinRequests[i].Status = joinRequestRejected
+            r.joinRequests[i].ReviewerID = reviewerID
+            r.joinRequests[i].Reason = reason
+            return nil
+        }
+    }
+    return errors.New("Join request not found")
+}
+
+func (r *repoTest) setReaction(reaction Reaction) error {
+    for i, existing := range r.reactions {
+        if existing.TargetType == reaction.TargetType && existing.TargetID == reaction.TargetID && existing.UserID == reaction.UserID {
+            r.reactions[i].Type = reaction.Type
+            return nil
+        }
+    }
+    r.reactions = append(r.reactions, reaction)
+    return nil
+}
+
+func (r *repoTest) removeReaction(targetType string, targetID, userID uint) (bool, error) {
+    for i, existing := range r.reactions {
+        if existing.TargetType == targetType && existing.TargetID == targetID && existing.UserID == userID {
+            r.reactions = append(r.reactions[:i], r.reactions[i+1:]...)
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (r *repoTest) getUserReaction(targetType string, targetID, userID uint) (string, error) {
+    for _, existing := range r.reactions {
+        if existing.TargetType == targetType && existing.TargetID == targetID && existing.UserID == userID {
+            return existing.Type, nil
+        }
+    }
+    return "", nil
+}
+
+func (r *repoTest) countReactions(targetType string, targetID uint) (map[string]int64, error) {
+    counts := make(map[string]int64)
+    for _, existing := range r.reactions {
+        if existing.TargetType == targetType && existing.TargetID == targetID {
+            counts[existing.Type]++
+        }
+    }
+    return counts, nil
+}
+
+func (r *repoTest) redisHashGetAll(key string) (map[string]string, error) {
+    values := make(map[string]string)
+    for field, value := range r.hashes[key] {
+        values[field] = strconv.FormatInt(value, 10)
+    }
+    return values, nil
+}
+
+func (r *repoTest) redisHashSet(key string, values map[string]int64, seconds time.Duration) error {
+    if r.hashes == nil {
+        r.hashes = make(map[string]map[string]int64)
+    }
+    r.hashes[key] = make(map[string]int64)
+    for field, value := range values {
+        r.hashes[key][field] = value
+    }
+    return nil
+}
+
 func (r *repoTest) redisGetValue(key string) (string, error) {
     value, prs := r.redis[key]
     if prs == false {
@@ -141,14 +690,16 @@ func TestGetGroupsHandler(t *testing.T) {
     group2 := Group{Name:"Group2", Private:false}
 
     repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
     repo.addGroup(group1)
     repo.addGroup(group2)
 
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(getGroupsHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, getGroupsHandler(formatter, repo)))
     defer server.Close()
     req, _ := http.NewRequest("GET", server.URL, nil)
+    req.Header.Add("Authorization", "token")
 
     resp, err := client.Do(req)
 
@@ -164,7 +715,7 @@ func TestGetGroupsHandler(t *testing.T) {
     }
 
     var groups []Group
-    err = json.Unmarshal(payload, &groups)
+    err = json.Unmarshal(payload, &pageResponse{Items: &groups})
     if err != nil {
         t.Errorf("Could not unmarshal payload into []groups slice")
     }
@@ -180,11 +731,13 @@ func TestGetGroupHandlerNotValidGroup(t *testing.T) {
         recorder *httptest.ResponseRecorder
     )
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/groups/1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
     if recorder.Code != http.StatusNotFound {
         t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
@@ -200,12 +753,14 @@ func TestGetGroupHandlerValidGroup(t *testing.T) {
     group := Group{Name: "test", Private: false}
     group.ID = 1
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
     repo.addGroup(group)
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/groups/1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
     if recorder.Code != http.StatusOK {
         t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
@@ -225,7 +780,7 @@ func TestPostGroupHandlerInvalidJSON(t *testing.T) {
     repo := &repoTest{}
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(postGroupHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postGroupHandler(formatter, repo)))
     defer server.Close()
 
     body := []byte("this is not valid json")
@@ -247,7 +802,7 @@ func TestPostGroupHandlerNotGroup(t *testing.T) {
     repo := &repoTest{}
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(postGroupHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postGroupHandler(formatter, repo)))
     defer server.Close()
 
     body := []byte("{\"test\":\"Not user.\"}")
@@ -263,6 +818,23 @@ func TestPostGroupHandlerNotGroup(t *testing.T) {
     }
 }
 
+func TestPostGroupHandlerBlankName(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups", bytes.NewBufferString(`{"name":"  ","private":true}`))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v for a blank name; received %v", http.StatusBadRequest, recorder.Code)
+    }
+    if len(repo.groups) != 0 {
+        t.Error("Expected no group to be created")
+    }
+}
+
 func TestPostGroupHandlerValidGroup(t *testing.T) {
     repo := &repoTest{}
     repo.redis =  make(map[string]string)
@@ -270,7 +842,7 @@ func TestPostGroupHandlerValidGroup(t *testing.T) {
     seconds := time.Second * time.Duration(time.Now().Unix() - time.Now().Unix())
     repo.redisSetValue("token", "1", seconds)
 
-    server := httptest.NewServer(http.HandlerFunc(postGroupHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postGroupHandler(formatter, repo)))
     defer server.Close()
 
     body := []byte("{\"name\":\"testname\",\n\"private\":false}")
@@ -307,7 +879,7 @@ func TestPostPostHandlerInvalidJSON(t *testing.T) {
     repo := &repoTest{}
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(postPostHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postPostHandler(formatter, repo)))
     defer server.Close()
 
     body := []byte("this is not valid json")
@@ -329,7 +901,7 @@ func TestPostPostHandlerNotPost(t *testing.T) {
     repo := &repoTest{}
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(postPostHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postPostHandler(formatter, repo)))
     defer server.Close()
 
     body := []byte("{\"test\":\"Not user.\"}")
@@ -351,8 +923,10 @@ func TestPostPostHandlerSuccess(t *testing.T) {
     client := &http.Client{}
     seconds := time.Second * time.Duration(time.Now().Unix() - time.Now().Unix())
     repo.redisSetValue("token", "1", seconds)
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
 
-    server := httptest.NewServer(http.HandlerFunc(postPostHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postPostHandler(formatter, repo)))
     defer server.Close()
 
     body := []byte("{\"group_id\":1,\n\"title\":\"test\",\n\"content\":\"this is a test\"}")
@@ -385,11 +959,13 @@ func TestGetPostHandlerNoPosts(t *testing.T) {
     )
 
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/posts/1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusNotFound {
@@ -406,11 +982,14 @@ func TestGetPostHandlerSuccess(t *testing.T) {
     post := Post{GroupID: 1, Title: "Test", Content: "This is a test"}
     post.ID = 1
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "test", Private: false})
     repo.addPost(post)
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/posts/1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusOK {
@@ -434,11 +1013,13 @@ func TestGetPostsHandlerNoGroup(t *testing.T) {
     )
 
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/posts?group=1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusOK {
@@ -446,7 +1027,7 @@ func TestGetPostsHandlerNoGroup(t *testing.T) {
     }
 
     var postResponse []Post
-    err := json.Unmarshal(recorder.Body.Bytes(), &postResponse)
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &postResponse})
     if err != nil {
         t.Errorf("Error unmarshaling token: %s", err)
     }
@@ -464,6 +1045,8 @@ func TestGetPostsHandlerGroupSuccess(t *testing.T) {
     post2 := Post{GroupID: 2, Title: "Test", Content: "This is a test"}
 
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "test", Private: false})
     repo.addPost(post)
     repo.addPost(post2)
 
@@ -471,6 +1054,7 @@ func TestGetPostsHandlerGroupSuccess(t *testing.T) {
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/posts?group=1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusOK {
@@ -478,7 +1062,7 @@ func TestGetPostsHandlerGroupSuccess(t *testing.T) {
     }
 
     var postResponse []Post
-    err := json.Unmarshal(recorder.Body.Bytes(), &postResponse)
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &postResponse})
     if err != nil {
         t.Errorf("Error unmarshaling token: %s", err)
     }
@@ -494,11 +1078,13 @@ func TestGetCommentsHandlerNoComments(t *testing.T) {
     )
 
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/posts?group=1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusOK {
@@ -506,7 +1092,7 @@ func TestGetCommentsHandlerNoComments(t *testing.T) {
     }
 
     var commentResponse []Comment
-    err := json.Unmarshal(recorder.Body.Bytes(), &commentResponse)
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &commentResponse})
     if err != nil {
         t.Errorf("Error unmarshaling token: %s", err)
     }
@@ -524,7 +1110,13 @@ func TestGetCommentsHandlerWithComments(t *testing.T) {
     comment := Comment{PostID: 1,  Content: "This is a test"}
     comment2 := Comment{PostID: 2, Content: "This is a test"}
 
+    post := Post{GroupID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "test", Private: false})
+    repo.addPost(post)
     repo.addComment(comment)
     repo.addComment(comment2)
 
@@ -532,6 +1124,7 @@ func TestGetCommentsHandlerWithComments(t *testing.T) {
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/comments?post=1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusOK {
@@ -539,7 +1132,7 @@ func TestGetCommentsHandlerWithComments(t *testing.T) {
     }
 
     var commentResponse []Comment
-    err := json.Unmarshal(recorder.Body.Bytes(), &commentResponse)
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &commentResponse})
     if err != nil {
         t.Errorf("Error unmarshaling token: %s", err)
     }
@@ -554,11 +1147,13 @@ func TestGetCommentHandlerNoComment(t *testing.T) {
         recorder *httptest.ResponseRecorder
     )
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/comments/1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusNotFound {
@@ -573,13 +1168,19 @@ func TestGetCommentHandlerSuccess(t *testing.T) {
     )
     comment := Comment{PostID: 1,  Content: "This is a test"}
     comment.ID = 1
+    post := Post{GroupID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
     repo  := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "test", Private: false})
+    repo.addPost(post)
     repo.addComment(comment)
 
     server := MakeTestServer(repo)
 
     recorder = httptest.NewRecorder()
     request, _ = http.NewRequest("GET", "/comments/1", nil)
+    request.Header.Add("Authorization", "token")
     server.ServeHTTP(recorder, request)
 
     if recorder.Code != http.StatusOK {
@@ -599,7 +1200,7 @@ func TestPostCommentHandlerInvalidJSON(t *testing.T) {
     repo := &repoTest{}
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(postCommentHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postCommentHandler(formatter, repo, testRules)))
     defer server.Close()
 
     body := []byte("this is not valid json")
@@ -621,7 +1222,7 @@ func TestPostCommentHandlerNotComment(t *testing.T) {
     repo := &repoTest{}
     client := &http.Client{}
 
-    server := httptest.NewServer(http.HandlerFunc(postCommentHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postCommentHandler(formatter, repo, testRules)))
     defer server.Close()
 
     body := []byte("{\"test\":\"Not comment.\"}")
@@ -643,8 +1244,12 @@ func TestPostCommentHandlerSuccess(t *testing.T) {
     client := &http.Client{}
     seconds := time.Second * time.Duration(time.Now().Unix() - time.Now().Unix())
     repo.redisSetValue("token", "1", seconds)
+    post := Post{GroupID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+    repo.addPost(post)
+    repo.addGroupMember(1, 1)
 
-    server := httptest.NewServer(http.HandlerFunc(postCommentHandler(formatter, repo)))
+    server := httptest.NewServer(testAuth(repo, postCommentHandler(formatter, repo, testRules)))
     defer server.Close()
 
     body := []byte("{\"post_id\":1,\n\"content\":\"this is a test\"}")
@@ -671,10 +1276,1340 @@ func TestPostCommentHandlerSuccess(t *testing.T) {
     }
 }
 
-func MakeTestServer(repository *repoTest) *negroni.Negroni {
-	server := negroni.New()
+func TestGetGroupsHandlerHidesPrivateGroups(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroup(Group{Name: "private", Private: true})
+    repo.addGroup(Group{Name: "joined", Private: true})
+    repo.addGroupMember(3, 1)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/groups", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    var groups []Group
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &groups})
+    if err != nil {
+        t.Errorf("Error unmarshaling groups: %s", err)
+    }
+    if len(groups) != 2 {
+        t.Errorf("Expected 2 readable groups, got %d", len(groups))
+    }
+    for _, group := range groups {
+        if group.Name == "private" {
+            t.Error("Private group returned to non member")
+        }
+    }
+}
+
+func TestGetGroupsHandlerPagesAreFull(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true})
+    repo.addGroup(Group{Name: "hidden", Private: true})
+    repo.addGroup(Group{Name: "first", Private: false})
+    repo.addGroup(Group{Name: "second", Private: false})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/groups?limit=2", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    var groups []Group
+    page := pageResponse{Items: &groups}
+    json.Unmarshal(recorder.Body.Bytes(), &page)
+    if len(groups) != 2 || groups[0].Name != "first" || page.NextCursor != "" {
+        t.Errorf("Expected private groups not to take up the page, got %v", groups)
+    }
+}
+
+func TestGetGroupHandlerPrivateNotMember(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/groups/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+}
+
+func TestGetPostsHandlerPrivateNotMember(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true})
+    repo.addPost(Post{GroupID: 1, Title: "Test", Content: "This is a test"})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/posts?group=1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    var posts []Post
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &posts})
+    if err != nil {
+        t.Errorf("Error unmarshaling posts: %s", err)
+    }
+    if len(posts) != 0 {
+        t.Error("Expected no posts from a private group")
+    }
+}
+
+func TestGetCommentHandlerPrivateNotMember(t *testing.T) {
+    post := Post{GroupID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+    comment := Comment{PostID: 1, Content: "This is a test"}
+    comment.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true})
+    repo.addPost(post)
+    repo.addComment(comment)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/comments/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+}
+
+func TestPostPostHandlerNotMember(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"group_id\":1,\n\"title\":\"test\",\n\"content\":\"this is a test\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/posts", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+    if len(repo.posts) != 0 {
+        t.Error("Post created by non member")
+    }
+}
+
+func TestPostGroupMemberHandlerPublicGroup(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/members", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+    if len(repo.groupMembers) != 1 {
+        t.Error("Expected one group member")
+    }
+
+    recorder = httptest.NewRecorder()
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusConflict {
+        t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+    }
+}
+
+func TestPostGroupMemberHandlerPrivateGroup(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/members", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+    if len(repo.groupMembers) != 0 {
+        t.Error("Expected no group members")
+    }
+}
+
+func TestDeleteGroupMemberHandlerLastAdmin(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addGroupAdmin(1, 1)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/groups/1/members/me", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusConflict {
+        t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+    }
+    if len(repo.groupMembers) != 1 {
+        t.Error("Last admin should still be a member")
+    }
+
+    repo.addGroupMember(1, 2)
+    repo.addGroupAdmin(1, 2)
+
+    recorder = httptest.NewRecorder()
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if len(repo.groupMembers) != 1 || len(repo.groupAdmins) != 1 {
+        t.Error("Expected admin to have left the group")
+    }
+}
+
+func TestGetGroupMembersHandlerPagination(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addGroupMember(1, 2)
+    repo.addGroupMember(1, 3)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/groups/1/members?limit=2", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    var members []GroupMember
+    page := pageResponse{Items: &members}
+    err := json.Unmarshal(recorder.Body.Bytes(), &page)
+    if err != nil {
+        t.Errorf("Error unmarshaling members: %s", err)
+    }
+    if len(members) != 2 || members[0].UserID != 1 || page.NextCursor == "" {
+        t.Fatalf("Expected the first page of members with a cursor, got %v", members)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("GET", "/groups/1/members?limit=2&cursor=" + page.NextCursor, nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    members = nil
+    page = pageResponse{Items: &members}
+    json.Unmarshal(recorder.Body.Bytes(), &page)
+    if len(members) != 1 || members[0].UserID != 3 || page.NextCursor != "" {
+        t.Errorf("Expected the last member on the second page, got %v", members)
+    }
+}
+
+func TestPostGroupAdminHandlerNotAdmin(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "2"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupMember(1, 1)
+    repo.addGroupAdmin(1, 1)
+    repo.addGroupMember(1, 2)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/admins/2", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+    if len(repo.groupAdmins) != 1 {
+        t.Error("Non admin should not be able to promote")
+    }
+}
+
+func TestGroupAdminHandlersPromoteAndDemote(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupMember(1, 1)
+    repo.addGroupAdmin(1, 1)
+    repo.addGroupMember(1, 2)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/admins/2", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+    if admin, _ := repo.isGroupAdmin(1, 2); !admin {
+        t.Error("Expected user to be promoted")
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("DELETE", "/groups/1/admins/2", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if admin, _ := repo.isGroupAdmin(1, 2); admin {
+        t.Error("Expected user to be demoted")
+    }
+
+    if len(repo.adminEvents) != 2 || repo.adminEvents[0].ActorID != 1 || repo.adminEvents[1].Action != adminActionDemote {
+        t.Errorf("Expected promote and demote to be recorded, got %v", repo.adminEvents)
+    }
+}
+
+func TestDeleteGroupAdminHandlerOwner(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "2"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+    repo.addGroupAdmin(1, 2)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/groups/1/admins/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusConflict {
+        t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+    }
+}
+
+func TestPostGroupOwnerHandler(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupMember(1, 1)
+    repo.addGroupAdmin(1, 1)
+    repo.addGroupMember(1, 2)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"user_id\":2}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/owner", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if repo.groups[0].OwnerID != 2 {
+        t.Error("Expected ownership to be transferred")
+    }
+    if admin, _ := repo.isGroupAdmin(1, 2); !admin {
+        t.Error("Expected new owner to be an admin")
+    }
+}
+
+func TestPutGroupHandlerNotAdmin(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "2"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+    repo.addGroupMember(1, 2)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"private\":true}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("PATCH", "/groups/1", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+    if repo.groups[0].Private {
+        t.Error("Group should not have been updated")
+    }
+}
+
+func TestPutGroupHandlerAdmin(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"private\":true}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("PATCH", "/groups/1", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if !repo.groups[0].Private || repo.groups[0].Name != "public" {
+        t.Errorf("Group not updated as expected, got %v", repo.groups[0])
+    }
+}
+
+func TestDeleteGroupHandlerCascades(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 2, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+    comment := Comment{PostID: 1, UserID: 2, Content: "This is a test"}
+    comment.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+    repo.addPost(post)
+    repo.addComment(comment)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/groups/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if len(repo.groups) != 0 || len(repo.posts) != 0 || len(repo.comments) != 0 {
+        t.Error("Expected group, posts and comments to be deleted")
+    }
+}
+
+func TestPutPostHandlerNotAuthor(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 2, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupAdmin(1, 1)
+    repo.addPost(post)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"title\":\"edited\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("PUT", "/posts/1", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+}
+
+func TestPutPostHandlerAuthor(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addPost(post)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"title\":\"edited\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("PUT", "/posts/1", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if repo.posts[0].Title != "edited" || repo.posts[0].Content != "This is a test" {
+        t.Errorf("Post not updated as expected, got %v", repo.posts[0])
+    }
+}
+
+func TestPutPostHandlerBlankContent(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addPost(post)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"content\":\"  \"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("PUT", "/posts/1", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+    }
+    if repo.posts[0].Content != "This is a test" {
+        t.Errorf("Expected the content to be kept, got %q", repo.posts[0].Content)
+    }
+}
+
+func TestDeletePostHandlerGroupAdmin(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 2, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupAdmin(1, 1)
+    repo.addPost(post)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/posts/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if len(repo.posts) != 0 {
+        t.Error("Expected post to be deleted")
+    }
+}
+
+func TestDeleteCommentHandlerNotAllowed(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 2, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+    comment := Comment{PostID: 1, UserID: 2, Content: "This is a test"}
+    comment.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "3"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addPost(post)
+    repo.addComment(comment)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/comments/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+    if len(repo.comments) != 1 {
+        t.Error("Comment should not have been deleted")
+    }
+}
+
+func TestPostGroupInviteHandlerAddressed(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupMember(1, 1)
+    repo.addGroupAdmin(1, 1)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"user_id\":2,\"max_uses\":5}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/invites", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+
+    var invite GroupInvite
+    err := json.Unmarshal(recorder.Body.Bytes(), &invite)
+    if err != nil {
+        t.Errorf("Error unmarshaling invite: %s", err)
+    }
+    if invite.Code == "" || invite.InviteeID != 2 || invite.MaxUses != 1 || invite.ExpiresAt == nil {
+        t.Errorf("Invite not created as expected, got %v", invite)
+    }
+}
+
+func TestPostInviteAcceptHandler(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "2", "other": "3"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupInvite(GroupInvite{GroupID: 1, Code: "code", InviterID: 1, InviteeID: 2, MaxUses: 1})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/invites/code/accept", nil)
+    request.Header.Add("Authorization", "other")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/invites/code/accept", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if member, _ := repo.isGroupMember(1, 2); !member {
+        t.Error("Expected invitee to be a member")
+    }
+    if repo.invites[0].Uses != 1 {
+        t.Error("Expected invite to be used")
+    }
+}
+
+func TestPostInviteAcceptHandlerUsedUp(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "3"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupInvite(GroupInvite{GroupID: 1, Code: "code", InviterID: 1, MaxUses: 1, Uses: 1})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/invites/code/accept", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusGone {
+        t.Errorf("Expected %v; received %v", http.StatusGone, recorder.Code)
+    }
+    if len(repo.groupMembers) != 0 {
+        t.Error("Used up invite should not add a member")
+    }
+}
+
+func TestInviteExpiryUsesRepositoryClock(t *testing.T) {
+    now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+    repo := &repoTest{clock: func() time.Time { return now }}
+    repo.redis = map[string]string{"token": "1", "invitee": "2"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupMember(1, 1)
+    repo.addGroupAdmin(1, 1)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"user_id\":2,\"expires_in\":60}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/invites", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Fatalf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+    if expires := repo.invites[0].ExpiresAt; expires == nil || !expires.Equal(now.Add(time.Minute)) {
+        t.Errorf("Expected the invite to expire a minute after the repository clock; received %v", expires)
+    }
+
+    now = now.Add(2 * time.Minute)
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/invites/"+repo.invites[0].Code+"/accept", nil)
+    request.Header.Add("Authorization", "invitee")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusGone {
+        t.Errorf("Expected %v; received %v", http.StatusGone, recorder.Code)
+    }
+}
+
+func TestDeleteInviteHandlerRevokes(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1", "other": "3"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+    repo.addGroupInvite(GroupInvite{GroupID: 1, Code: "code", InviterID: 1})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/invites/code", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/invites/code/accept", nil)
+    request.Header.Add("Authorization", "other")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusGone {
+        t.Errorf("Expected %v; received %v", http.StatusGone, recorder.Code)
+    }
+}
+
+func TestPostJoinRequestHandlerDuplicate(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "2"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/requests", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusConflict {
+        t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+    }
+    if len(repo.joinRequests) != 1 {
+        t.Error("Expected one join request")
+    }
+}
+
+func TestPostJoinRequestHandlerMember(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "2"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupMember(1, 2)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/requests", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusConflict {
+        t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+    }
+}
+
+func TestPostJoinRequestApproveHandler(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1", "other": "2"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+    repo.addJoinRequest(GroupJoinRequest{GroupID: 1, UserID: 2, Status: joinRequestPending})
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/requests/1/approve", nil)
+    request.Header.Add("Authorization", "other")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/groups/1/requests/1/approve", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if member, _ := repo.isGroupMember(1, 2); !member {
+        t.Error("Expected requester to be a member")
+    }
+
+    recorder = httptest.NewRecorder()
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusConflict {
+        t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+    }
+}
+
+func TestPostJoinRequestRejectHandler(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "private", Private: true, OwnerID: 1})
+    repo.addGroupAdmin(1, 1)
+    repo.addJoinRequest(GroupJoinRequest{GroupID: 1, UserID: 2, Status: joinRequestPending})
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"reason\":\"not today\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/groups/1/requests/1/reject", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+    if repo.joinRequests[0].Status != joinRequestRejected || repo.joinRequests[0].Reason != "not today" {
+        t.Errorf("Join request not rejected as expected, got %v", repo.joinRequests[0])
+    }
+    if len(repo.groupMembers) != 0 {
+        t.Error("Rejected request should not add a member")
+    }
+}
+
+func TestGetPostsHandlerCursorPagination(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    created := time.Now()
+    for i := 1; i <= 5; i++ {
+        post := Post{GroupID: 1, Title: "Test", Content: "This is a test"}
+        post.ID = uint(i)
+        post.CreatedAt = created
+        repo.addPost(post)
+    }
+
+    server := MakeTestServer(repo)
+
+    var seen []uint
+    cursor := ""
+    for pages := 0; pages < 5; pages++ {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest("GET", "/posts?group=1&limit=2&cursor=" + cursor, nil)
+        request.Header.Add("Authorization", "token")
+        server.ServeHTTP(recorder, request)
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("Expected %v; received %v", http.StatusOK, recorder.Code)
+        }
+
+        var posts []Post
+        response := pageResponse{Items: &posts}
+        err := json.Unmarshal(recorder.Body.Bytes(), &response)
+        if err != nil {
+            t.Fatalf("Error unmarshaling posts: %s", err)
+        }
+        if len(posts) > 2 {
+            t.Errorf("Expected at most 2 posts a page, got %d", len(posts))
+        }
+        for _, post := range posts {
+            seen = append(seen, post.ID)
+        }
+        if response.NextCursor == "" {
+            break
+        }
+        cursor = response.NextCursor
+    }
+
+    if len(seen) != 5 {
+        t.Fatalf("Expected to page through 5 posts, got %v", seen)
+    }
+    for i, id := range seen {
+        if id != uint(i + 1) {
+            t.Errorf("Expected posts in (created_at, id) order, got %v", seen)
+            break
+        }
+    }
+}
+
+func TestGetGroupsHandlerInvalidCursor(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/groups?cursor=not-a-cursor", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+    }
+}
+
+func newThreadTestRepo() *repoTest {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+    other := Post{GroupID: 1, UserID: 1, Title: "Other", Content: "This is a test"}
+    other.ID = 2
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addPost(post)
+    repo.addPost(other)
+
+    comments := []Comment{
+        {PostID: 1, Content: "root", UserID: 1},
+        {PostID: 1, ParentID: 1, Depth: 1, Content: "reply", UserID: 1},
+        {PostID: 1, ParentID: 2, Depth: 2, Content: "nested reply", UserID: 1},
+        {PostID: 1, ParentID: 1, Depth: 1, Content: "second reply", UserID: 1},
+        {PostID: 2, Content: "other root", UserID: 1},
+    }
+    for i, comment := range comments {
+        comment.ID = uint(i + 1)
+        repo.addComment(comment)
+    }
+    return repo
+}
+
+func TestPostCommentHandlerReplyToOtherPost(t *testing.T) {
+    repo := newThreadTestRepo()
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"post_id\":1,\"parent_id\":5,\"content\":\"reply\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/comments", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+    }
+}
+
+func TestPostCommentHandlerReplyTooDeep(t *testing.T) {
+    repo := newThreadTestRepo()
+    rules := testRules
+    rules.maxCommentDepth = 2
+    server := makeTestServerWithRules(repo, rules)
+
+    body := []byte("{\"post_id\":1,\"parent_id\":3,\"content\":\"reply\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/comments", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+    }
+
+    body = []byte("{\"post_id\":1,\"parent_id\":2,\"content\":\"reply\"}")
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/comments", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+    if repo.comments[len(repo.comments) - 1].Depth != 2 {
+        t.Error("Expected reply depth to follow its parent")
+    }
+}
+
+func TestContentLengthIsLimited(t *testing.T) {
+    repo := newThreadTestRepo()
+    server := MakeTestServer(repo)
+
+    // multi byte characters count once, like in the varchar column
+    content := strings.Repeat("é", maxContentLength)
+    requests := []struct {
+        method      string
+        path        string
+        body        string
+        expected    int
+    }{
+        {"POST", "/comments", `{"post_id":1,"content":"` + content + `"}`, http.StatusCreated},
+        {"POST", "/comments", `{"post_id":1,"content":"` + content + `e"}`, http.StatusBadRequest},
+        {"PUT", "/comments/1", `{"content":"` + content + `e"}`, http.StatusBadRequest},
+        {"POST", "/posts", `{"group_id":1,"content":"` + content + `e"}`, http.StatusBadRequest},
+    }
+    for _, r := range requests {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest(r.method, r.path, bytes.NewBufferString(r.body))
+        request.Header.Add("Authorization", "token")
+        server.ServeHTTP(recorder, request)
+        if recorder.Code != r.expected {
+            t.Errorf("Expected %v for %s %s; received %v", r.expected, r.method, r.path, recorder.Code)
+        }
+    }
+}
+
+func TestGetCommentsHandlerTree(t *testing.T) {
+    repo := newThreadTestRepo()
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/comments?post=1&tree=true", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    var tree []*commentNode
+    err := json.Unmarshal(recorder.Body.Bytes(), &pageResponse{Items: &tree})
+    if err != nil {
+        t.Fatalf("Error unmarshaling comments: %s", err)
+    }
+    if len(tree) != 1 || tree[0].ReplyCount != 2 || len(tree[0].Replies) != 2 {
+        t.Fatalf("Expected one root with two replies, got %v", tree)
+    }
+    if tree[0].Replies[0].ReplyCount != 1 || tree[0].Replies[0].Replies[0].Content != "nested reply" {
+        t.Error("Expected nested reply under the first reply")
+    }
+}
+
+func TestGetCommentsHandlerTreePagesByThread(t *testing.T) {
+    repo := newThreadTestRepo()
+    second := Comment{PostID: 1, Content: "second root", UserID: 1}
+    second.ID = 6
+    reply := Comment{PostID: 1, ParentID: 6, Depth: 1, Content: "late reply", UserID: 1}
+    reply.ID = 7
+    repo.addComment(second)
+    repo.addComment(reply)
+    server := MakeTestServer(repo)
+
+    get := func(path string) ([]*commentNode, string) {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest("GET", path, nil)
+        request.Header.Add("Authorization", "token")
+        server.ServeHTTP(recorder, request)
+        var tree []*commentNode
+        response := pageResponse{Items: &tree}
+        if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+            t.Fatalf("Error unmarshaling comments: %s", err)
+        }
+        return tree, response.NextCursor
+    }
+
+    tree, cursor := get("/comments?post=1&tree=true&limit=1")
+    if len(tree) != 1 || tree[0].Content != "root" || tree[0].ReplyCount != 2 || tree[0].Replies[0].ReplyCount != 1 {
+        t.Fatalf("Expected the first thread whole on the first page, got %v", tree)
+    }
+    if cursor == "" {
+        t.Fatal("Expected a cursor to the next thread")
+    }
+    tree, cursor = get("/comments?post=1&tree=true&limit=1&cursor=" + cursor)
+    if len(tree) != 1 || tree[0].Content != "second root" || tree[0].ReplyCount != 1 || cursor != "" {
+        t.Errorf("Expected the second thread on the last page, got %v (%q)", tree, cursor)
+    }
+}
+
+func TestDeleteCommentHandlerLeavesTombstone(t *testing.T) {
+    repo := newThreadTestRepo()
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("DELETE", "/comments/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    comment, err := repo.getComment("1")
+    if err != nil || !comment.Deleted || comment.Content != "" {
+        t.Errorf("Expected comment with replies to be a tombstone, got %v", comment)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("DELETE", "/comments/4", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if _, err := repo.getComment("4"); err == nil {
+        t.Error("Expected comment without replies to be deleted")
+    }
+}
+
+func TestPostReactionHandlerCounts(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1", "other": "2"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addGroupMember(1, 2)
+    repo.addPost(post)
+    // an existing reaction from before the counters were cached
+    repo.setReaction(Reaction{TargetType: reactionTargetPost, TargetID: 1, UserID: 2, Type: "like"})
+
+    server := MakeTestServer(repo)
+
+    for _, reaction := range []string{"like", "love"} {
+        body := []byte("{\"type\":\"" + reaction + "\"}")
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest("POST", "/posts/1/reactions", bytes.NewBuffer(body))
+        request.Header.Add("Authorization", "token")
+        server.ServeHTTP(recorder, request)
+        if recorder.Code != http.StatusOK {
+            t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+        }
+    }
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/posts/1", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    var response postResponse
+    err := json.Unmarshal(recorder.Body.Bytes(), &response)
+    if err != nil {
+        t.Fatalf("Error unmarshaling post: %s", err)
+    }
+    counts := response.Reactions.Counts
+    if counts["like"] != 1 || counts["love"] != 1 || len(counts) != 2 {
+        t.Errorf("Expected one like and one love, got %v", counts)
+    }
+    if !response.Reactions.Reacted || response.Reactions.Mine != "love" {
+        t.Errorf("Expected caller to have reacted with love, got %v", response.Reactions)
+    }
+}
+
+func TestPostReactionHandlerRebuildsCounts(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addPost(post)
+    // counters that drifted from the database
+    repo.redisHashSet(reactionKey(reactionTargetPost, 1), map[string]int64{"like": 7, "sad": 2}, reactionCountsTTL)
+
+    server := MakeTestServer(repo)
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/posts/1/reactions", bytes.NewBufferString(`{"type":"like"}`))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    var summary reactionSummary
+    json.Unmarshal(recorder.Body.Bytes(), &summary)
+    if summary.Counts["like"] != 1 || len(summary.Counts) != 1 {
+        t.Errorf("Expected the counts to be rebuilt from the database, got %v", summary.Counts)
+    }
+}
+
+func TestPostReactionHandlerInvalidType(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addPost(post)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"type\":\"shrug\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/posts/1/reactions", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+    }
+}
+
+func TestDeleteReactionHandlerComment(t *testing.T) {
+    post := Post{GroupID: 1, UserID: 1, Title: "Test", Content: "This is a test"}
+    post.ID = 1
+    comment := Comment{PostID: 1, UserID: 1, Content: "This is a test"}
+    comment.ID = 1
+
+    repo := &repoTest{}
+    repo.redis = map[string]string{"token": "1"}
+    repo.addGroup(Group{Name: "public", Private: false})
+    repo.addGroupMember(1, 1)
+    repo.addPost(post)
+    repo.addComment(comment)
+
+    server := MakeTestServer(repo)
+
+    body := []byte("{\"type\":\"laugh\"}")
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/comments/1/reactions", bytes.NewBuffer(body))
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("DELETE", "/comments/1/reactions", nil)
+    request.Header.Add("Authorization", "token")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    var summary reactionSummary
+    err := json.Unmarshal(recorder.Body.Bytes(), &summary)
+    if err != nil {
+        t.Fatalf("Error unmarshaling reactions: %s", err)
+    }
+    if summary.Reacted || len(summary.Counts) != 0 {
+        t.Errorf("Expected no reactions left, got %v", summary)
+    }
+
+    recorder = httptest.NewRecorder()
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
+    }
+}
+
+//testAuth stands in for the middleware, it resolves the token through the
+//fake redis map and attaches the user to the request. Values are the user id
+//followed by any scopes
+func testAuth(repo *repoTest, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        value, err := repo.redisGetValue(tokenFromRequest(req))
+        if err == nil {
+            fields := strings.Fields(value)
+            userID, _ := strconv.ParseUint(fields[0], 10, 64)
+            principal := Principal{UserID: uint(userID), ExpiresAt: time.Now().Add(time.Hour), Scopes: fields[1:]}
+            req = req.WithContext(withPrincipal(req.Context(), principal))
+        }
+        next.ServeHTTP(w, req)
+    })
+}
+
+func TestUserIDFromRequest(t *testing.T) {
+    req, _ := http.NewRequest("GET", "/groups", nil)
+    _, err := userIDFromRequest(req)
+    if err != errNoPrincipal {
+        t.Errorf("Expected %v; received %v", errNoPrincipal, err)
+    }
+
+    req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 3}))
+    userID, err := userIDFromRequest(req)
+    if err != nil || userID != 3 {
+        t.Errorf("Expected user %v; received %v (%v)", 3, userID, err)
+    }
+}
+
+func TestPostAPIKeyHandler(t *testing.T) {
+    repo := &repoTest{}
+    repo.redis = map[string]string{"user": "1", "admin": "2 admin"}
+    repo.addGroup(Group{Name: "digests", Private: true})
+    server := MakeTestServer(repo)
+
+    body := []byte(`{"name":"digest-bot","scopes":["posts:read","posts:write"],"group_ids":[1]}`)
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/apikeys", bytes.NewReader(body))
+    request.Header.Add("Authorization", "user")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v for a user without the admin scope; received %v", http.StatusForbidden, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/apikeys", bytes.NewReader([]byte(`{"name":"bot","scopes":["everything"]}`)))
+    request.Header.Add("Authorization", "admin")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v for an unknown scope; received %v", http.StatusBadRequest, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/apikeys", bytes.NewReader([]byte(`{"name":"bot","scopes":["posts:read"],"group_ids":[9]}`)))
+    request.Header.Add("Authorization", "admin")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Expected %v for an unknown group; received %v", http.StatusBadRequest, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/apikeys", bytes.NewReader(body))
+    request.Header.Add("Authorization", "admin")
+    server.ServeHTTP(recorder, request)
+    if recorder.Code != http.StatusCreated {
+        t.Fatalf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+
+    var created apiKeyResponse
+    json.Unmarshal(recorder.Body.Bytes(), &created)
+    if !strings.HasPrefix(created.Key, apiKeyPrefix) || len(created.Scopes) != 2 || len(created.GroupIDs) != 1 {
+        t.Errorf("Unexpected key %+v", created)
+    }
+    if len(repo.apiKeys) != 1 || repo.apiKeys[0].KeyHash != hashAPIKey(created.Key) || repo.apiKeys[0].CreatorID != 2 {
+        t.Errorf("Expected only the hash of the key to be stored, got %+v", repo.apiKeys)
+    }
+    if strings.Contains(recorder.Body.String(), repo.apiKeys[0].KeyHash) {
+        t.Error("The key hash should not be sent to clients")
+    }
+}
+
+func TestAPIKeyBotAccess(t *testing.T) {
+    repo := &repoTest{}
+    repo.addGroup(Group{Name: "Group1", Private: true})
+    repo.addGroup(Group{Name: "Group2", Private: true})
+    key, hash, _ := newAPIKey()
+    repo.addAPIKey(APIKey{Name: "digest-bot", KeyHash: hash, Scopes: "posts:read posts:write", GroupIDs: "1"})
+
+    mx := mux.NewRouter()
+    initRoutes(mx, formatter, repo, testRules)
+    server := negroni.New(&Middleware{store: newMemoryTokenStore(), repo: repo, client: &countingAuthClient{}, now: time.Now}, negroni.Wrap(mx))
+
+    send := func(method, path string, body []byte) *httptest.ResponseRecorder {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest(method, path, bytes.NewReader(body))
+        request.Header.Add(apiKeyHeader, key)
+        server.ServeHTTP(recorder, request)
+        return recorder
+    }
+
+    recorder := send("POST", "/posts", []byte(`{"group_id":1,"title":"Digest","content":"Weekly digest"}`))
+    if recorder.Code != http.StatusCreated {
+        t.Fatalf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+    }
+    if len(repo.posts) != 1 || repo.posts[0].BotID != 1 || repo.posts[0].UserID != 0 {
+        t.Errorf("Expected the post to be attributed to the bot, got %+v", repo.posts)
+    }
+
+    recorder = send("POST", "/posts", []byte(`{"group_id":2,"title":"Digest","content":"Weekly digest"}`))
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v for a group the key wasn't granted; received %v", http.StatusForbidden, recorder.Code)
+    }
+    recorder = send("POST", "/posts", []byte(`{"group_id":3,"title":"Digest","content":"Weekly digest"}`))
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("Expected %v for a missing group; received %v", http.StatusNotFound, recorder.Code)
+    }
+
+    recorder = send("GET", "/groups", nil)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v without groups:read; received %v", http.StatusForbidden, recorder.Code)
+    }
+    var apiErr apiError
+    json.Unmarshal(recorder.Body.Bytes(), &apiErr)
+    if apiErr.Code != errCodeInsufficientScope {
+        t.Errorf("Expected code %s, got %s", errCodeInsufficientScope, apiErr.Code)
+    }
+
+    recorder = send("POST", "/posts/1/reactions", []byte(`{"type":"like"}`))
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v for a user only route; received %v", http.StatusForbidden, recorder.Code)
+    }
+
+    repo.revokeAPIKey("1")
+    recorder = send("GET", "/posts/1", nil)
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Expected %v for a revoked key; received %v", http.StatusUnauthorized, recorder.Code)
+    }
+}
+
+//testRules are the content rules of the default config
+var testRules = newContentRules(DefaultConfig())
+
+func MakeTestServer(repository *repoTest) *negroni.Negroni {
+	return makeTestServerWithRules(repository, testRules)
+}
+
+func makeTestServerWithRules(repository *repoTest, rules contentRules) *negroni.Negroni {
+	server := negroni.New()
 	mx := mux.NewRouter()
-	initRoutes(mx, formatter, repository)
-	server.UseHandler(mx)
+	initRoutes(mx, formatter, repository, rules)
+	server.UseHandler(testAuth(repository, mx))
 	return server
 }
+
+func TestNewServerRequiresDependencies(t *testing.T) {
+    _, err := NewServer(DefaultConfig(), Dependencies{Auth: &countingAuthClient{}})
+    if err == nil {
+        t.Error("Expected a server without a database or cache to be refused")
+    }
+}
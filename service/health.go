@@ -0,0 +1,153 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/unrolled/render"
+)
+
+const (
+    healthOK        = "ok"
+    healthFailing   = "failing"
+    healthDraining  = "draining"
+)
+
+//healthCheck probes a single dependency, it should give up when ctx is done
+type healthCheck struct {
+    name        string
+    check       func(ctx context.Context) error
+}
+
+//DependencyStatus is the result of probing one dependency
+type DependencyStatus struct {
+    Status      string  `json:"status"`
+    LatencyMS   float64 `json:"latency_ms"`
+    Error       string  `json:"error,omitempty"`
+}
+
+//HealthReport is returned by /healthz and /readyz
+type HealthReport struct {
+    Status          string                      `json:"status"`
+    Dependencies    map[string]DependencyStatus `json:"dependencies"`
+}
+
+//Health probes the dependencies of the service for the health endpoints
+type Health struct {
+    checks      []healthCheck
+    timeout     time.Duration
+    draining    int32
+}
+
+//authPinger is implemented by auth clients that talk to a remote service
+type authPinger interface {
+    ping(ctx context.Context) error
+}
+
+//newHealth checks postgres and redis, and the auth service when cfg asks for
+//it and the auth client is remote
+func newHealth(cfg HealthConfig, deps Dependencies) *Health {
+    health := &Health{timeout: time.Duration(cfg.Timeout)}
+    health.checks = append(health.checks,
+        healthCheck{name: "postgres", check: func(ctx context.Context) error {
+            return deps.DB.DB().PingContext(ctx)
+        }},
+        healthCheck{name: "redis", check: func(ctx context.Context) error {
+            return deps.Cache.Ping().Err()
+        }},
+    )
+    if pinger, ok := deps.Auth.(authPinger); ok && cfg.CheckAuth {
+        health.checks = append(health.checks, healthCheck{name: "auth", check: pinger.ping})
+    }
+    return health
+}
+
+//drain makes readiness fail from now on so load balancers stop sending us
+//requests before the server shuts down
+func (h *Health) drain() {
+    atomic.StoreInt32(&h.draining, 1)
+}
+
+func (h *Health) isDraining() bool {
+    return atomic.LoadInt32(&h.draining) == 1
+}
+
+//report runs every check at the same time, each one is given up on after
+//the timeout
+func (h *Health) report(ctx context.Context) HealthReport {
+    report := HealthReport{Status: healthOK, Dependencies: make(map[string]DependencyStatus)}
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for _, check := range h.checks {
+        wg.Add(1)
+        go func(check healthCheck) {
+            defer wg.Done()
+            status := runHealthCheck(ctx, check, h.timeout)
+            mu.Lock()
+            defer mu.Unlock()
+            report.Dependencies[check.name] = status
+            if status.Status != healthOK {
+                report.Status = healthFailing
+            }
+        }(check)
+    }
+    wg.Wait()
+    return report
+}
+
+func runHealthCheck(ctx context.Context, check healthCheck, timeout time.Duration) DependencyStatus {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    start := time.Now()
+    // checks that ignore ctx still can't hold up the response
+    result := make(chan error, 1)
+    go func() {
+        result <- check.check(ctx)
+    }()
+    var err error
+    select {
+    case err = <-result:
+    case <-ctx.Done():
+        err = errors.New("timed out after " + timeout.String())
+    }
+
+    status := DependencyStatus{
+        Status:    healthOK,
+        LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+    }
+    if err != nil {
+        status.Status = healthFailing
+        status.Error = err.Error()
+    }
+    return status
+}
+
+//getHealthzHandler is the liveness probe, it reports the dependencies but
+//always answers 200 so an outage of postgres or redis doesn't get every
+//instance restarted
+func getHealthzHandler(formatter *render.Render, health *Health) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        formatter.JSON(w, http.StatusOK, health.report(req.Context()))
+    }
+}
+
+//getReadyzHandler is the readiness probe, it answers 503 while any dependency
+//is failing or the server is shutting down
+func getReadyzHandler(formatter *render.Render, health *Health) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        report := health.report(req.Context())
+        if health.isDraining() {
+            report.Status = healthDraining
+        }
+        code := http.StatusOK
+        if report.Status != healthOK {
+            code = http.StatusServiceUnavailable
+        }
+        formatter.JSON(w, code, report)
+    }
+}
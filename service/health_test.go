@@ -0,0 +1,90 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/unrolled/render"
+)
+
+func probe(handler http.HandlerFunc) (int, HealthReport) {
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/readyz", nil)
+    handler(recorder, request)
+
+    var report HealthReport
+    json.Unmarshal(recorder.Body.Bytes(), &report)
+    return recorder.Code, report
+}
+
+func TestReadyzReportsEachDependency(t *testing.T) {
+    formatter := render.New(render.Options{IndentJSON: true})
+    health := &Health{timeout: time.Second, checks: []healthCheck{
+        {name: "postgres", check: func(ctx context.Context) error { return nil }},
+        {name: "redis", check: func(ctx context.Context) error { return nil }},
+    }}
+
+    code, report := probe(getReadyzHandler(formatter, health))
+    if code != http.StatusOK || report.Status != healthOK {
+        t.Errorf("Expected %v %q; received %v %q", http.StatusOK, healthOK, code, report.Status)
+    }
+    if len(report.Dependencies) != 2 || report.Dependencies["redis"].Status != healthOK {
+        t.Errorf("Expected both dependencies to be ok; received %v", report.Dependencies)
+    }
+
+    health.checks[1].check = func(ctx context.Context) error { return errors.New("connection refused") }
+    code, report = probe(getReadyzHandler(formatter, health))
+    if code != http.StatusServiceUnavailable || report.Status != healthFailing {
+        t.Errorf("Expected %v %q; received %v %q", http.StatusServiceUnavailable, healthFailing, code, report.Status)
+    }
+    if redis := report.Dependencies["redis"]; redis.Status != healthFailing || redis.Error != "connection refused" {
+        t.Errorf("Expected redis to be failing with its error; received %v", redis)
+    }
+    if report.Dependencies["postgres"].Status != healthOK {
+        t.Error("Expected postgres to still be ok")
+    }
+}
+
+func TestHealthChecksTimeOut(t *testing.T) {
+    formatter := render.New(render.Options{IndentJSON: true})
+    release := make(chan struct{})
+    defer close(release)
+    health := &Health{timeout: 20 * time.Millisecond, checks: []healthCheck{
+        {name: "auth", check: func(ctx context.Context) error {
+            <-release
+            return nil
+        }},
+    }}
+
+    start := time.Now()
+    code, report := probe(getReadyzHandler(formatter, health))
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("Expected the probe to give up after the timeout; took %s", elapsed)
+    }
+    if code != http.StatusServiceUnavailable || report.Dependencies["auth"].Status != healthFailing {
+        t.Errorf("Expected a hanging check to fail; received %v %v", code, report.Dependencies)
+    }
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+    formatter := render.New(render.Options{IndentJSON: true})
+    health := &Health{timeout: time.Second, checks: []healthCheck{
+        {name: "postgres", check: func(ctx context.Context) error { return nil }},
+    }}
+    health.drain()
+
+    code, report := probe(getReadyzHandler(formatter, health))
+    if code != http.StatusServiceUnavailable || report.Status != healthDraining {
+        t.Errorf("Expected %v %q; received %v %q", http.StatusServiceUnavailable, healthDraining, code, report.Status)
+    }
+
+    code, _ = probe(getHealthzHandler(formatter, health))
+    if code != http.StatusOK {
+        t.Errorf("Expected liveness to pass while draining; received %v", code)
+    }
+}
@@ -0,0 +1,306 @@
+package service
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/unrolled/render"
+)
+
+const defaultInviteExpiry = 7 * 24 * time.Hour
+
+//newInviteCode returns a random code that is hard to guess
+func newInviteCode() (string, error) {
+    b := make([]byte, 16)
+    _, err := rand.Read(b)
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+//inviteUsable reports if an invite can still be accepted or declined
+func inviteUsable(invite GroupInvite, now time.Time) bool {
+    if invite.RevokedAt != nil || invite.DeclinedAt != nil {
+        return false
+    }
+    if invite.ExpiresAt != nil && now.After(*invite.ExpiresAt) {
+        return false
+    }
+    return invite.MaxUses == 0 || invite.Uses < invite.MaxUses
+}
+
+func postGroupInviteHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var body struct {
+            UserID    uint  `json:"user_id"`
+            ExpiresIn int64 `json:"expires_in"`
+            MaxUses   int   `json:"max_uses"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        if len(payload) > 0 {
+            err := json.Unmarshal(payload, &body)
+            if err != nil || body.ExpiresIn < 0 || body.MaxUses < 0 {
+                formatter.JSON(w, http.StatusBadRequest, "Failed to parse invite.")
+                return
+            }
+        }
+
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        if body.UserID != 0 {
+            member, err := repo.isGroupMember(group.ID, body.UserID)
+            if err != nil {
+                formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+                return
+            }
+            if member {
+                formatter.JSON(w, http.StatusConflict, "User is already a member of this group.")
+                return
+            }
+        }
+
+        code, err := newInviteCode()
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to create invite.")
+            return
+        }
+
+        expiry := defaultInviteExpiry
+        if body.ExpiresIn > 0 {
+            expiry = time.Duration(body.ExpiresIn) * time.Second
+        }
+        expiresAt := repo.now().Add(expiry)
+
+        invite := GroupInvite{
+            GroupID:   group.ID,
+            Code:      code,
+            InviterID: userID,
+            InviteeID: body.UserID,
+            ExpiresAt: &expiresAt,
+            MaxUses:   body.MaxUses,
+        }
+        // an invite addressed to someone can only ever be used by them once
+        if invite.InviteeID != 0 {
+            invite.MaxUses = 1
+        }
+
+        invite, err = repo.addGroupInvite(invite)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to create invite.")
+            return
+        }
+        formatter.JSON(w, http.StatusCreated, invite)
+    }
+}
+
+func getGroupInvitesHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        invites, err := repo.getGroupInvites(group.ID, page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get invites")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, pageOf(invites, page))
+    }
+}
+
+func getUserInvitesHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        invites, err := repo.getUserInvites(userID, page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get invites")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, pageOf(invites, page))
+    }
+}
+
+func postInviteAcceptHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        invite, err := repo.getGroupInvite(vars["code"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Invite not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        if invite.InviteeID != 0 && invite.InviteeID != userID {
+            formatter.JSON(w, http.StatusForbidden, "Invite is for another user.")
+            return
+        }
+        if !inviteUsable(invite, repo.now()) {
+            formatter.JSON(w, http.StatusGone, "Invite is no longer valid.")
+            return
+        }
+
+        member, err := repo.isGroupMember(invite.GroupID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if member {
+            formatter.JSON(w, http.StatusConflict, "Already a member of this group.")
+            return
+        }
+
+        err = repo.acceptGroupInvite(invite.ID, invite.GroupID, userID)
+        if err == errInviteUsedUp {
+            formatter.JSON(w, http.StatusGone, "Invite is no longer valid.")
+            return
+        }
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to join group.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Invite succesfully accepted.")
+    }
+}
+
+func postInviteDeclineHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        invite, err := repo.getGroupInvite(vars["code"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Invite not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        // shareable codes are simply not used, only addressed invites are declined
+        if invite.InviteeID != userID {
+            formatter.JSON(w, http.StatusForbidden, "Invite is for another user.")
+            return
+        }
+        if !inviteUsable(invite, repo.now()) {
+            formatter.JSON(w, http.StatusGone, "Invite is no longer valid.")
+            return
+        }
+
+        err = repo.declineGroupInvite(invite.ID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to decline invite.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Invite succesfully declined.")
+    }
+}
+
+func deleteInviteHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        invite, err := repo.getGroupInvite(vars["code"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Invite not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(invite.GroupID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        err = repo.revokeGroupInvite(invite.ID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to revoke invite.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Invite succesfully revoked.")
+    }
+}
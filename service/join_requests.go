@@ -0,0 +1,207 @@
+package service
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+
+    "github.com/gorilla/mux"
+    "github.com/unrolled/render"
+)
+
+func postJoinRequestHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        if !group.Private {
+            formatter.JSON(w, http.StatusBadRequest, "Group is public, join it directly.")
+            return
+        }
+
+        member, err := repo.isGroupMember(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if member {
+            formatter.JSON(w, http.StatusConflict, "Already a member of this group.")
+            return
+        }
+
+        pending, err := repo.hasPendingJoinRequest(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check join requests.")
+            return
+        }
+        if pending {
+            formatter.JSON(w, http.StatusConflict, "Join request already pending.")
+            return
+        }
+
+        request := GroupJoinRequest{GroupID: group.ID, UserID: userID, Status: joinRequestPending}
+        request, err = repo.addJoinRequest(request)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to create join request.")
+            return
+        }
+        formatter.JSON(w, http.StatusCreated, request)
+    }
+}
+
+func getJoinRequestsHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if !admin {
+            formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+            return
+        }
+
+        status := req.URL.Query().Get("status")
+        switch status {
+        case "":
+            status = joinRequestPending
+        case joinRequestPending, joinRequestApproved, joinRequestRejected:
+        default:
+            formatter.JSON(w, http.StatusBadRequest, "Unknown join request status.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        requests, err := repo.getJoinRequests(group.ID, status, page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get join requests")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, pageOf(requests, page))
+    }
+}
+
+func postJoinRequestApproveHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        request, userID, ok := reviewableJoinRequest(w, req, formatter, repo)
+        if !ok {
+            return
+        }
+
+        err := repo.approveJoinRequest(request.ID, userID)
+        if err == errJoinRequestReviewed {
+            formatter.JSON(w, http.StatusConflict, "Join request already reviewed.")
+            return
+        }
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to approve join request.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Join request succesfully approved.")
+    }
+}
+
+func postJoinRequestRejectHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var body struct {
+            Reason string `json:"reason"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        if len(payload) > 0 {
+            err := json.Unmarshal(payload, &body)
+            if err != nil {
+                formatter.JSON(w, http.StatusBadRequest, "Failed to parse rejection.")
+                return
+            }
+        }
+
+        request, userID, ok := reviewableJoinRequest(w, req, formatter, repo)
+        if !ok {
+            return
+        }
+
+        err := repo.rejectJoinRequest(request.ID, userID, body.Reason)
+        if err == errJoinRequestReviewed {
+            formatter.JSON(w, http.StatusConflict, "Join request already reviewed.")
+            return
+        }
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to reject join request.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Join request succesfully rejected.")
+    }
+}
+
+//reviewableJoinRequest loads the pending join request named in the route and
+//checks the caller is an admin of its group, writing the error response and
+//returning false if not
+func reviewableJoinRequest(w http.ResponseWriter, req *http.Request, formatter *render.Render, repo repository) (GroupJoinRequest, uint, bool) {
+    vars := mux.Vars(req)
+    group, err := repo.getGroup(vars["id"])
+    if err != nil {
+        formatter.JSON(w, http.StatusNotFound, "Group not found")
+        return GroupJoinRequest{}, 0, false
+    }
+
+    request, err := repo.getJoinRequest(vars["requestID"])
+    if err != nil || request.GroupID != group.ID {
+        formatter.JSON(w, http.StatusNotFound, "Join request not found")
+        return GroupJoinRequest{}, 0, false
+    }
+
+    userID, err := userIDFromRequest(req)
+    if err != nil {
+        formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+        return GroupJoinRequest{}, 0, false
+    }
+
+    admin, err := repo.isGroupAdmin(group.ID, userID)
+    if err != nil {
+        formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+        return GroupJoinRequest{}, 0, false
+    }
+    if !admin {
+        formatter.JSON(w, http.StatusForbidden, "Not an admin of this group.")
+        return GroupJoinRequest{}, 0, false
+    }
+
+    if request.Status != joinRequestPending {
+        formatter.JSON(w, http.StatusConflict, "Join request already reviewed.")
+        return GroupJoinRequest{}, 0, false
+    }
+    return request, userID, true
+}
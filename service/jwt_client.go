@@ -0,0 +1,330 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "crypto"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    jwtHS256 = "HS256"
+    jwtRS256 = "RS256"
+
+    //jwtLeeway allows for clock drift between us and the token issuer on nbf
+    jwtLeeway = 30 * time.Second
+)
+
+//errExpiredToken is returned when a token verified locally is past its exp
+var errExpiredToken = errors.New("Token has expired")
+
+//jwtKey is a verification key, secret is used for HS256 and public for RS256
+type jwtKey struct {
+    secret      []byte
+    public      *rsa.PublicKey
+}
+
+//jwtClient verifies signed tokens locally instead of asking the auth service
+type jwtClient struct {
+    algorithm   string
+    keys        map[string]jwtKey
+    issuer      string
+    audience    string
+    now         func() time.Time
+}
+
+type jwtHeader struct {
+    Algorithm   string  `json:"alg"`
+    KeyID       string  `json:"kid"`
+}
+
+type jwtClaims struct {
+    Subject     string          `json:"sub"`
+    Issuer      string          `json:"iss"`
+    Audience    jwtAudience     `json:"aud"`
+    ExpiresAt   int64           `json:"exp"`
+    NotBefore   int64           `json:"nbf"`
+    Scope       string          `json:"scope"`
+    Scopes      []string        `json:"scopes"`
+}
+
+//jwtAudience accepts aud as either a single string or a list
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+    var single string
+    if err := json.Unmarshal(data, &single); err == nil {
+        *a = jwtAudience{single}
+        return nil
+    }
+    var list []string
+    err := json.Unmarshal(data, &list)
+    *a = jwtAudience(list)
+    return err
+}
+
+func (a jwtAudience) contains(audience string) bool {
+    for _, aud := range a {
+        if aud == audience {
+            return true
+        }
+    }
+    return false
+}
+
+//newJWTClient loads the verification keys for algorithm, keyFile holds the
+//HS256 secret or an RS256 public key in PEM and jwksFile a JWKS document,
+//one of the two has to be set
+func newJWTClient(algorithm, keyFile, jwksFile, issuer, audience string) (*jwtClient, error) {
+    if algorithm != jwtHS256 && algorithm != jwtRS256 {
+        return nil, fmt.Errorf("Unsupported JWT algorithm %q", algorithm)
+    }
+
+    var keys map[string]jwtKey
+    var err error
+    switch {
+    case jwksFile != "":
+        keys, err = loadJWKS(jwksFile, algorithm)
+    case keyFile != "":
+        keys, err = loadJWTKeyFile(keyFile, algorithm)
+    default:
+        err = errors.New("JWT verification needs a key file or a JWKS file")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if len(keys) == 0 {
+        return nil, errors.New("No usable JWT keys were found")
+    }
+
+    return &jwtClient{
+        algorithm: algorithm,
+        keys:      keys,
+        issuer:    issuer,
+        audience:  audience,
+        now:       time.Now,
+    }, nil
+}
+
+//loadJWTKeyFile reads a single key, which is used for tokens with any kid
+func loadJWTKeyFile(path, algorithm string) (map[string]jwtKey, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    if algorithm == jwtHS256 {
+        secret := bytes.TrimSpace(data)
+        if len(secret) == 0 {
+            return nil, errors.New("JWT secret file is empty")
+        }
+        return map[string]jwtKey{"": {secret: secret}}, nil
+    }
+
+    public, err := parseRSAPublicKey(data)
+    if err != nil {
+        return nil, err
+    }
+    return map[string]jwtKey{"": {public: public}}, nil
+}
+
+//parseRSAPublicKey accepts PKIX and PKCS1 public keys and certificates
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, errors.New("JWT key file is not PEM encoded")
+    }
+
+    switch block.Type {
+    case "RSA PUBLIC KEY":
+        return x509.ParsePKCS1PublicKey(block.Bytes)
+    case "CERTIFICATE":
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        if public, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+            return public, nil
+        }
+    default:
+        key, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        if public, ok := key.(*rsa.PublicKey); ok {
+            return public, nil
+        }
+    }
+    return nil, errors.New("JWT key file does not hold an RSA public key")
+}
+
+//loadJWKS reads the keys of a JWKS document that can be used with algorithm,
+//keys for other algorithms or uses are skipped
+func loadJWKS(path, algorithm string) (map[string]jwtKey, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var document struct {
+        Keys []struct {
+            KeyType     string  `json:"kty"`
+            KeyID       string  `json:"kid"`
+            Algorithm   string  `json:"alg"`
+            Use         string  `json:"use"`
+            N           string  `json:"n"`
+            E           string  `json:"e"`
+            K           string  `json:"k"`
+        } `json:"keys"`
+    }
+    err = json.Unmarshal(data, &document)
+    if err != nil {
+        return nil, err
+    }
+
+    keys := make(map[string]jwtKey)
+    for _, k := range document.Keys {
+        if (k.Algorithm != "" && k.Algorithm != algorithm) || (k.Use != "" && k.Use != "sig") {
+            continue
+        }
+
+        switch {
+        case algorithm == jwtHS256 && k.KeyType == "oct":
+            secret, err := base64.RawURLEncoding.DecodeString(k.K)
+            if err != nil {
+                return nil, fmt.Errorf("Bad JWKS key %q: %s", k.KeyID, err)
+            }
+            keys[k.KeyID] = jwtKey{secret: secret}
+        case algorithm == jwtRS256 && k.KeyType == "RSA":
+            n, err := base64.RawURLEncoding.DecodeString(k.N)
+            if err != nil {
+                return nil, fmt.Errorf("Bad JWKS key %q: %s", k.KeyID, err)
+            }
+            e, err := base64.RawURLEncoding.DecodeString(k.E)
+            if err != nil {
+                return nil, fmt.Errorf("Bad JWKS key %q: %s", k.KeyID, err)
+            }
+            public := &rsa.PublicKey{
+                N: new(big.Int).SetBytes(n),
+                E: int(new(big.Int).SetBytes(e).Int64()),
+            }
+            keys[k.KeyID] = jwtKey{public: public}
+        }
+    }
+    return keys, nil
+}
+
+//key picks the key named by kid, tokens without a kid are accepted when
+//there is only one key to choose from
+func (client *jwtClient) key(kid string) (jwtKey, bool) {
+    if key, ok := client.keys[kid]; ok {
+        return key, true
+    }
+    if key, ok := client.keys[""]; ok {
+        return key, true
+    }
+    if kid == "" && len(client.keys) == 1 {
+        for _, key := range client.keys {
+            return key, true
+        }
+    }
+    return jwtKey{}, false
+}
+
+func (client *jwtClient) verify(signed, signature []byte, key jwtKey) bool {
+    digest := sha256.Sum256(signed)
+    if client.algorithm == jwtHS256 {
+        if key.secret == nil {
+            return false
+        }
+        mac := hmac.New(sha256.New, key.secret)
+        mac.Write(signed)
+        return hmac.Equal(mac.Sum(nil), signature)
+    }
+    if key.public == nil {
+        return false
+    }
+    return rsa.VerifyPKCS1v15(key.public, crypto.SHA256, digest[:], signature) == nil
+}
+
+//getUserIDFromToken verifies the token signature and claims, the subject
+//has to be the numeric id of the user
+func (client *jwtClient) getUserIDFromToken(ctx context.Context, key string) (token Token, err error) {
+    parts := strings.Split(key, ".")
+    if len(parts) != 3 {
+        return token, errInvalidToken
+    }
+
+    var header jwtHeader
+    if !decodeJWTSegment(parts[0], &header) || header.Algorithm != client.algorithm {
+        return token, errInvalidToken
+    }
+    verifyKey, ok := client.key(header.KeyID)
+    if !ok {
+        return token, errInvalidToken
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil || !client.verify([]byte(parts[0]+"."+parts[1]), signature, verifyKey) {
+        return token, errInvalidToken
+    }
+
+    var claims jwtClaims
+    if !decodeJWTSegment(parts[1], &claims) {
+        return token, errInvalidToken
+    }
+
+    now := client.now()
+    if claims.ExpiresAt == 0 {
+        return token, errInvalidToken
+    }
+    if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+        return token, errExpiredToken
+    }
+    if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+        return token, errInvalidToken
+    }
+    if client.issuer != "" && claims.Issuer != client.issuer {
+        return token, errInvalidToken
+    }
+    if client.audience != "" && !claims.Audience.contains(client.audience) {
+        return token, errInvalidToken
+    }
+
+    userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+    if err != nil || userID == 0 {
+        return token, errInvalidToken
+    }
+
+    scopes := claims.Scopes
+    if len(scopes) == 0 && claims.Scope != "" {
+        scopes = strings.Fields(claims.Scope)
+    }
+
+    return Token{
+        Key:       key,
+        UserID:    uint(userID),
+        ExpiresAt: claims.ExpiresAt,
+        Scopes:    scopes,
+    }, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) bool {
+    payload, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return false
+    }
+    return json.Unmarshal(payload, v) == nil
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "io"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/urfave/negroni"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const (
+    requestIDHeader = "X-Request-ID"
+    //maxRequestIDLength keeps callers from stuffing our logs through the header
+    maxRequestIDLength = 128
+)
+
+//NewLogger writes JSON lines at level and above, an unknown level falls back
+//to info since the config reports it anyway
+func NewLogger(w io.Writer, level string) *slog.Logger {
+    var threshold slog.Level
+    if err := threshold.UnmarshalText([]byte(level)); err != nil {
+        threshold = slog.LevelInfo
+    }
+    return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: threshold}))
+}
+
+//validLogLevel reports if level is one NewLogger understands
+func validLogLevel(level string) bool {
+    var threshold slog.Level
+    return threshold.UnmarshalText([]byte(level)) == nil
+}
+
+//requestInfo is what every log line of a request is tagged with, the caller
+//is filled in by the auth middleware once it is known
+type requestInfo struct {
+    id          string
+    route       string
+
+    mu          sync.Mutex
+    userID      uint
+    botID       uint
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+    return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+    info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+    return info
+}
+
+//requestIDFromContext returns the id of the request ctx belongs to, or an
+//empty string outside of a request
+func requestIDFromContext(ctx context.Context) string {
+    if info := requestInfoFromContext(ctx); info != nil {
+        return info.id
+    }
+    return ""
+}
+
+func (info *requestInfo) setCaller(principal Principal) {
+    info.mu.Lock()
+    defer info.mu.Unlock()
+    info.userID = principal.UserID
+    info.botID = principal.BotID
+}
+
+//loggerFor tags logger with the request and trace ctx belongs to, a nil
+//logger is replaced with slog.Default
+func loggerFor(ctx context.Context, logger *slog.Logger) *slog.Logger {
+    if logger == nil {
+        logger = slog.Default()
+    }
+    if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+        logger = logger.With("trace_id", span.TraceID().String())
+    }
+    info := requestInfoFromContext(ctx)
+    if info == nil {
+        return logger
+    }
+    info.mu.Lock()
+    defer info.mu.Unlock()
+
+    attrs := []any{"request_id", info.id, "route", info.route}
+    if info.userID != 0 {
+        attrs = append(attrs, "user_id", info.userID)
+    }
+    if info.botID != 0 {
+        attrs = append(attrs, "bot_id", info.botID)
+    }
+    return logger.With(attrs...)
+}
+
+//newRequestID returns 16 random bytes in hex
+func newRequestID() string {
+    id := make([]byte, 16)
+    rand.Read(id)
+    return hex.EncodeToString(id)
+}
+
+//validRequestID accepts ids of printable ascii that aren't too long
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if id[i] <= ' ' || id[i] > '~' {
+            return false
+        }
+    }
+    return true
+}
+
+//setRequestID passes the request id of ctx on to an outbound request, calls
+//made outside of a request get an id of their own
+func setRequestID(ctx context.Context, req *http.Request) {
+    id := requestIDFromContext(ctx)
+    if id == "" {
+        id = newRequestID()
+    }
+    req.Header.Set(requestIDHeader, id)
+}
+
+//RequestLogger accepts or generates an X-Request-ID, echoes it back and logs
+//every request once it is done
+type RequestLogger struct {
+    logger      *slog.Logger
+    routers     []*mux.Router
+}
+
+//NewRequestLogger goes right after RequestTracing, so its logs carry the
+//trace id and everything after it can log with the request id
+func NewRequestLogger(logger *slog.Logger, routers ...*mux.Router) *RequestLogger {
+    return &RequestLogger{logger: logger, routers: routers}
+}
+
+// The request logging handler
+func (l *RequestLogger) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+    start := time.Now()
+    id := req.Header.Get(requestIDHeader)
+    if !validRequestID(id) {
+        id = newRequestID()
+    }
+    w.Header().Set(requestIDHeader, id)
+
+    info := &requestInfo{id: id, route: routeTemplate(req, l.routers)}
+    ctx := withRequestInfo(req.Context(), info)
+    rw, ok := w.(negroni.ResponseWriter)
+    if !ok {
+        rw = negroni.NewResponseWriter(w)
+    }
+    next(rw, req.WithContext(ctx))
+
+    status := rw.Status()
+    if status == 0 {
+        status = http.StatusOK
+    }
+    level := slog.LevelInfo
+    if status >= http.StatusInternalServerError {
+        level = slog.LevelError
+    }
+    loggerFor(ctx, l.logger).Log(ctx, level, "Handled request",
+        "method", req.Method,
+        "path", req.URL.Path,
+        "status", status,
+        "latency_ms", float64(time.Since(start))/float64(time.Millisecond),
+    )
+}
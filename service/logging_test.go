@@ -0,0 +1,92 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/urfave/negroni"
+)
+
+func TestRequestLoggerTagsRequests(t *testing.T) {
+    var out bytes.Buffer
+    logger := NewLogger(&out, "info")
+    router := mux.NewRouter()
+    router.HandleFunc("/api/posts/{id}", func(w http.ResponseWriter, req *http.Request) {
+        withPrincipal(req.Context(), Principal{UserID: 7})
+        loggerFor(req.Context(), logger).Info("Inside handler")
+        w.WriteHeader(http.StatusCreated)
+    })
+    n := negroni.New(NewRequestLogger(logger, router), negroni.Wrap(router))
+
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/api/posts/3", nil)
+    request.Header.Set(requestIDHeader, "abc-123")
+    n.ServeHTTP(recorder, request)
+
+    if id := recorder.Header().Get(requestIDHeader); id != "abc-123" {
+        t.Errorf("Expected the request id to be echoed; received %q", id)
+    }
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("Expected 2 log lines; received %d", len(lines))
+    }
+    for _, line := range lines {
+        var entry map[string]interface{}
+        if err := json.Unmarshal([]byte(line), &entry); err != nil {
+            t.Fatalf("Expected a JSON log line; received %s", line)
+        }
+        if entry["request_id"] != "abc-123" || entry["route"] != "/api/posts/{id}" || entry["user_id"] != float64(7) {
+            t.Errorf("Expected request id, route and user on every line; received %s", line)
+        }
+    }
+
+    var entry map[string]interface{}
+    json.Unmarshal([]byte(lines[1]), &entry)
+    if entry["status"] != float64(http.StatusCreated) || entry["latency_ms"] == nil || entry["level"] != "INFO" {
+        t.Errorf("Expected the status and latency to be logged; received %s", lines[1])
+    }
+}
+
+func TestRequestLoggerGeneratesIDs(t *testing.T) {
+    var out bytes.Buffer
+    n := negroni.New(NewRequestLogger(NewLogger(&out, "error")), negroni.Wrap(http.NotFoundHandler()))
+
+    for _, id := range []string{"", "has spaces", strings.Repeat("a", maxRequestIDLength+1)} {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest("GET", "/", nil)
+        request.Header.Set(requestIDHeader, id)
+        n.ServeHTTP(recorder, request)
+
+        generated := recorder.Header().Get(requestIDHeader)
+        if generated == id || len(generated) != 32 {
+            t.Errorf("Expected a generated id in place of %q; received %q", id, generated)
+        }
+    }
+    if out.Len() != 0 {
+        t.Errorf("Expected nothing below the error level to be logged; received %s", out.String())
+    }
+}
+
+func TestAuthClientPropagatesRequestID(t *testing.T) {
+    received := make(chan string, 1)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        received <- req.Header.Get(requestIDHeader)
+        w.WriteHeader(http.StatusNotFound)
+    }))
+    defer server.Close()
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, Timeout: Duration(time.Second)})
+    ctx := withRequestInfo(context.Background(), &requestInfo{id: "req-42"})
+    client.getUserIDFromToken(ctx, "abc")
+
+    if id := <-received; id != "req-42" {
+        t.Errorf("Expected the auth service to receive the request id; received %q", id)
+    }
+}
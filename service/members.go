@@ -0,0 +1,152 @@
+package service
+
+import (
+    "net/http"
+
+    "github.com/gorilla/mux"
+    "github.com/unrolled/render"
+)
+
+func postGroupMemberHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        if group.Private {
+            formatter.JSON(w, http.StatusForbidden, "Group is private.")
+            return
+        }
+
+        member, err := repo.isGroupMember(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if member {
+            formatter.JSON(w, http.StatusConflict, "Already a member of this group.")
+            return
+        }
+
+        err = repo.addGroupMember(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to join group.")
+            return
+        }
+        formatter.JSON(w, http.StatusCreated, "Group succesfully joined.")
+    }
+}
+
+func deleteGroupMemberHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        member, err := repo.isGroupMember(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !member {
+            formatter.JSON(w, http.StatusNotFound, "Not a member of this group.")
+            return
+        }
+
+        if group.OwnerID == userID {
+            formatter.JSON(w, http.StatusConflict, "Owner can't leave, transfer ownership first.")
+            return
+        }
+
+        admin, err := repo.isGroupAdmin(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+            return
+        }
+        if admin {
+            admins, err := repo.countGroupAdmins(group.ID)
+            if err != nil {
+                formatter.JSON(w, http.StatusInternalServerError, "Failed to check group admins.")
+                return
+            }
+            // a group always needs someone to manage it
+            if admins <= 1 {
+                formatter.JSON(w, http.StatusConflict, "Last admin can't leave, promote another admin first.")
+                return
+            }
+            err = repo.removeGroupAdmin(group.ID, userID)
+            if err != nil {
+                formatter.JSON(w, http.StatusInternalServerError, "Failed to leave group.")
+                return
+            }
+        }
+
+        err = repo.removeGroupMember(group.ID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to leave group.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Group succesfully left.")
+    }
+}
+
+func getGroupMembersHandler(formatter *render.Render, repo repository) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        group, err := repo.getGroup(vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, "Group not found")
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canReadGroup(repo, group, Principal{UserID: userID})
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        page, err := cursorParams(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse cursor.")
+            return
+        }
+
+        members, err := repo.getGroupMembers(group.ID, page)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get group members")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, pageOf(members, page))
+    }
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/jinzhu/gorm"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "github.com/urfave/negroni"
+    "gopkg.in/redis.v4"
+)
+
+//unmatchedRoute labels requests that didn't match a route, so raw paths never
+//end up in labels
+const unmatchedRoute = "unmatched"
+
+//Metrics holds the prometheus collectors of a server, each server gets its
+//own registry. A nil *Metrics records nothing
+type Metrics struct {
+    registry        *prometheus.Registry
+    requests        *prometheus.CounterVec
+    requestDuration *prometheus.HistogramVec
+    repoDuration    *prometheus.HistogramVec
+    redisDuration   *prometheus.HistogramVec
+    tokenCache      *prometheus.CounterVec
+    authRequests    *prometheus.CounterVec
+    authDuration    *prometheus.HistogramVec
+}
+
+//NewMetrics registers the collectors along with the go and process ones
+func NewMetrics() *Metrics {
+    m := &Metrics{
+        registry: prometheus.NewRegistry(),
+        requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "grouper_http_requests_total",
+            Help: "HTTP requests by method, route template and status.",
+        }, []string{"method", "route", "status"}),
+        requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "grouper_http_request_duration_seconds",
+            Help:    "HTTP request latency by method, route template and status.",
+            Buckets: prometheus.DefBuckets,
+        }, []string{"method", "route", "status"}),
+        repoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "grouper_repository_duration_seconds",
+            Help:    "Repository call latency by method and outcome.",
+            Buckets: prometheus.DefBuckets,
+        }, []string{"method", "outcome"}),
+        redisDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "grouper_redis_duration_seconds",
+            Help:    "Redis command latency by command and outcome.",
+            Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+        }, []string{"command", "outcome"}),
+        tokenCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "grouper_token_cache_lookups_total",
+            Help: "Token cache lookups by result, hit, miss, invalid or revoked.",
+        }, []string{"result"}),
+        authRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "grouper_auth_requests_total",
+            Help: "Token lookups against the auth service by outcome.",
+        }, []string{"outcome"}),
+        authDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "grouper_auth_request_duration_seconds",
+            Help:    "Latency of single calls to the auth service.",
+            Buckets: prometheus.DefBuckets,
+        }, []string{"outcome"}),
+    }
+    m.registry.MustRegister(
+        prometheus.NewGoCollector(),
+        prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+        m.requests,
+        m.requestDuration,
+        m.repoDuration,
+        m.redisDuration,
+        m.tokenCache,
+        m.authRequests,
+        m.authDuration,
+    )
+    return m
+}
+
+//Handler serves the metrics in the prometheus text format
+func (m *Metrics) Handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+//outcome labels an error as ok or error
+func outcome(err error) string {
+    if err != nil {
+        return "error"
+    }
+    return "ok"
+}
+
+//observeRepository times a call, records that aren't found are labeled apart
+//from errors since handlers answer them with a 404
+func (m *Metrics) observeRepository(method string, start time.Time, err error) {
+    if m == nil {
+        return
+    }
+    result := outcome(err)
+    if gorm.IsRecordNotFoundError(err) {
+        result = "not_found"
+    }
+    m.repoDuration.WithLabelValues(method, result).Observe(time.Since(start).Seconds())
+}
+
+//observeRedis times a command, redis.Nil is a normal miss and not an error
+func (m *Metrics) observeRedis(command string, start time.Time, err error) {
+    if m == nil {
+        return
+    }
+    if err == redis.Nil {
+        err = nil
+    }
+    m.redisDuration.WithLabelValues(command, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeTokenCache(result string) {
+    if m == nil {
+        return
+    }
+    m.tokenCache.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) observeAuthRequest(outcome string, start time.Time) {
+    if m == nil {
+        return
+    }
+    m.authDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeAuthResult(outcome string) {
+    if m == nil {
+        return
+    }
+    m.authRequests.WithLabelValues(outcome).Inc()
+}
+
+//authOutcome labels the result of a token lookup
+func authOutcome(err error) string {
+    switch err {
+    case nil:
+        return "ok"
+    case errInvalidToken:
+        return "invalid"
+    case context.Canceled, context.DeadlineExceeded:
+        return "canceled"
+    }
+    return "unavailable"
+}
+
+//RequestMetrics records every request, labeled by the template of the route
+//it matched in routers
+type RequestMetrics struct {
+    metrics     *Metrics
+    routers     []*mux.Router
+}
+
+//NewRequestMetrics has to come before any handler that writes a response
+func NewRequestMetrics(metrics *Metrics, routers ...*mux.Router) *RequestMetrics {
+    return &RequestMetrics{metrics: metrics, routers: routers}
+}
+
+//routeTemplate finds the template of the route a request is for in routers
+func routeTemplate(req *http.Request, routers []*mux.Router) string {
+    for _, router := range routers {
+        var match mux.RouteMatch
+        if router.Match(req, &match) && match.Route != nil {
+            if template, err := match.Route.GetPathTemplate(); err == nil {
+                return template
+            }
+        }
+    }
+    return unmatchedRoute
+}
+
+// The metrics handler
+func (m *RequestMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+    start := time.Now()
+    rw, ok := w.(negroni.ResponseWriter)
+    if !ok {
+        rw = negroni.NewResponseWriter(w)
+    }
+    next(rw, req)
+
+    status := rw.Status()
+    if status == 0 {
+        status = http.StatusOK
+    }
+    labels := []string{req.Method, routeTemplate(req, m.routers), strconv.Itoa(status)}
+    m.metrics.requests.WithLabelValues(labels...).Inc()
+    m.metrics.requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
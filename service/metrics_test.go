@@ -0,0 +1,82 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+    "github.com/urfave/negroni"
+)
+
+func TestRequestMetricsUseRouteTemplates(t *testing.T) {
+    metrics := NewMetrics()
+    router := mux.NewRouter()
+    router.HandleFunc("/api/posts/{id}", func(w http.ResponseWriter, req *http.Request) {
+        w.WriteHeader(http.StatusNotFound)
+    }).Methods("GET")
+    n := negroni.New(NewRequestMetrics(metrics, router), negroni.Wrap(router))
+
+    for _, path := range []string{"/api/posts/1", "/api/posts/2", "/nowhere"} {
+        request, _ := http.NewRequest("GET", path, nil)
+        n.ServeHTTP(httptest.NewRecorder(), request)
+    }
+
+    if count := testutil.ToFloat64(metrics.requests.WithLabelValues("GET", "/api/posts/{id}", "404")); count != 2 {
+        t.Errorf("Expected 2 requests for the route template; received %v", count)
+    }
+    if count := testutil.ToFloat64(metrics.requests.WithLabelValues("GET", unmatchedRoute, "404")); count != 1 {
+        t.Errorf("Expected 1 unmatched request; received %v", count)
+    }
+}
+
+func TestMetricsCountTokenCacheLookups(t *testing.T) {
+    metrics := NewMetrics()
+    client := &countingAuthClient{tokens: map[string]Token{
+        "good": {Key: "good", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+    }}
+    middleware := &Middleware{store: newMemoryTokenStore(), repo: &repoTest{}, client: client, now: time.Now, metrics: metrics}
+
+    middleware.principalForToken(context.Background(), "good", time.Now())
+    middleware.principalForToken(context.Background(), "good", time.Now())
+    middleware.principalForToken(context.Background(), "bad", time.Now())
+
+    if hits := testutil.ToFloat64(metrics.tokenCache.WithLabelValues("hit")); hits != 1 {
+        t.Errorf("Expected 1 hit; received %v", hits)
+    }
+    if misses := testutil.ToFloat64(metrics.tokenCache.WithLabelValues("miss")); misses != 2 {
+        t.Errorf("Expected 2 misses; received %v", misses)
+    }
+}
+
+func TestInstrumentedRepositoryLabelsOutcomes(t *testing.T) {
+    metrics := NewMetrics()
+    repo := instrumentedRepository{repo: &repoTest{}, metrics: metrics}
+
+    repo.getGroup("1")
+    repo.revokeAPIKey("1")
+
+    families, err := metrics.registry.Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    series := make(map[string]bool)
+    for _, family := range families {
+        if family.GetName() != "grouper_repository_duration_seconds" {
+            continue
+        }
+        for _, metric := range family.GetMetric() {
+            labels := make(map[string]string)
+            for _, label := range metric.GetLabel() {
+                labels[label.GetName()] = label.GetValue()
+            }
+            series[labels["method"]+" "+labels["outcome"]] = true
+        }
+    }
+    if !series["getGroup error"] || !series["revokeAPIKey not_found"] || len(series) != 2 {
+        t.Errorf("Expected getGroup error and revokeAPIKey not_found; received %v", series)
+    }
+}
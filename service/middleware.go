@@ -1,43 +1,128 @@
 package service
 
 import (
+    "context"
+    "log/slog"
     "net/http"
-    "os"
+    "strings"
     "time"
 )
 
 type Middleware struct {
-    auth bool
+    auth        bool
+    store       tokenStore
+    repo        repository
+    client      authClient
+    negativeTTL time.Duration
+    now         func() time.Time
+    metrics     *Metrics
+    logger      *slog.Logger
 }
 
-// New`Middleware is a struct that has a ServeHTTP method
-func NewMiddleware() *Middleware {
-    return &Middleware{true}
+// New`Middleware is a struct that has a ServeHTTP method, tokens are cached
+// in store and looked up with the auth client of deps
+func NewMiddleware(repo repository, store tokenStore, cfg TokenConfig, deps Dependencies) *Middleware {
+    deps = deps.withDefaults()
+    return &Middleware{
+        auth:        true,
+        store:       store,
+        repo:        repo,
+        client:      deps.Auth,
+        negativeTTL: time.Duration(cfg.NegativeTTL),
+        now:         deps.Clock,
+        metrics:     deps.Metrics,
+        logger:      deps.Logger,
+    }
+}
+
+//tokenFromRequest reads the token from the Authorization header, accepting
+//both the Bearer scheme and a bare token
+func tokenFromRequest(req *http.Request) string {
+    header := strings.TrimSpace(req.Header.Get("Authorization"))
+    if len(header) > len("bearer ") && strings.EqualFold(header[:len("bearer ")], "bearer ") {
+        return strings.TrimSpace(header[len("bearer "):])
+    }
+    return header
 }
 
 // The middleware handler
 func (l *Middleware) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
-    serviceClient := authtWebClient{
-        rootURL: os.Getenv("AUTH_URL"),
-    }
-    key := req.Header.Get("Authorization")
     w.Header().Set("Content-Type", "application/json")
-    if key == "" {
-        http.Error(w, "Failed to find token", http.StatusInternalServerError)
-        return
+
+    var principal Principal
+    var err error
+    if apiKey := req.Header.Get(apiKeyHeader); apiKey != "" {
+        principal, err = principalForAPIKey(repoFor(req, l.repo), apiKey)
+    } else {
+        key := tokenFromRequest(req)
+        if key == "" {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeError(w, http.StatusUnauthorized, errCodeMissingToken, "Failed to find token")
+            return
+        }
+        principal, err = l.principalForToken(req.Context(), key, l.now())
     }
 
-    _, err := REDIS.Get(key).Result()
-    if err != nil {
+    switch err {
+    case nil:
+        next(w, req.WithContext(withPrincipal(req.Context(), principal)))
+    case errAuthUnavailable:
+        loggerFor(req.Context(), l.logger).Warn("Failed to authenticate, the auth service is unavailable")
+        writeError(w, http.StatusServiceUnavailable, errCodeAuthUnavailable, "Auth service is unavailable")
+    case context.Canceled, context.DeadlineExceeded:
+        loggerFor(req.Context(), l.logger).Info("Request ended before it was authenticated")
+        writeError(w, http.StatusServiceUnavailable, errCodeAuthUnavailable, "Request ended before it was authenticated")
+    case errExpiredToken:
+        w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+        writeError(w, http.StatusUnauthorized, errCodeExpiredToken, "Token has expired")
+    case errRevokedToken:
+        w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+        writeError(w, http.StatusUnauthorized, errCodeRevokedToken, "Token has been revoked")
+    default:
+        w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+        writeError(w, http.StatusUnauthorized, errCodeInvalidToken, "Token is not valid")
+    }
+}
+
+//principalForToken resolves a user token through the cache, falling back to
+//the auth client
+func (l *Middleware) principalForToken(ctx context.Context, key string, now time.Time) (Principal, error) {
+    principal, err := cachedPrincipal(ctx, l.store, key, now)
+    switch err {
+    case nil, errExpiredToken:
+        l.metrics.observeTokenCache("hit")
+    case errInvalidToken:
+        l.metrics.observeTokenCache("invalid")
+    case errRevokedToken:
+        l.metrics.observeTokenCache("revoked")
+    default:
+        l.metrics.observeTokenCache("miss")
+    }
+    if err == errTokenNotCached {
         // if the token is not in redis get it and then set it
-        token, err := serviceClient.getUserIDFromToken(key)
-        if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
+        principal, err = lookupPrincipal(ctx, l.client, key, now)
+        switch err {
+        case nil:
+            cachePrincipal(ctx, l.store, key, principal, now)
+        case errInvalidToken, errExpiredToken:
+            cacheRejectedToken(ctx, l.store, key, err, l.negativeTTL)
         }
-        now := time.Now().Unix()
-        seconds := time.Second * time.Duration(token.ExpiresAt - now)
-        REDIS.Set(token.Key, string(token.UserID), seconds)
     }
-    next(w, req)
+    return principal, err
+}
+
+//lookupPrincipal asks the auth client about a token that isn't cached
+func lookupPrincipal(ctx context.Context, client authClient, key string, now time.Time) (Principal, error) {
+    token, err := client.getUserIDFromToken(ctx, key)
+    if err != nil {
+        return Principal{}, err
+    }
+    if token.ExpiresAt <= now.Unix() {
+        return Principal{}, errExpiredToken
+    }
+    return Principal{
+        UserID:    token.UserID,
+        ExpiresAt: time.Unix(token.ExpiresAt, 0),
+        Scopes:    token.Scopes,
+    }, nil
 }
@@ -0,0 +1,712 @@
+package service
+
+import (
+    "context"
+    "crypto"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "io/ioutil"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/urfave/negroni"
+)
+
+func TestMiddlewareMissingToken(t *testing.T) {
+    middleware := NewMiddleware(&repoTest{}, newMemoryTokenStore(), DefaultConfig().Tokens, Dependencies{Auth: &countingAuthClient{}})
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/api/groups", nil)
+
+    called := false
+    middleware.ServeHTTP(recorder, request, func(w http.ResponseWriter, req *http.Request) {
+        called = true
+    })
+
+    if called {
+        t.Error("Request without a token should not reach the handler")
+    }
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+    }
+
+    var body apiError
+    err := json.Unmarshal(recorder.Body.Bytes(), &body)
+    if err != nil {
+        t.Errorf("Error unmarshaling error body: %s", err)
+    }
+    if body.Code != errCodeMissingToken {
+        t.Errorf("Expected code %s, got %s", errCodeMissingToken, body.Code)
+    }
+}
+
+func TestTokenFromRequest(t *testing.T) {
+    cases := map[string]string{
+        "":                 "",
+        "abc":              "abc",
+        "Bearer abc":       "abc",
+        "bearer   abc ":    "abc",
+        "Bearer":           "Bearer",
+    }
+    for header, expected := range cases {
+        request, _ := http.NewRequest("GET", "/", nil)
+        request.Header.Set("Authorization", header)
+        if token := tokenFromRequest(request); token != expected {
+            t.Errorf("Expected %q from %q, got %q", expected, header, token)
+        }
+    }
+}
+
+func TestAuthClientClassifiesResponses(t *testing.T) {
+    cases := []struct {
+        status      int
+        body        string
+        expected    error
+    }{
+        {http.StatusOK, "{\"token\":\"abc\",\"user_id\":1,\"expires_at\":1}", nil},
+        {http.StatusOK, "not json", errInvalidToken},
+        {http.StatusNotFound, "", errInvalidToken},
+        {http.StatusUnauthorized, "", errInvalidToken},
+        {http.StatusBadGateway, "", errAuthUnavailable},
+    }
+
+    for _, c := range cases {
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+            w.WriteHeader(c.status)
+            w.Write([]byte(c.body))
+        }))
+        client := authtWebClient{rootURL: server.URL}
+        _, err := client.getUserIDFromToken(context.Background(), "abc")
+        if err != c.expected {
+            t.Errorf("Expected %v for status %d, got %v", c.expected, c.status, err)
+        }
+        server.Close()
+    }
+
+    client := authtWebClient{rootURL: "http://127.0.0.1:1"}
+    _, err := client.getUserIDFromToken(context.Background(), "abc")
+    if err != errAuthUnavailable {
+        t.Errorf("Expected %v when auth service is down, got %v", errAuthUnavailable, err)
+    }
+}
+
+func TestAuthClientRetriesTransientFailures(t *testing.T) {
+    calls := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        calls++
+        if calls < 3 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte("{\"token\":\"abc\",\"user_id\":1,\"expires_at\":1}"))
+    }))
+    defer server.Close()
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, Retries: 2, RetryBackoff: Duration(time.Millisecond)})
+    token, err := client.getUserIDFromToken(context.Background(), "abc")
+    if err != nil || token.UserID != 1 {
+        t.Errorf("Expected the third attempt to succeed, got %v", err)
+    }
+    if calls != 3 {
+        t.Errorf("Expected 3 calls, got %d", calls)
+    }
+
+    calls = 0
+    client = newAuthWebClient(AuthConfig{URL: server.URL, Retries: 0})
+    _, err = client.getUserIDFromToken(context.Background(), "abc")
+    if err != errAuthUnavailable || calls != 1 {
+        t.Errorf("Expected a single failed call, got %d calls and %v", calls, err)
+    }
+}
+
+func TestAuthClientStopsRetryingWhenCanceled(t *testing.T) {
+    calls := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        calls++
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer server.Close()
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, Retries: 3, RetryBackoff: Duration(time.Minute)})
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    _, err := client.getUserIDFromToken(ctx, "abc")
+    if err != context.DeadlineExceeded || calls != 1 {
+        t.Errorf("Expected a single call ended by the deadline, got %d calls and %v", calls, err)
+    }
+    if time.Since(start) > time.Second {
+        t.Errorf("Expected the backoff to end with the request")
+    }
+}
+
+func TestAuthClientCancellationsDontTripTheBreaker(t *testing.T) {
+    calls := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        calls++
+        w.Write([]byte("{\"token\":\"abc\",\"user_id\":1,\"expires_at\":1}"))
+    }))
+    defer server.Close()
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, BreakerThreshold: 1, BreakerCooldown: Duration(time.Minute)})
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    for i := 0; i < 3; i++ {
+        if _, err := client.getUserIDFromToken(ctx, "abc"); err != context.Canceled {
+            t.Errorf("Expected %v, got %v", context.Canceled, err)
+        }
+    }
+    if calls != 0 {
+        t.Errorf("Expected a canceled request not to call the auth service, got %d calls", calls)
+    }
+
+    // a half open trial that is abandoned leaves the next call to be the trial
+    client.breaker.failure()
+    client.breaker.openedAt = time.Now().Add(-time.Hour)
+    if !client.breaker.allow() {
+        t.Fatal("Expected a trial after the cooldown")
+    }
+    client.breaker.release()
+    if _, err := client.getUserIDFromToken(context.Background(), "abc"); err != nil || calls != 1 {
+        t.Errorf("Expected the breaker to let the next call through, got %v", err)
+    }
+}
+
+func TestAuthClientTimesOut(t *testing.T) {
+    release := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        <-release
+    }))
+    defer server.Close()
+    defer close(release)
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, Timeout: Duration(20 * time.Millisecond)})
+    _, err := client.getUserIDFromToken(context.Background(), "abc")
+    if err != errAuthUnavailable {
+        t.Errorf("Expected %v from a slow auth service, got %v", errAuthUnavailable, err)
+    }
+}
+
+func TestCircuitBreaker(t *testing.T) {
+    calls := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        calls++
+        w.WriteHeader(http.StatusBadGateway)
+    }))
+    defer server.Close()
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, BreakerThreshold: 2, BreakerCooldown: Duration(time.Minute)})
+    now := time.Now()
+    client.breaker.now = func() time.Time { return now }
+
+    for i := 0; i < 4; i++ {
+        client.getUserIDFromToken(context.Background(), "abc")
+    }
+    if calls != 2 {
+        t.Errorf("Expected the breaker to open after 2 calls, got %d", calls)
+    }
+
+    now = now.Add(2 * time.Minute)
+    client.getUserIDFromToken(context.Background(), "abc")
+    client.getUserIDFromToken(context.Background(), "abc")
+    if calls != 3 {
+        t.Errorf("Expected a single trial call after the cooldown, got %d", calls-2)
+    }
+
+    now = now.Add(2 * time.Minute)
+    client.breaker.allow()
+    client.breaker.success()
+    if !client.breaker.allow() {
+        t.Error("Expected the breaker to close after a successful trial")
+    }
+}
+
+type memoryTokenStore struct {
+    values  map[string]string
+    ttls    map[string]time.Duration
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+    return &memoryTokenStore{values: map[string]string{}, ttls: map[string]time.Duration{}}
+}
+
+func (s *memoryTokenStore) get(ctx context.Context, key string) (string, error) {
+    value, ok := s.values[key]
+    if !ok {
+        return "", errTokenNotCached
+    }
+    return value, nil
+}
+
+func (s *memoryTokenStore) set(ctx context.Context, key, value string, ttl time.Duration) error {
+    s.values[key] = value
+    s.ttls[key] = ttl
+    return nil
+}
+
+func (s *memoryTokenStore) add(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+    if _, ok := s.values[key]; ok {
+        return false, nil
+    }
+    return true, s.set(ctx, key, value, ttl)
+}
+
+func (s *memoryTokenStore) ttl(ctx context.Context, key string) (time.Duration, error) {
+    ttl, ok := s.ttls[key]
+    if !ok {
+        return -2, nil
+    }
+    return ttl, nil
+}
+
+type countingAuthClient struct {
+    calls   int
+    tokens  map[string]Token
+}
+
+func (c *countingAuthClient) getUserIDFromToken(ctx context.Context, key string) (Token, error) {
+    c.calls++
+    token, ok := c.tokens[key]
+    if !ok {
+        return token, errInvalidToken
+    }
+    return token, nil
+}
+
+func serveMiddleware(middleware *Middleware, token string) *httptest.ResponseRecorder {
+    recorder := httptest.NewRecorder()
+    request, _ := http.NewRequest("GET", "/api/groups", nil)
+    request.Header.Set("Authorization", "Bearer "+token)
+    middleware.ServeHTTP(recorder, request, func(w http.ResponseWriter, req *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    })
+    return recorder
+}
+
+func TestMiddlewareCachesInvalidTokens(t *testing.T) {
+    client := &countingAuthClient{tokens: map[string]Token{}}
+    store := newMemoryTokenStore()
+    middleware := &Middleware{store: store, repo: &repoTest{}, client: client, negativeTTL: 30 * time.Second, now: time.Now}
+
+    for i := 0; i < 3; i++ {
+        recorder := serveMiddleware(middleware, "bad")
+        if recorder.Code != http.StatusUnauthorized {
+            t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+        }
+    }
+    if client.calls != 1 {
+        t.Errorf("Expected a single auth call for a bad token, got %d", client.calls)
+    }
+    if store.ttls[tokenCacheKey("bad")] != 30 * time.Second {
+        t.Errorf("Expected the bad token to be cached for %v, got %v", 30 * time.Second, store.ttls[tokenCacheKey("bad")])
+    }
+}
+
+func TestMiddlewareCachesExpiredTokensAsExpired(t *testing.T) {
+    client := &countingAuthClient{tokens: map[string]Token{
+        "old": {Key: "old", UserID: 1, ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+    }}
+    store := newMemoryTokenStore()
+    middleware := &Middleware{store: store, repo: &repoTest{}, client: client, negativeTTL: 30 * time.Second, now: time.Now}
+
+    recorder := serveMiddleware(middleware, "old")
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+    }
+    if store.values[tokenCacheKey("old")] != expiredTokenMarker {
+        t.Errorf("Expected the expired token to be cached as expired, got %q", store.values[tokenCacheKey("old")])
+    }
+    recorder = serveMiddleware(middleware, "old")
+    if !strings.Contains(recorder.Body.String(), errCodeExpiredToken) || client.calls != 1 {
+        t.Errorf("Expected the cached token to still be reported as expired, got %s", recorder.Body.String())
+    }
+
+    err := cachePrincipal(context.Background(), store, "gone", Principal{UserID: 1, ExpiresAt: time.Now().Add(-time.Second)}, time.Now())
+    if err != errExpiredToken {
+        t.Errorf("Expected %v, got %v", errExpiredToken, err)
+    }
+    if _, ok := store.values[tokenCacheKey("gone")]; ok {
+        t.Error("Expired principal should not be cached")
+    }
+}
+
+func TestTokensCantPickTheirCacheKey(t *testing.T) {
+    store := newMemoryTokenStore()
+    token := "ratelimit:read:ip:10.0.0.1:1200"
+    cacheRejectedToken(context.Background(), store, token, errInvalidToken, time.Minute)
+    if _, ok := store.values[token]; ok {
+        t.Error("Expected the token not to be used as the key")
+    }
+    for key := range store.values {
+        if !strings.HasPrefix(key, "token:") || strings.Contains(key, token) {
+            t.Errorf("Expected a hashed key under token:, got %q", key)
+        }
+    }
+}
+
+//revokingAuthClient revokes the token while it is being looked up
+type revokingAuthClient struct {
+    store   tokenStore
+}
+
+func (c revokingAuthClient) getUserIDFromToken(ctx context.Context, key string) (Token, error) {
+    revokeToken(ctx, c.store, key, time.Hour)
+    return Token{Key: key, UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil
+}
+
+func TestRevocationDuringLookupIsKept(t *testing.T) {
+    store := newMemoryTokenStore()
+    middleware := &Middleware{store: store, repo: &repoTest{}, client: revokingAuthClient{store}, now: time.Now}
+
+    serveMiddleware(middleware, "good")
+    if store.values[tokenCacheKey("good")] != revokedTokenMarker {
+        t.Errorf("Expected the revocation not to be overwritten by the lookup, got %q", store.values[tokenCacheKey("good")])
+    }
+    if recorder := serveMiddleware(middleware, "good"); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Expected %v after revocation; received %v", http.StatusUnauthorized, recorder.Code)
+    }
+}
+
+func TestRevokeToken(t *testing.T) {
+    client := &countingAuthClient{tokens: map[string]Token{
+        "good": {Key: "good", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+    }}
+    store := newMemoryTokenStore()
+    middleware := &Middleware{store: store, repo: &repoTest{}, client: client, negativeTTL: 30 * time.Second, now: time.Now}
+
+    recorder := serveMiddleware(middleware, "good")
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    handler := postRevokeTokenHandler(formatter, store, TokenConfig{RevocationSecret: "shh", RevokedTTL: Duration(time.Hour)})
+
+    recorder = httptest.NewRecorder()
+    request, _ := http.NewRequest("POST", "/tokens/revoke", strings.NewReader(`{"token":"good"}`))
+    handler(recorder, request)
+    if recorder.Code != http.StatusForbidden {
+        t.Errorf("Expected %v without the secret; received %v", http.StatusForbidden, recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request, _ = http.NewRequest("POST", "/tokens/revoke", strings.NewReader(`{"token":"good"}`))
+    request.Header.Set("X-Revocation-Secret", "shh")
+    handler(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+    }
+
+    recorder = serveMiddleware(middleware, "good")
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Expected %v after revocation; received %v", http.StatusUnauthorized, recorder.Code)
+    }
+    var body apiError
+    json.Unmarshal(recorder.Body.Bytes(), &body)
+    if body.Code != errCodeRevokedToken {
+        t.Errorf("Expected code %s, got %s", errCodeRevokedToken, body.Code)
+    }
+    if client.calls != 1 {
+        t.Errorf("Expected the revoked token to be rejected from the cache, got %d calls", client.calls)
+    }
+}
+
+type memoryRateLimitStore map[string]int64
+
+func (s memoryRateLimitStore) incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+    s[key]++
+    return s[key], nil
+}
+
+func (s memoryRateLimitStore) get(ctx context.Context, key string) (int64, error) {
+    return s[key], nil
+}
+
+func TestRateLimiter(t *testing.T) {
+    router := mux.NewRouter()
+    router.HandleFunc("/posts", func(w http.ResponseWriter, req *http.Request) {}).Methods("GET", "POST")
+    router.HandleFunc("/groups", func(w http.ResponseWriter, req *http.Request) {}).Methods("POST")
+
+    options := RateLimitOptions{
+        Reads:  RateLimit{Requests: 3, Window: time.Minute},
+        Writes: RateLimit{Requests: 2, Window: time.Minute},
+        Routes: map[string]RateLimit{"POST /posts": {Requests: 1, Window: time.Minute}},
+    }
+    limiter := NewRateLimiter(options, router, Dependencies{})
+    limiter.store = memoryRateLimitStore{}
+    now := time.Unix(1200, 0)
+    limiter.now = func() time.Time { return now }
+
+    send := func(method, path string, userID uint) *httptest.ResponseRecorder {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest(method, path, nil)
+        request.RemoteAddr = "10.0.0.1:1234"
+        if userID != 0 {
+            request = request.WithContext(withPrincipal(request.Context(), Principal{UserID: userID}))
+        }
+        limiter.ServeHTTP(recorder, request, router.ServeHTTP)
+        return recorder
+    }
+
+    for i := 0; i < 3; i++ {
+        recorder := send("GET", "/posts", 1)
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("Expected read %d to pass; received %v", i, recorder.Code)
+        }
+        if remaining := recorder.Header().Get("X-RateLimit-Remaining"); remaining != strconv.Itoa(2-i) {
+            t.Errorf("Expected %d remaining, got %s", 2-i, remaining)
+        }
+    }
+    recorder := send("GET", "/posts", 1)
+    if recorder.Code != http.StatusTooManyRequests {
+        t.Errorf("Expected %v; received %v", http.StatusTooManyRequests, recorder.Code)
+    }
+    if recorder.Header().Get("Retry-After") != "60" {
+        t.Errorf("Expected to retry after 60 seconds, got %q", recorder.Header().Get("Retry-After"))
+    }
+
+    if send("GET", "/posts", 2).Code != http.StatusOK {
+        t.Error("Another user should have their own limit")
+    }
+    if send("GET", "/posts", 0).Code != http.StatusOK {
+        t.Error("Anonymous callers should be limited by ip")
+    }
+
+    if send("POST", "/posts", 1).Code != http.StatusOK || send("POST", "/posts", 1).Code != http.StatusTooManyRequests {
+        t.Error("Expected the route override to allow a single post")
+    }
+    if send("POST", "/groups", 1).Code != http.StatusOK || send("POST", "/groups", 1).Code != http.StatusOK {
+        t.Error("Expected writes to have their own limit")
+    }
+    if send("POST", "/groups", 1).Code != http.StatusTooManyRequests {
+        t.Error("Expected the third write to be limited")
+    }
+
+    // half way through the next window half of the last one still counts
+    now = now.Add(90 * time.Second)
+    if send("GET", "/posts", 1).Code != http.StatusOK {
+        t.Error("Expected reads to be allowed again in the next window")
+    }
+    if send("GET", "/posts", 1).Code != http.StatusTooManyRequests {
+        t.Error("Expected the previous window to still count towards the limit")
+    }
+}
+
+func TestAuthFailureLimiter(t *testing.T) {
+    options := RateLimitOptions{AuthFailures: RateLimit{Requests: 2, Window: time.Minute}}
+    limiter := NewAuthFailureLimiter(options, Dependencies{})
+    store := memoryRateLimitStore{}
+    limiter.store = store
+    limiter.now = func() time.Time { return time.Unix(1200, 0) }
+
+    client := &countingAuthClient{}
+    n := negroni.New(limiter, NewMiddleware(&repoTest{}, newMemoryTokenStore(), DefaultConfig().Tokens, Dependencies{Auth: client}))
+    n.UseHandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+    send := func(token, ip string) int {
+        recorder := httptest.NewRecorder()
+        request, _ := http.NewRequest("GET", "/api/groups", nil)
+        request.RemoteAddr = ip + ":1234"
+        request.Header.Set("Authorization", "Bearer "+token)
+        n.ServeHTTP(recorder, request)
+        return recorder.Code
+    }
+
+    if send("guess-1", "10.0.0.1") != http.StatusUnauthorized || send("guess-2", "10.0.0.1") != http.StatusUnauthorized {
+        t.Fatal("Expected the first guesses to reach the auth middleware")
+    }
+    if code := send("guess-3", "10.0.0.1"); code != http.StatusTooManyRequests {
+        t.Errorf("Expected %v once the failures are used up; received %v", http.StatusTooManyRequests, code)
+    }
+    if client.calls != 2 {
+        t.Errorf("Expected the turned away guess not to be looked up, got %d calls", client.calls)
+    }
+    if send("guess-4", "10.0.0.2") != http.StatusUnauthorized {
+        t.Error("Another ip should have its own count")
+    }
+}
+
+func TestParseRateLimits(t *testing.T) {
+    limit, err := parseRateLimit("60/1m")
+    if err != nil || limit.Requests != 60 || limit.Window != time.Minute {
+        t.Errorf("Unexpected limit %+v (%v)", limit, err)
+    }
+    for _, bad := range []string{"60", "x/1m", "0/1m", "10/soon"} {
+        if _, err := parseRateLimit(bad); err == nil {
+            t.Errorf("Expected %q to be rejected", bad)
+        }
+    }
+
+    var routes RouteLimits
+    err = routes.UnmarshalText([]byte("POST  /api/posts=10/1m; GET /api/groups=100/1s"))
+    if err != nil || routes["POST /api/posts"] != "10/1m" || routes["GET /api/groups"] != "100/1s" {
+        t.Errorf("Unexpected routes %+v (%v)", routes, err)
+    }
+}
+
+//signJWT builds a token, key is an hmac secret or an rsa private key
+func signJWT(header, claims map[string]interface{}, key interface{}) string {
+    h, _ := json.Marshal(header)
+    c, _ := json.Marshal(claims)
+    signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+    var signature []byte
+    switch k := key.(type) {
+    case []byte:
+        mac := hmac.New(sha256.New, k)
+        mac.Write([]byte(signed))
+        signature = mac.Sum(nil)
+    case *rsa.PrivateKey:
+        digest := sha256.Sum256([]byte(signed))
+        signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+    }
+    return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTempFile(t *testing.T, name, contents string) string {
+    dir, err := ioutil.TempDir("", "jwt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(dir, name)
+    err = ioutil.WriteFile(path, []byte(contents), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestJWTClientHS256(t *testing.T) {
+    secret := []byte("secret")
+    path := writeTempFile(t, "secret", "secret\n")
+    defer os.RemoveAll(filepath.Dir(path))
+
+    client, err := newJWTClient(jwtHS256, path, "", "grouper-auth", "grouper-api")
+    if err != nil {
+        t.Fatalf("Failed to create client: %s", err)
+    }
+    now := time.Unix(1000000, 0)
+    client.now = func() time.Time { return now }
+
+    header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+    claims := func(changes map[string]interface{}) map[string]interface{} {
+        c := map[string]interface{}{
+            "sub":   "7",
+            "iss":   "grouper-auth",
+            "aud":   []string{"grouper-api"},
+            "exp":   now.Unix() + 60,
+            "nbf":   now.Unix(),
+            "scope": "groups:read posts:write",
+        }
+        for k, v := range changes {
+            c[k] = v
+        }
+        return c
+    }
+
+    token, err := client.getUserIDFromToken(context.Background(), signJWT(header, claims(nil), secret))
+    if err != nil {
+        t.Fatalf("Expected a valid token, got %s", err)
+    }
+    if token.UserID != 7 || token.ExpiresAt != now.Unix()+60 {
+        t.Errorf("Unexpected token %+v", token)
+    }
+    if strings.Join(token.Scopes, " ") != "groups:read posts:write" {
+        t.Errorf("Unexpected scopes %v", token.Scopes)
+    }
+
+    cases := map[string]struct {
+        token       string
+        expected    error
+    }{
+        "expired":      {signJWT(header, claims(map[string]interface{}{"exp": now.Unix()}), secret), errExpiredToken},
+        "no exp":       {signJWT(header, claims(map[string]interface{}{"exp": nil}), secret), errInvalidToken},
+        "not yet":      {signJWT(header, claims(map[string]interface{}{"nbf": now.Unix() + 600}), secret), errInvalidToken},
+        "issuer":       {signJWT(header, claims(map[string]interface{}{"iss": "someone"}), secret), errInvalidToken},
+        "audience":     {signJWT(header, claims(map[string]interface{}{"aud": "other"}), secret), errInvalidToken},
+        "subject":      {signJWT(header, claims(map[string]interface{}{"sub": "alice"}), secret), errInvalidToken},
+        "signature":    {signJWT(header, claims(nil), []byte("wrong")), errInvalidToken},
+        "algorithm":    {signJWT(map[string]interface{}{"alg": "none"}, claims(nil), secret), errInvalidToken},
+        "malformed":    {"abc.def", errInvalidToken},
+    }
+    for name, c := range cases {
+        _, err := client.getUserIDFromToken(context.Background(), c.token)
+        if err != c.expected {
+            t.Errorf("%s: expected %v, got %v", name, c.expected, err)
+        }
+    }
+}
+
+func TestJWTClientRS256JWKS(t *testing.T) {
+    private, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+    jwks, _ := json.Marshal(map[string]interface{}{
+        "keys": []map[string]string{{
+            "kty": "RSA",
+            "kid": "k1",
+            "alg": "RS256",
+            "use": "sig",
+            "n":   base64.RawURLEncoding.EncodeToString(private.N.Bytes()),
+            "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes()),
+        }},
+    })
+    path := writeTempFile(t, "jwks.json", string(jwks))
+    defer os.RemoveAll(filepath.Dir(path))
+
+    client, err := newJWTClient(jwtRS256, "", path, "", "")
+    if err != nil {
+        t.Fatalf("Failed to create client: %s", err)
+    }
+
+    claims := map[string]interface{}{"sub": "3", "exp": time.Now().Add(time.Hour).Unix()}
+    token, err := client.getUserIDFromToken(context.Background(), signJWT(map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, private))
+    if err != nil || token.UserID != 3 {
+        t.Errorf("Expected user 3, got %v (%v)", token.UserID, err)
+    }
+
+    _, err = client.getUserIDFromToken(context.Background(), signJWT(map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, other))
+    if err != errInvalidToken {
+        t.Errorf("Expected %v for a foreign key, got %v", errInvalidToken, err)
+    }
+    _, err = client.getUserIDFromToken(context.Background(), signJWT(map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims, private))
+    if err != errInvalidToken {
+        t.Errorf("Expected %v for an unknown kid, got %v", errInvalidToken, err)
+    }
+    _, err = client.getUserIDFromToken(context.Background(), signJWT(map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims, []byte("secret")))
+    if err != errInvalidToken {
+        t.Errorf("Expected %v for a mismatched algorithm, got %v", errInvalidToken, err)
+    }
+}
+
+func TestNewAuthClient(t *testing.T) {
+    client, err := newAuthClient(AuthConfig{Mode: AuthModeRemote, URL: "http://auth"}, Dependencies{})
+    if err != nil {
+        t.Errorf("Expected remote mode to work, got %s", err)
+    }
+    if _, ok := client.(authtWebClient); !ok {
+        t.Errorf("Expected a web client, got %T", client)
+    }
+
+    _, err = newAuthClient(AuthConfig{Mode: AuthModeJWT, JWT: JWTConfig{Algorithm: jwtHS256}}, Dependencies{})
+    if err == nil {
+        t.Error("Expected jwt mode without keys to fail")
+    }
+    _, err = newAuthClient(AuthConfig{Mode: "magic"}, Dependencies{})
+    if err == nil {
+        t.Error("Expected an unknown mode to fail")
+    }
+}
@@ -0,0 +1,417 @@
+package service
+
+import (
+    "context"
+    "database/sql"
+    "embed"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "regexp"
+    "sort"
+    "strconv"
+    "text/tabwriter"
+    "time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+//migrationLockID is the postgres advisory lock held while migrating, so
+//instances started together don't apply the same migration twice
+const migrationLockID = 0x67726f7570657200
+
+var (
+    //ErrMigrationAborted is returned when a rollback or a migration that
+    //deletes or changes rows wasn't confirmed
+    ErrMigrationAborted = errors.New("Migration aborted")
+
+    migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down|check)\.sql$`)
+)
+
+//Migration is a numbered change to the schema and the sql that undoes it.
+//Check is an optional query for the rows Up deletes or changes, it returns
+//a description and a count per kind of row
+type Migration struct {
+    Version     int
+    Name        string
+    Up          string
+    Down        string
+    Check       string
+}
+
+//MigrationStep is a migration applied or rolled back, Changes lists what
+//applying it does to existing rows
+type MigrationStep struct {
+    Migration
+    Rollback    bool
+    Changes     []string
+}
+
+//MigrationStatus tells if and when a migration was applied
+type MigrationStatus struct {
+    Migration
+    AppliedAt   *time.Time
+}
+
+//LoadMigrations reads migrations from files named like 0001_name.up.sql and
+//0001_name.down.sql, every version needs both and versions can't skip. A
+//0001_name.check.sql is optional
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+    names, err := fs.Glob(fsys, "*.sql")
+    if err != nil {
+        return nil, err
+    }
+
+    byVersion := make(map[int]*Migration)
+    for _, name := range names {
+        match := migrationFileName.FindStringSubmatch(name)
+        if match == nil {
+            return nil, fmt.Errorf("Migration %s should be named like 0001_name.up.sql", name)
+        }
+        version, _ := strconv.Atoi(match[1])
+        if version <= 0 {
+            return nil, fmt.Errorf("Migration %s needs a positive version", name)
+        }
+        content, err := fs.ReadFile(fsys, name)
+        if err != nil {
+            return nil, err
+        }
+
+        migration, ok := byVersion[version]
+        if !ok {
+            migration = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = migration
+        }
+        if migration.Name != match[2] {
+            return nil, fmt.Errorf("Migration %d is named both %s and %s", version, migration.Name, match[2])
+        }
+        switch match[3] {
+        case "up":
+            migration.Up = string(content)
+        case "down":
+            migration.Down = string(content)
+        case "check":
+            migration.Check = string(content)
+        }
+    }
+
+    migrations := make([]Migration, 0, len(byVersion))
+    for _, migration := range byVersion {
+        migrations = append(migrations, *migration)
+    }
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+    for i, migration := range migrations {
+        if migration.Version != i+1 {
+            return nil, fmt.Errorf("Migration %d is missing", i+1)
+        }
+        if migration.Up == "" || migration.Down == "" {
+            return nil, fmt.Errorf("Migration %d needs both an up and a down file", migration.Version)
+        }
+    }
+    return migrations, nil
+}
+
+//planMigrations lists the steps that take a database with the applied
+//versions to target, rollbacks come last to first
+func planMigrations(migrations []Migration, applied map[int]bool, target int) ([]MigrationStep, error) {
+    if target < 0 || target > len(migrations) {
+        return nil, fmt.Errorf("Version %d doesn't exist, the latest is %d", target, len(migrations))
+    }
+    for version := range applied {
+        if version > len(migrations) {
+            return nil, fmt.Errorf("The database has version %d applied, which this build doesn't know", version)
+        }
+    }
+
+    var steps []MigrationStep
+    for _, migration := range migrations {
+        if migration.Version <= target && !applied[migration.Version] {
+            steps = append(steps, MigrationStep{Migration: migration})
+        }
+    }
+    for i := len(migrations) - 1; i >= target; i-- {
+        if applied[migrations[i].Version] {
+            steps = append(steps, MigrationStep{Migration: migrations[i], Rollback: true})
+        }
+    }
+    return steps, nil
+}
+
+//Migrator applies the embedded migrations and records them in the
+//schema_migrations table
+type Migrator struct {
+    db          *sql.DB
+    migrations  []Migration
+    logger      *slog.Logger
+    //Confirm is asked before anything is rolled back and before a migration
+    //deletes or changes existing rows, both are refused when it is nil
+    Confirm     func(steps []MigrationStep) bool
+}
+
+//NewMigrator migrates db with the migrations built into the binary
+func NewMigrator(db *sql.DB, logger *slog.Logger) (*Migrator, error) {
+    files, err := fs.Sub(migrationFiles, "migrations")
+    if err != nil {
+        return nil, err
+    }
+    migrations, err := LoadMigrations(files)
+    if err != nil {
+        return nil, err
+    }
+    if logger == nil {
+        logger = slog.Default()
+    }
+    return &Migrator{db: db, migrations: migrations, logger: logger}, nil
+}
+
+//Latest is the version of the newest migration
+func (m *Migrator) Latest() int {
+    return len(m.migrations)
+}
+
+//Up applies every migration that hasn't been yet
+func (m *Migrator) Up(ctx context.Context) error {
+    return m.To(ctx, m.Latest())
+}
+
+//Down rolls back the newest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+    return m.migrate(ctx, func(applied map[int]bool) int {
+        target := 0
+        for version := range applied {
+            if version > target {
+                target = version
+            }
+        }
+        if target == 0 {
+            return 0
+        }
+        return target - 1
+    })
+}
+
+//To applies or rolls back migrations until the database is at version
+func (m *Migrator) To(ctx context.Context, version int) error {
+    return m.migrate(ctx, func(map[int]bool) int {
+        return version
+    })
+}
+
+//Status lists every migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+    applied, err := m.applied(ctx, m.db)
+    if err != nil {
+        return nil, err
+    }
+    statuses := make([]MigrationStatus, len(m.migrations))
+    for i, migration := range m.migrations {
+        statuses[i].Migration = migration
+        if at, ok := applied[migration.Version]; ok {
+            at := at
+            statuses[i].AppliedAt = &at
+        }
+    }
+    return statuses, nil
+}
+
+//Pending counts the migrations that haven't been applied
+func (m *Migrator) Pending(ctx context.Context) (int, error) {
+    statuses, err := m.Status(ctx)
+    if err != nil {
+        return 0, err
+    }
+    pending := 0
+    for _, status := range statuses {
+        if status.AppliedAt == nil {
+            pending++
+        }
+    }
+    return pending, nil
+}
+
+//queryer is what applied needs of a database or a single connection
+type queryer interface {
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//applied returns when each applied version was applied, a database that has
+//never been migrated has nothing applied
+func (m *Migrator) applied(ctx context.Context, db queryer) (map[int]time.Time, error) {
+    applied := make(map[int]time.Time)
+    var exists bool
+    err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+    if err != nil || !exists {
+        return applied, err
+    }
+
+    rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var version int
+        var at time.Time
+        if err := rows.Scan(&version, &at); err != nil {
+            return nil, err
+        }
+        applied[version] = at
+    }
+    return applied, rows.Err()
+}
+
+//migrate takes the lock, works out the target from what is applied and runs
+//the steps to it, each in its own transaction
+func (m *Migrator) migrate(ctx context.Context, target func(applied map[int]bool) int) error {
+    conn, err := m.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    var locked bool
+    err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockID).Scan(&locked)
+    if err != nil {
+        return err
+    }
+    if !locked {
+        m.logger.Info("Waiting for another instance to finish migrating")
+        _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+        if err != nil {
+            return err
+        }
+    }
+    defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+    _, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+        version integer PRIMARY KEY,
+        name text NOT NULL,
+        applied_at timestamp with time zone NOT NULL DEFAULT now()
+    )`)
+    if err != nil {
+        return err
+    }
+
+    appliedAt, err := m.applied(ctx, conn)
+    if err != nil {
+        return err
+    }
+    applied := make(map[int]bool, len(appliedAt))
+    for version := range appliedAt {
+        applied[version] = true
+    }
+    steps, err := planMigrations(m.migrations, applied, target(applied))
+    if err != nil {
+        return err
+    }
+    if len(steps) == 0 {
+        m.logger.Info("The schema is up to date")
+        return nil
+    }
+    // rollbacks come last, so checking the last step is enough
+    if steps[len(steps)-1].Rollback && (m.Confirm == nil || !m.Confirm(steps)) {
+        return ErrMigrationAborted
+    }
+
+    for _, step := range steps {
+        err = m.check(ctx, conn, &step)
+        if err != nil {
+            return fmt.Errorf("Migration %d_%s failed its check: %s", step.Version, step.Name, err)
+        }
+        if len(step.Changes) > 0 && (m.Confirm == nil || !m.Confirm([]MigrationStep{step})) {
+            return ErrMigrationAborted
+        }
+        err = m.run(ctx, conn, step)
+        if err != nil {
+            return fmt.Errorf("Migration %d_%s failed: %s", step.Version, step.Name, err)
+        }
+    }
+    return nil
+}
+
+//check runs the check of a migration about to be applied, right before it
+//so earlier steps are taken into account, and logs what it will change
+func (m *Migrator) check(ctx context.Context, conn *sql.Conn, step *MigrationStep) error {
+    if step.Rollback || step.Check == "" {
+        return nil
+    }
+    rows, err := conn.QueryContext(ctx, step.Check)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var description string
+        var count int64
+        if err := rows.Scan(&description, &count); err != nil {
+            return err
+        }
+        if count > 0 {
+            m.logger.Warn("Migration changes existing rows", "version", step.Version, "name", step.Name, "rows", count, "change", description)
+            step.Changes = append(step.Changes, fmt.Sprintf("%d %s", count, description))
+        }
+    }
+    return rows.Err()
+}
+
+//run applies or rolls back a single migration
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, step MigrationStep) error {
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if step.Rollback {
+        m.logger.Info("Rolling back migration", "version", step.Version, "name", step.Name)
+        _, err = tx.ExecContext(ctx, step.Down)
+        if err == nil {
+            _, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", step.Version)
+        }
+    } else {
+        m.logger.Info("Applying migration", "version", step.Version, "name", step.Name)
+        _, err = tx.ExecContext(ctx, step.Up)
+        if err == nil {
+            _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", step.Version, step.Name)
+        }
+    }
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+//PrintMigrationStatus writes the statuses as a table
+func PrintMigrationStatus(w io.Writer, statuses []MigrationStatus) error {
+    table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(table, "VERSION\tNAME\tAPPLIED")
+    for _, status := range statuses {
+        applied := "pending"
+        if status.AppliedAt != nil {
+            applied = status.AppliedAt.UTC().Format(time.RFC3339)
+        }
+        fmt.Fprintf(table, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+    }
+    return table.Flush()
+}
+
+//PrintMigrationSteps lists steps one per line with their changes below
+//them, for confirmations
+func PrintMigrationSteps(w io.Writer, steps []MigrationStep) {
+    for _, step := range steps {
+        action := "apply"
+        if step.Rollback {
+            action = "roll back"
+        }
+        fmt.Fprintf(w, "  %s %04d_%s\n", action, step.Version, step.Name)
+        for _, change := range step.Changes {
+            fmt.Fprintf(w, "    %s\n", change)
+        }
+    }
+}
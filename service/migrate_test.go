@@ -0,0 +1,214 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "io"
+    "io/fs"
+    "log/slog"
+    "os"
+    "strings"
+    "testing"
+    "testing/fstest"
+    "time"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+    files, err := fs.Sub(migrationFiles, "migrations")
+    if err != nil {
+        t.Fatal(err)
+    }
+    migrations, err := LoadMigrations(files)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(migrations) == 0 || migrations[0].Name != "initial_schema" {
+        t.Errorf("Expected the initial schema to be the first migration; received %v", migrations)
+    }
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+    file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+    tests := map[string]fstest.MapFS{
+        "missing down": {"0001_a.up.sql": file},
+        "gap":          {"0001_a.up.sql": file, "0001_a.down.sql": file, "0003_c.up.sql": file, "0003_c.down.sql": file},
+        "bad name":     {"0001-a.up.sql": file},
+        "zero version": {"0000_a.up.sql": file, "0000_a.down.sql": file},
+        "two names":    {"0001_a.up.sql": file, "0001_b.down.sql": file},
+    }
+    for name, files := range tests {
+        if _, err := LoadMigrations(files); err == nil {
+            t.Errorf("Expected %s to fail", name)
+        }
+    }
+
+    migrations, err := LoadMigrations(fstest.MapFS{
+        "0002_b.down.sql": file, "0001_a.up.sql": file, "0002_b.up.sql": file, "0001_a.down.sql": file,
+        "0002_b.check.sql": file,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(migrations) != 2 || migrations[0].Name != "a" || migrations[1].Version != 2 {
+        t.Errorf("Expected migrations sorted by version; received %v", migrations)
+    }
+    if len(migrations) == 2 && (migrations[0].Check != "" || migrations[1].Check == "") {
+        t.Errorf("Expected only the second migration to have a check; received %v", migrations)
+    }
+}
+
+func describePlan(steps []MigrationStep) string {
+    var parts []string
+    for _, step := range steps {
+        if step.Rollback {
+            parts = append(parts, "-"+step.Name)
+        } else {
+            parts = append(parts, "+"+step.Name)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+func TestPlanMigrations(t *testing.T) {
+    migrations := []Migration{{Version: 1, Name: "a"}, {Version: 2, Name: "b"}, {Version: 3, Name: "c"}}
+    tests := []struct {
+        applied     map[int]bool
+        target      int
+        expected    string
+    }{
+        {map[int]bool{}, 3, "+a +b +c"},
+        {map[int]bool{1: true}, 3, "+b +c"},
+        {map[int]bool{1: true, 2: true, 3: true}, 3, ""},
+        {map[int]bool{1: true, 2: true, 3: true}, 1, "-c -b"},
+        {map[int]bool{1: true, 2: true}, 0, "-b -a"},
+        {map[int]bool{1: true, 3: true}, 2, "+b -c"},
+    }
+    for _, test := range tests {
+        steps, err := planMigrations(migrations, test.applied, test.target)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if plan := describePlan(steps); plan != test.expected {
+            t.Errorf("Expected %v to %d to be %q; received %q", test.applied, test.target, test.expected, plan)
+        }
+    }
+
+    if _, err := planMigrations(migrations, map[int]bool{}, 4); err == nil {
+        t.Errorf("Expected an unknown target to fail")
+    }
+    if _, err := planMigrations(migrations, map[int]bool{4: true}, 3); err == nil {
+        t.Errorf("Expected an applied version newer than the build to fail")
+    }
+}
+
+func TestPrintMigrationStepsListsChanges(t *testing.T) {
+    var out bytes.Buffer
+    PrintMigrationSteps(&out, []MigrationStep{
+        {Migration: Migration{Version: 2, Name: "constraints"}, Changes: []string{"3 posts in groups that don't exist are removed"}},
+        {Migration: Migration{Version: 1, Name: "initial_schema"}, Rollback: true},
+    })
+
+    expected := "  apply 0002_constraints\n    3 posts in groups that don't exist are removed\n  roll back 0001_initial_schema\n"
+    if out.String() != expected {
+        t.Errorf("Expected %q; received %q", expected, out.String())
+    }
+}
+
+func TestPrintMigrationStatus(t *testing.T) {
+    applied := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+    var out bytes.Buffer
+    PrintMigrationStatus(&out, []MigrationStatus{
+        {Migration: Migration{Version: 1, Name: "initial_schema"}, AppliedAt: &applied},
+        {Migration: Migration{Version: 2, Name: "indexes"}},
+    })
+
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    if len(lines) != 3 || !strings.Contains(lines[1], "2017-01-02T03:04:05Z") || !strings.HasSuffix(lines[2], "pending") {
+        t.Errorf("Unexpected status table:\n%s", out.String())
+    }
+}
+
+//baselineSchema is what the -create flag built before the schema was
+//migrated, the shape databases from the first release are in
+const baselineSchema = `
+CREATE TABLE groups (id serial PRIMARY KEY, created_at timestamp with time zone, updated_at timestamp with time zone,
+    deleted_at timestamp with time zone, name text, private boolean);
+CREATE TABLE group_members (user_id integer, group_id integer);
+CREATE TABLE group_admins (user_id integer, group_id integer);
+CREATE TABLE posts (id serial PRIMARY KEY, created_at timestamp with time zone, updated_at timestamp with time zone,
+    deleted_at timestamp with time zone, group_id integer, user_id integer, content text, title text);
+CREATE TABLE comments (id serial PRIMARY KEY, created_at timestamp with time zone, updated_at timestamp with time zone,
+    deleted_at timestamp with time zone, post_id integer, content text, user_id integer);
+INSERT INTO groups (created_at, name, private) VALUES (now(), 'first', false);
+INSERT INTO group_members (user_id, group_id) VALUES (1, 1);
+INSERT INTO group_admins (user_id, group_id) VALUES (1, 1);
+INSERT INTO posts (created_at, group_id, user_id, content, title) VALUES (now(), 1, 1, 'hello', 'hello');
+INSERT INTO comments (created_at, post_id, content, user_id) VALUES (now(), 1, 'hi', 1);
+INSERT INTO posts (created_at, group_id, user_id, content, title) VALUES (now(), 0, 1, 'lost', 'lost');
+INSERT INTO comments (created_at, post_id, content, user_id) VALUES (now(), 1, repeat('a', 600), 1);
+`
+
+//TestMigrationsAdoptBaselineSchema needs a postgres database named by
+//TEST_DATABASE_URL, where it builds the baseline in a scratch schema
+func TestMigrationsAdoptBaselineSchema(t *testing.T) {
+    url := os.Getenv("TEST_DATABASE_URL")
+    if url == "" {
+        t.Skip("TEST_DATABASE_URL isn't set")
+    }
+    db, err := sql.Open("postgres", url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    // a single connection keeps the search path for every statement
+    db.SetMaxOpenConns(1)
+
+    ctx := context.Background()
+    _, err = db.ExecContext(ctx, "DROP SCHEMA IF EXISTS grouper_migration_test CASCADE; CREATE SCHEMA grouper_migration_test; SET search_path TO grouper_migration_test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.ExecContext(ctx, "DROP SCHEMA grouper_migration_test CASCADE")
+    if _, err = db.ExecContext(ctx, baselineSchema); err != nil {
+        t.Fatal(err)
+    }
+
+    migrator, err := NewMigrator(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the orphaned post and the long comment have to be confirmed
+    if err = migrator.Up(ctx); err != ErrMigrationAborted {
+        t.Fatalf("Expected the constraints to wait for confirmation; received %v", err)
+    }
+    var confirmed []MigrationStep
+    migrator.Confirm = func(steps []MigrationStep) bool {
+        confirmed = append(confirmed, steps...)
+        return true
+    }
+    if err = migrator.Up(ctx); err != nil {
+        t.Fatalf("Expected a baseline database to migrate; received %s", err)
+    }
+    if len(confirmed) != 1 || confirmed[0].Name != "constraints" || len(confirmed[0].Changes) != 2 {
+        t.Errorf("Expected the removed post and the cut comment to be confirmed; received %v", confirmed)
+    }
+
+    var parentID sql.NullInt64
+    var depth, botID int
+    var deleted bool
+    err = db.QueryRowContext(ctx, "SELECT parent_id, depth, deleted, bot_id FROM comments WHERE id = 1").Scan(&parentID, &depth, &deleted, &botID)
+    if err != nil || parentID.Valid || depth != 0 || deleted || botID != 0 {
+        t.Errorf("Expected the old comment to become a top level comment; received %v %d %v %d (%v)", parentID, depth, deleted, botID, err)
+    }
+    var posts, length int
+    err = db.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM posts), (SELECT length(content) FROM comments WHERE id = 2)").Scan(&posts, &length)
+    if err != nil || posts != 1 || length != 500 {
+        t.Errorf("Expected the orphaned post to be removed and the long comment cut; received %d %d (%v)", posts, length, err)
+    }
+    var ownerID int
+    err = db.QueryRowContext(ctx, "SELECT g.owner_id FROM groups g JOIN posts p ON p.group_id = g.id WHERE p.bot_id = 0").Scan(&ownerID)
+    if err != nil {
+        t.Errorf("Expected groups and posts to have their new columns; received %s", err)
+    }
+}
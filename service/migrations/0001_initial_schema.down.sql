@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS reactions;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS group_invites;
+DROP TABLE IF EXISTS group_admin_events;
+DROP TABLE IF EXISTS group_admins;
+DROP TABLE IF EXISTS group_join_requests;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS groups;
@@ -0,0 +1,130 @@
+-- The tables as gorm created them. Databases set up with the old -create
+-- flag already have the tables, IF NOT EXISTS skips those and the columns
+-- added since the first release are added at the end of this file
+CREATE TABLE IF NOT EXISTS groups (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    name text,
+    private boolean,
+    owner_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_groups_deleted_at ON groups (deleted_at);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    user_id integer,
+    group_id integer
+);
+
+CREATE TABLE IF NOT EXISTS group_join_requests (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    group_id integer,
+    user_id integer,
+    status text,
+    reason text,
+    reviewer_id integer,
+    reviewed_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS idx_group_join_requests_deleted_at ON group_join_requests (deleted_at);
+
+CREATE TABLE IF NOT EXISTS group_admins (
+    user_id integer,
+    group_id integer
+);
+
+CREATE TABLE IF NOT EXISTS group_admin_events (
+    id serial PRIMARY KEY,
+    group_id integer,
+    actor_id integer,
+    user_id integer,
+    action text,
+    created_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS group_invites (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    group_id integer,
+    code text,
+    inviter_id integer,
+    invitee_id integer,
+    expires_at timestamp with time zone,
+    max_uses integer,
+    uses integer,
+    revoked_at timestamp with time zone,
+    declined_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS idx_group_invites_deleted_at ON group_invites (deleted_at);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    name text,
+    prefix text,
+    key_hash text,
+    scopes text,
+    creator_id integer,
+    revoked_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS idx_api_keys_deleted_at ON api_keys (deleted_at);
+
+CREATE TABLE IF NOT EXISTS posts (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    group_id integer,
+    user_id integer,
+    bot_id integer,
+    content text,
+    title text
+);
+CREATE INDEX IF NOT EXISTS idx_posts_deleted_at ON posts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS comments (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    post_id integer,
+    parent_id integer,
+    depth integer,
+    content text,
+    user_id integer,
+    bot_id integer,
+    deleted boolean
+);
+CREATE INDEX IF NOT EXISTS idx_comments_deleted_at ON comments (deleted_at);
+
+CREATE TABLE IF NOT EXISTS reactions (
+    id serial PRIMARY KEY,
+    target_type text,
+    target_id integer,
+    user_id integer,
+    type text,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone
+);
+
+-- Tables created before groups had owners, bots could post and comments were
+-- threaded lack these columns, rows that predate them get the zero values
+-- the models would have written
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS owner_id integer;
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS bot_id integer;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_id integer;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS depth integer;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS deleted boolean;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS bot_id integer;
+UPDATE groups SET owner_id = 0 WHERE owner_id IS NULL;
+UPDATE posts SET bot_id = 0 WHERE bot_id IS NULL;
+UPDATE comments SET parent_id = coalesce(parent_id, 0), depth = coalesce(depth, 0),
+    deleted = coalesce(deleted, false), bot_id = coalesce(bot_id, 0)
+    WHERE parent_id IS NULL OR depth IS NULL OR deleted IS NULL OR bot_id IS NULL;
@@ -0,0 +1,49 @@
+-- Counts the rows 0002_constraints.up.sql removes or changes, so they can be
+-- confirmed before it runs
+SELECT 'group members without a group or user id are removed', count(*)
+    FROM group_members WHERE group_id IS NULL OR user_id IS NULL
+UNION ALL
+SELECT 'duplicate group members are removed', count(*) - count(DISTINCT (group_id, user_id))
+    FROM group_members WHERE group_id IS NOT NULL AND user_id IS NOT NULL
+UNION ALL
+SELECT 'group admins without a group or user id are removed', count(*)
+    FROM group_admins WHERE group_id IS NULL OR user_id IS NULL
+UNION ALL
+SELECT 'duplicate group admins are removed', count(*) - count(DISTINCT (group_id, user_id))
+    FROM group_admins WHERE group_id IS NOT NULL AND user_id IS NOT NULL
+UNION ALL
+SELECT 'group members of groups that don''t exist are removed', count(*)
+    FROM group_members m WHERE group_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = m.group_id)
+UNION ALL
+SELECT 'group admins of groups that don''t exist are removed', count(*)
+    FROM group_admins a WHERE group_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = a.group_id)
+UNION ALL
+SELECT 'admin events of groups that don''t exist are removed', count(*)
+    FROM group_admin_events e WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = e.group_id)
+UNION ALL
+SELECT 'join requests to groups that don''t exist are removed', count(*)
+    FROM group_join_requests r WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = r.group_id)
+UNION ALL
+SELECT 'invites to groups that don''t exist are removed', count(*)
+    FROM group_invites i WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = i.group_id)
+UNION ALL
+SELECT 'posts in groups that don''t exist are removed', count(*)
+    FROM posts p WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = p.group_id)
+UNION ALL
+SELECT 'comments on posts that don''t exist or are removed are removed', count(*)
+    FROM comments c WHERE NOT EXISTS (SELECT 1 FROM posts p JOIN groups g ON g.id = p.group_id WHERE p.id = c.post_id)
+UNION ALL
+SELECT 'replies to comments that don''t exist become top level comments', count(*)
+    FROM comments c WHERE parent_id <> 0 AND NOT EXISTS (SELECT 1 FROM comments p WHERE p.id = c.parent_id)
+UNION ALL
+SELECT 'older reactions of a user to the same target are removed', count(*) - count(DISTINCT (target_type, target_id, user_id))
+    FROM reactions
+UNION ALL
+SELECT 'groups without a name are named after their id', count(*)
+    FROM groups WHERE name IS NULL OR btrim(name) = ''
+UNION ALL
+SELECT 'posts longer than 500 characters are cut', count(*)
+    FROM posts WHERE length(content) > 500
+UNION ALL
+SELECT 'comments longer than 500 characters are cut', count(*)
+    FROM comments WHERE length(content) > 500
@@ -0,0 +1,39 @@
+ALTER TABLE group_invites DROP CONSTRAINT group_invites_uses_check;
+ALTER TABLE comments DROP CONSTRAINT comments_depth_check;
+ALTER TABLE group_join_requests DROP CONSTRAINT group_join_requests_status_check;
+
+ALTER TABLE comments ALTER COLUMN content TYPE text;
+ALTER TABLE posts ALTER COLUMN content TYPE text;
+ALTER TABLE groups DROP CONSTRAINT groups_name_check;
+ALTER TABLE groups ALTER COLUMN name DROP NOT NULL;
+
+DROP INDEX reactions_target_user_idx;
+DROP INDEX api_keys_key_hash_idx;
+DROP INDEX group_join_requests_pending_idx;
+DROP INDEX group_join_requests_group_id_status_idx;
+DROP INDEX group_invites_code_idx;
+DROP INDEX group_invites_invitee_id_idx;
+DROP INDEX group_invites_group_id_created_at_idx;
+DROP INDEX group_admin_events_group_id_created_at_idx;
+DROP INDEX comments_parent_id_idx;
+DROP INDEX comments_post_id_created_at_idx;
+DROP INDEX posts_group_id_created_at_idx;
+
+ALTER TABLE comments DROP CONSTRAINT comments_parent_id_fkey;
+ALTER TABLE comments DROP CONSTRAINT comments_post_id_fkey;
+ALTER TABLE posts DROP CONSTRAINT posts_group_id_fkey;
+ALTER TABLE group_invites DROP CONSTRAINT group_invites_group_id_fkey;
+ALTER TABLE group_join_requests DROP CONSTRAINT group_join_requests_group_id_fkey;
+ALTER TABLE group_admin_events DROP CONSTRAINT group_admin_events_group_id_fkey;
+ALTER TABLE group_admins DROP CONSTRAINT group_admins_group_id_fkey;
+ALTER TABLE group_members DROP CONSTRAINT group_members_group_id_fkey;
+
+UPDATE comments SET parent_id = 0 WHERE parent_id IS NULL;
+ALTER TABLE comments ALTER COLUMN post_id DROP NOT NULL;
+ALTER TABLE posts ALTER COLUMN group_id DROP NOT NULL;
+
+DROP INDEX group_members_user_id_idx;
+ALTER TABLE group_admins DROP CONSTRAINT group_admins_pkey;
+ALTER TABLE group_members DROP CONSTRAINT group_members_pkey;
+ALTER TABLE group_admins ALTER COLUMN group_id DROP NOT NULL, ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE group_members ALTER COLUMN group_id DROP NOT NULL, ALTER COLUMN user_id DROP NOT NULL;
@@ -0,0 +1,88 @@
+-- Rows removed or changed here are counted by 0002_constraints.check.sql and
+-- have to be confirmed before this runs
+
+-- Membership rows get a primary key, so duplicates and rows missing an id
+-- are removed first
+DELETE FROM group_members WHERE group_id IS NULL OR user_id IS NULL;
+DELETE FROM group_members a USING group_members b
+    WHERE a.ctid < b.ctid AND a.group_id = b.group_id AND a.user_id = b.user_id;
+ALTER TABLE group_members ADD PRIMARY KEY (group_id, user_id);
+CREATE INDEX group_members_user_id_idx ON group_members (user_id);
+
+DELETE FROM group_admins WHERE group_id IS NULL OR user_id IS NULL;
+DELETE FROM group_admins a USING group_admins b
+    WHERE a.ctid < b.ctid AND a.group_id = b.group_id AND a.user_id = b.user_id;
+ALTER TABLE group_admins ADD PRIMARY KEY (group_id, user_id);
+
+-- Rows pointing at groups or posts that don't exist were accepted before,
+-- like posts with group_id 0. There is nothing to reparent them to, so they
+-- are removed before the foreign keys are added. Comments go after posts so
+-- the comments of removed posts go with them
+DELETE FROM group_members m WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = m.group_id);
+DELETE FROM group_admins a WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = a.group_id);
+DELETE FROM group_admin_events e WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = e.group_id);
+DELETE FROM group_join_requests r WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = r.group_id);
+DELETE FROM group_invites i WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = i.group_id);
+DELETE FROM posts p WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = p.group_id);
+DELETE FROM comments c WHERE NOT EXISTS (SELECT 1 FROM posts p WHERE p.id = c.post_id);
+ALTER TABLE posts ALTER COLUMN group_id SET NOT NULL;
+ALTER TABLE comments ALTER COLUMN post_id SET NOT NULL;
+
+-- Top level comments had parent_id 0, they get NULL so replies can reference
+-- their parent. Replies whose parent is gone become top level
+UPDATE comments SET parent_id = NULL WHERE parent_id = 0;
+UPDATE comments c SET parent_id = NULL
+    WHERE parent_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM comments p WHERE p.id = c.parent_id);
+
+-- Groups, posts and comments are soft deleted, cascading only applies when
+-- rows are removed for good
+ALTER TABLE group_members ADD CONSTRAINT group_members_group_id_fkey
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE;
+ALTER TABLE group_admins ADD CONSTRAINT group_admins_group_id_fkey
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE;
+ALTER TABLE group_admin_events ADD CONSTRAINT group_admin_events_group_id_fkey
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE;
+ALTER TABLE group_join_requests ADD CONSTRAINT group_join_requests_group_id_fkey
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE;
+ALTER TABLE group_invites ADD CONSTRAINT group_invites_group_id_fkey
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE;
+ALTER TABLE posts ADD CONSTRAINT posts_group_id_fkey
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE;
+ALTER TABLE comments ADD CONSTRAINT comments_post_id_fkey
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE;
+ALTER TABLE comments ADD CONSTRAINT comments_parent_id_fkey
+    FOREIGN KEY (parent_id) REFERENCES comments (id) ON DELETE CASCADE;
+
+-- Feeds and threads are paged by created_at, id within their parent
+CREATE INDEX posts_group_id_created_at_idx ON posts (group_id, created_at, id);
+CREATE INDEX comments_post_id_created_at_idx ON comments (post_id, created_at, id);
+CREATE INDEX comments_parent_id_idx ON comments (parent_id) WHERE parent_id IS NOT NULL;
+CREATE INDEX group_admin_events_group_id_created_at_idx ON group_admin_events (group_id, created_at, id);
+CREATE INDEX group_invites_group_id_created_at_idx ON group_invites (group_id, created_at, id);
+CREATE INDEX group_invites_invitee_id_idx ON group_invites (invitee_id) WHERE invitee_id <> 0;
+CREATE UNIQUE INDEX group_invites_code_idx ON group_invites (code);
+CREATE INDEX group_join_requests_group_id_status_idx ON group_join_requests (group_id, status, created_at, id);
+CREATE UNIQUE INDEX group_join_requests_pending_idx ON group_join_requests (group_id, user_id)
+    WHERE status = 'pending' AND deleted_at IS NULL;
+CREATE UNIQUE INDEX api_keys_key_hash_idx ON api_keys (key_hash);
+
+-- A user has one reaction per target, the newest is kept
+DELETE FROM reactions a USING reactions b
+    WHERE a.id < b.id AND a.target_type = b.target_type AND a.target_id = b.target_id AND a.user_id = b.user_id;
+CREATE UNIQUE INDEX reactions_target_user_idx ON reactions (target_type, target_id, user_id);
+
+-- Groups need a name, unnamed ones are named after their id
+UPDATE groups SET name = 'Group ' || id WHERE name IS NULL OR btrim(name) = '';
+ALTER TABLE groups ALTER COLUMN name SET NOT NULL;
+ALTER TABLE groups ADD CONSTRAINT groups_name_check CHECK (btrim(name) <> '');
+
+-- Content is limited to 500 characters, longer content is cut
+UPDATE posts SET content = left(content, 500) WHERE length(content) > 500;
+UPDATE comments SET content = left(content, 500) WHERE length(content) > 500;
+ALTER TABLE posts ALTER COLUMN content TYPE varchar(500);
+ALTER TABLE comments ALTER COLUMN content TYPE varchar(500);
+
+ALTER TABLE group_join_requests ADD CONSTRAINT group_join_requests_status_check
+    CHECK (status IN ('pending', 'approved', 'rejected'));
+ALTER TABLE comments ADD CONSTRAINT comments_depth_check CHECK (depth >= 0);
+ALTER TABLE group_invites ADD CONSTRAINT group_invites_uses_check CHECK (uses >= 0 AND max_uses >= 0);
@@ -0,0 +1,3 @@
+-- Api keys are granted the groups they may use, space separated like scopes.
+-- Existing keys get no groups, only keys with the admin scope keep access
+ALTER TABLE api_keys ADD COLUMN group_ids text NOT NULL DEFAULT '';
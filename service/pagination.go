@@ -0,0 +1,127 @@
+package service
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+const (
+    defaultPageLimit = 20
+    maxPageLimit     = 100
+)
+
+//pageRequest asks for the page of rows following After in (created_at, id)
+//order, repositories return up to Limit+1 rows so the caller can tell
+//whether another page follows
+type pageRequest struct {
+    Limit       int
+    After       *pageCursor
+}
+
+//pageCursor is the position of the last row of a page
+type pageCursor struct {
+    CreatedAt   time.Time   `json:"created_at"`
+    ID          uint        `json:"id"`
+}
+
+//pageRow is a row of a list endpoint, position is where the row sits in
+//the order the endpoint pages through. Rows without created_at or id, like
+//memberships, are paged by user id alone
+type pageRow interface {
+    position() pageCursor
+}
+
+func (g Group) position() pageCursor            { return pageCursor{g.CreatedAt, g.ID} }
+func (p Post) position() pageCursor             { return pageCursor{p.CreatedAt, p.ID} }
+func (c Comment) position() pageCursor          { return pageCursor{c.CreatedAt, c.ID} }
+func (m GroupMember) position() pageCursor      { return pageCursor{ID: m.UserID} }
+func (a GroupAdmin) position() pageCursor       { return pageCursor{ID: a.UserID} }
+func (e GroupAdminEvent) position() pageCursor  { return pageCursor{e.CreatedAt, e.ID} }
+func (i GroupInvite) position() pageCursor      { return pageCursor{i.CreatedAt, i.ID} }
+func (r GroupJoinRequest) position() pageCursor { return pageCursor{r.CreatedAt, r.ID} }
+func (k APIKey) position() pageCursor           { return pageCursor{k.CreatedAt, k.ID} }
+
+//pageResponse wraps a page of results for list endpoints
+type pageResponse struct {
+    Items       interface{}     `json:"items"`
+    NextCursor  string          `json:"next_cursor,omitempty"`
+}
+
+//pageOf drops the extra row repositories fetch to tell if another page
+//follows and wraps rows up with the cursor of that page
+func pageOf[T pageRow](rows []T, page pageRequest) pageResponse {
+    if rows == nil {
+        rows = []T{}
+    }
+    next := ""
+    if len(rows) > page.Limit {
+        rows = rows[:page.Limit]
+        last := rows[len(rows)-1].position()
+        next = encodeCursor(last.CreatedAt, last.ID)
+    }
+    return pageResponse{Items: rows, NextCursor: next}
+}
+
+//encodeCursor turns a row position into an opaque cursor for clients
+func encodeCursor(createdAt time.Time, id uint) string {
+    payload, _ := json.Marshal(pageCursor{CreatedAt: createdAt, ID: id})
+    return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+//decodeCursor reads back a cursor handed out by encodeCursor
+func decodeCursor(cursor string) (*pageCursor, error) {
+    payload, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return nil, err
+    }
+
+    var c pageCursor
+    err = json.Unmarshal(payload, &c)
+    if err != nil {
+        return nil, err
+    }
+    return &c, nil
+}
+
+//after reports if a row comes after the cursor in (created_at, id) order
+func (c *pageCursor) after(createdAt time.Time, id uint) bool {
+    if c == nil {
+        return true
+    }
+    if createdAt.Equal(c.CreatedAt) {
+        return id > c.ID
+    }
+    return createdAt.After(c.CreatedAt)
+}
+
+//limitParam reads the page size from the query string, it is capped at
+//maxPageLimit and bad values fall back to the default
+func limitParam(query url.Values) int {
+    limit, err := strconv.Atoi(query.Get("limit"))
+    if err != nil || limit <= 0 {
+        limit = defaultPageLimit
+    }
+    if limit > maxPageLimit {
+        limit = maxPageLimit
+    }
+    return limit
+}
+
+//cursorParams reads limit and cursor from the query string
+func cursorParams(req *http.Request) (pageRequest, error) {
+    query := req.URL.Query()
+    page := pageRequest{Limit: limitParam(query)}
+
+    if cursor := query.Get("cursor"); cursor != "" {
+        after, err := decodeCursor(cursor)
+        if err != nil {
+            return page, err
+        }
+        page.After = after
+    }
+    return page, nil
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+//errNoPrincipal is returned when a request didn't pass through the middleware
+var errNoPrincipal = errors.New("No authenticated user on request")
+
+const (
+    scopeGroupsRead  = "groups:read"
+    scopeGroupsWrite = "groups:write"
+    scopePostsRead   = "posts:read"
+    scopePostsWrite  = "posts:write"
+    scopeAdmin       = "admin"
+)
+
+//Scopes are the scopes tokens and api keys can be limited to, admin grants
+//all of them
+var Scopes = []string{scopeGroupsRead, scopeGroupsWrite, scopePostsRead, scopePostsWrite, scopeAdmin}
+
+//Principal is the authenticated caller of a request, either a user or a bot
+//using an api key. GroupIDs are the groups a bot was granted
+type Principal struct {
+    UserID      uint        `json:"user_id"`
+    BotID       uint        `json:"bot_id,omitempty"`
+    Name        string      `json:"name,omitempty"`
+    ExpiresAt   time.Time   `json:"expires_at"`
+    Scopes      []string    `json:"scopes"`
+    GroupIDs    []uint      `json:"group_ids,omitempty"`
+}
+
+//isBot reports if the caller authenticated with an api key
+func (p Principal) isBot() bool {
+    return p.BotID != 0
+}
+
+//grantedGroup reports if a bot may act in a group, which needs the group
+//granted to its key or the admin scope
+func (p Principal) grantedGroup(groupID uint) bool {
+    if p.hasScope(scopeAdmin) {
+        return true
+    }
+    for _, id := range p.GroupIDs {
+        if id == groupID {
+            return true
+        }
+    }
+    return false
+}
+
+//hasScope reports if the caller may use routes needing scope, user tokens
+//issued without scopes may do anything but admin
+func (p Principal) hasScope(scope string) bool {
+    if !p.isBot() && len(p.Scopes) == 0 {
+        return scope != scopeAdmin
+    }
+    for _, s := range p.Scopes {
+        if s == scope || s == scopeAdmin {
+            return true
+        }
+    }
+    return false
+}
+
+func validScope(scope string) bool {
+    for _, s := range Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+type principalKey struct{}
+
+//withPrincipal returns a copy of ctx carrying the principal
+func withPrincipal(ctx context.Context, principal Principal) context.Context {
+    if info := requestInfoFromContext(ctx); info != nil {
+        info.setCaller(principal)
+    }
+    return context.WithValue(ctx, principalKey{}, principal)
+}
+
+//principalFromRequest returns the principal the middleware attached
+func principalFromRequest(req *http.Request) (Principal, bool) {
+    principal, ok := req.Context().Value(principalKey{}).(Principal)
+    return principal, ok
+}
+
+//callerFromRequest returns the user or bot making the request
+func callerFromRequest(req *http.Request) (Principal, error) {
+    principal, ok := principalFromRequest(req)
+    if !ok || (principal.UserID == 0 && !principal.isBot()) {
+        return principal, errNoPrincipal
+    }
+    return principal, nil
+}
+
+//userIDFromRequest returns the id of the calling user, bots have none
+func userIDFromRequest(req *http.Request) (uint, error) {
+    principal, ok := principalFromRequest(req)
+    if !ok || principal.UserID == 0 {
+        return 0, errNoPrincipal
+    }
+    return principal.UserID, nil
+}
+
+//scoped only lets callers with scope through to next
+func scoped(scope string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        caller, err := callerFromRequest(req)
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeError(w, http.StatusUnauthorized, errCodeMissingToken, "Failed to find token")
+            return
+        }
+        if !caller.hasScope(scope) {
+            w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+            writeError(w, http.StatusForbidden, errCodeInsufficientScope, fmt.Sprintf("Missing the %s scope", scope))
+            return
+        }
+        next(w, req)
+    }
+}
+
+//userScoped is scoped for routes that act on behalf of a user, which bots
+//can't use
+func userScoped(scope string, next http.HandlerFunc) http.HandlerFunc {
+    return scoped(scope, func(w http.ResponseWriter, req *http.Request) {
+        caller, _ := callerFromRequest(req)
+        if caller.isBot() {
+            writeError(w, http.StatusForbidden, errCodeUserRequired, "API keys can't use this endpoint")
+            return
+        }
+        next(w, req)
+    })
+}
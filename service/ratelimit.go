@@ -0,0 +1,289 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/urfave/negroni"
+    "go.opentelemetry.io/otel/trace"
+    "gopkg.in/redis.v4"
+)
+
+//RateLimit allows Requests per Window
+type RateLimit struct {
+    Requests    int
+    Window      time.Duration
+}
+
+//RateLimitOptions sets the limits for reads and writes, Routes overrides them
+//for single routes keyed like "POST /api/posts". AuthFailures limits the
+//requests an ip can make that fail authentication
+type RateLimitOptions struct {
+    Reads           RateLimit
+    Writes          RateLimit
+    Routes          map[string]RateLimit
+    AuthFailures    RateLimit
+    //TrustProxy reads the client ip from X-Forwarded-For, only turn it on
+    //behind a proxy that sets the header
+    TrustProxy      bool
+}
+
+//parseRateLimit reads a limit written like 60/1m
+func parseRateLimit(value string) (RateLimit, error) {
+    parts := strings.SplitN(value, "/", 2)
+    if len(parts) != 2 {
+        return RateLimit{}, fmt.Errorf("%q should look like 60/1m", value)
+    }
+    requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+    if err != nil || requests <= 0 {
+        return RateLimit{}, fmt.Errorf("%q needs a positive number of requests", value)
+    }
+    window, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+    if err != nil || window <= 0 {
+        return RateLimit{}, fmt.Errorf("%q needs a positive window", value)
+    }
+    return RateLimit{Requests: requests, Window: window}, nil
+}
+
+//rateLimitStore keeps the request counters
+type rateLimitStore interface {
+    incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+    get(ctx context.Context, key string) (int64, error)
+}
+
+type redisRateLimitStore struct {
+    client      *redis.Client
+    metrics     *Metrics
+    tracer      trace.Tracer
+}
+
+//incrScript increments a counter and sets its expiry in one step, so a
+//counter is never left without one when the connection drops in between
+var incrScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if redis.call("PTTL", KEYS[1]) < 0 then
+    redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (s redisRateLimitStore) incr(ctx context.Context, key string, ttl time.Duration) (count int64, err error) {
+    err = redisCall(ctx, s.tracer, s.metrics, "incr", func() error {
+        result, err := incrScript.Run(s.client, []string{key}, int64(ttl/time.Millisecond)).Result()
+        if err != nil {
+            return err
+        }
+        var ok bool
+        if count, ok = result.(int64); !ok {
+            return fmt.Errorf("Unexpected counter %v", result)
+        }
+        return nil
+    })
+    return count, err
+}
+
+func (s redisRateLimitStore) get(ctx context.Context, key string) (int64, error) {
+    var value string
+    err := redisCall(ctx, s.tracer, s.metrics, "get", func() (err error) {
+        value, err = s.client.Get(key).Result()
+        return err
+    })
+    if err == redis.Nil {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseInt(value, 10, 64)
+}
+
+//RateLimiter is a sliding window rate limiter, the count of the previous
+//window is weighted by how much of it still overlaps the sliding window.
+//Authenticated callers are limited by user or bot, everyone else by ip
+type RateLimiter struct {
+    options     RateLimitOptions
+    router      *mux.Router
+    store       rateLimitStore
+    now         func() time.Time
+    logger      *slog.Logger
+}
+
+//NewRateLimiter limits requests to router, which is used to find the route
+//a request is for, the counters are kept in the cache of deps
+func NewRateLimiter(options RateLimitOptions, router *mux.Router, deps Dependencies) *RateLimiter {
+    deps = deps.withDefaults()
+    store := redisRateLimitStore{client: deps.Cache, metrics: deps.Metrics, tracer: deps.Tracer}
+    return &RateLimiter{options: options, router: router, store: store, now: deps.Clock, logger: deps.Logger}
+}
+
+//limitFor picks the limit and the name of the counter for a request
+func (l *RateLimiter) limitFor(req *http.Request) (string, RateLimit) {
+    var match mux.RouteMatch
+    if l.router != nil && l.router.Match(req, &match) && match.Route != nil {
+        if template, err := match.Route.GetPathTemplate(); err == nil {
+            route := req.Method + " " + template
+            if limit, ok := l.options.Routes[route]; ok {
+                return route, limit
+            }
+        }
+    }
+
+    switch req.Method {
+    case "GET", "HEAD", "OPTIONS":
+        return "read", l.options.Reads
+    }
+    return "write", l.options.Writes
+}
+
+//clientKey names who the request is counted against
+func (l *RateLimiter) clientKey(req *http.Request) string {
+    if principal, ok := principalFromRequest(req); ok {
+        if principal.isBot() {
+            return fmt.Sprintf("bot:%d", principal.BotID)
+        }
+        if principal.UserID != 0 {
+            return fmt.Sprintf("user:%d", principal.UserID)
+        }
+    }
+    return "ip:" + clientIP(req, l.options.TrustProxy)
+}
+
+//clientIP returns the address of the caller
+func clientIP(req *http.Request, trustProxy bool) string {
+    if trustProxy {
+        if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+            return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+        }
+    }
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+    return host
+}
+
+//allow counts the request and returns how many are left in the window and
+//when the current window ends
+func (l *RateLimiter) allow(ctx context.Context, name, client string, limit RateLimit) (bool, int64, time.Time, error) {
+    estimate, reset, err := l.count(ctx, name, client, limit, true)
+    if err != nil {
+        return false, 0, reset, err
+    }
+    remaining := int64(limit.Requests) - estimate
+    if remaining < 0 {
+        remaining = 0
+    }
+    return estimate <= int64(limit.Requests), remaining, reset, nil
+}
+
+//count estimates the requests in the sliding window ending now, add counts
+//one more first. It returns when the current window ends
+func (l *RateLimiter) count(ctx context.Context, name, client string, limit RateLimit, add bool) (int64, time.Time, error) {
+    if limit.Requests <= 0 || limit.Window <= 0 {
+        return 0, time.Time{}, errors.New("Rate limit is not configured")
+    }
+
+    now := l.now()
+    start := now.Truncate(limit.Window)
+    reset := start.Add(limit.Window)
+    key := fmt.Sprintf("ratelimit:%s:%s:%d", name, client, start.Unix())
+    previousKey := fmt.Sprintf("ratelimit:%s:%s:%d", name, client, start.Add(-limit.Window).Unix())
+
+    var count int64
+    var err error
+    if add {
+        count, err = l.store.incr(ctx, key, 2*limit.Window)
+    } else {
+        count, err = l.store.get(ctx, key)
+    }
+    if err != nil {
+        return 0, reset, err
+    }
+    previous, err := l.store.get(ctx, previousKey)
+    if err != nil {
+        return 0, reset, err
+    }
+
+    overlap := float64(reset.Sub(now)) / float64(limit.Window)
+    return int64(float64(previous)*overlap) + count, reset, nil
+}
+
+//rejectOverLimit answers 429 with when to retry
+func (l *RateLimiter) rejectOverLimit(w http.ResponseWriter, reset time.Time, message string) {
+    retry := int64(reset.Sub(l.now()) / time.Second)
+    if retry < 1 {
+        retry = 1
+    }
+    w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+    writeError(w, http.StatusTooManyRequests, errCodeRateLimited, message)
+}
+
+// The rate limiting handler, it has to come after the auth middleware to
+// limit by user
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+    name, limit := l.limitFor(req)
+    allowed, remaining, reset, err := l.allow(req.Context(), name, l.clientKey(req), limit)
+    if err != nil {
+        // fail open, an outage of redis shouldn't take the api down with it
+        loggerFor(req.Context(), l.logger).Error("Failed to check rate limit", "error", err)
+        next(w, req)
+        return
+    }
+
+    w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+    w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+    w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+    if !allowed {
+        l.rejectOverLimit(w, reset, "Too many requests")
+        return
+    }
+    next(w, req)
+}
+
+//AuthFailureLimiter turns an ip away once too many of its requests failed
+//authentication. It comes before the auth middleware, so guessed tokens and
+//api keys stop costing a lookup each
+type AuthFailureLimiter struct {
+    *RateLimiter
+}
+
+//NewAuthFailureLimiter limits failed authentications by ip, the counters are
+//kept in the cache of deps
+func NewAuthFailureLimiter(options RateLimitOptions, deps Dependencies) *AuthFailureLimiter {
+    return &AuthFailureLimiter{NewRateLimiter(options, nil, deps)}
+}
+
+// The auth failure handler, it checks the count without adding to it and
+// counts the request once the auth middleware turned it away with a 401
+func (l *AuthFailureLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+    limit := l.options.AuthFailures
+    if limit.Requests <= 0 {
+        next(w, req)
+        return
+    }
+
+    client := "ip:" + clientIP(req, l.options.TrustProxy)
+    failures, reset, err := l.count(req.Context(), "auth_failures", client, limit, false)
+    if err != nil {
+        // fail open like the rate limiter
+        loggerFor(req.Context(), l.logger).Error("Failed to check auth failures", "error", err)
+    } else if failures >= int64(limit.Requests) {
+        l.rejectOverLimit(w, reset, "Too many failed authentications")
+        return
+    }
+
+    next(w, req)
+    if rw, ok := w.(negroni.ResponseWriter); ok && rw.Status() == http.StatusUnauthorized {
+        if _, _, err := l.count(req.Context(), "auth_failures", client, limit, true); err != nil {
+            loggerFor(req.Context(), l.logger).Error("Failed to count auth failure", "error", err)
+        }
+    }
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/unrolled/render"
+)
+
+const (
+    reactionTargetPost    = "post"
+    reactionTargetComment = "comment"
+
+    //reactionCountsTTL bounds how long cached counters can lag the database
+    //when two writes race to refresh them
+    reactionCountsTTL = 24 * time.Hour
+)
+
+//reactionSummary is embedded in post and comment responses
+type reactionSummary struct {
+    Counts      map[string]int64    `json:"counts"`
+    Reacted     bool                `json:"reacted"`
+    Mine        string              `json:"mine,omitempty"`
+}
+
+type postResponse struct {
+    Post
+    Reactions   reactionSummary     `json:"reactions"`
+}
+
+type commentResponse struct {
+    Comment
+    Reactions   reactionSummary     `json:"reactions"`
+}
+
+//validReactionType reports if users may leave reactions of reactionType
+func (rules contentRules) validReactionType(reactionType string) bool {
+    for _, t := range rules.reactionTypes {
+        if t == reactionType {
+            return true
+        }
+    }
+    return false
+}
+
+func reactionKey(targetType string, targetID uint) string {
+    return fmt.Sprintf("reactions:%s:%d", targetType, targetID)
+}
+
+//reactionCounts reads the counters for a target from redis, loading them
+//from the database first if they aren't cached
+func reactionCounts(repo repository, rules contentRules, targetType string, targetID uint) (map[string]int64, error) {
+    key := reactionKey(targetType, targetID)
+    cached, err := repo.redisHashGetAll(key)
+    if err != nil {
+        return nil, err
+    }
+
+    counts := make(map[string]int64)
+    if len(cached) > 0 {
+        for reactionType, value := range cached {
+            count, _ := strconv.ParseInt(value, 10, 64)
+            if count > 0 {
+                counts[reactionType] = count
+            }
+        }
+        return counts, nil
+    }
+
+    return refreshReactionCounts(repo, rules, targetType, targetID)
+}
+
+//refreshReactionCounts recounts a target in the database and caches the
+//result. Every type is written, zeros included, so a type nobody uses any
+//more doesn't keep its old count
+func refreshReactionCounts(repo repository, rules contentRules, targetType string, targetID uint) (map[string]int64, error) {
+    counts, err := repo.countReactions(targetType, targetID)
+    if err != nil {
+        return nil, err
+    }
+
+    fields := make(map[string]int64, len(rules.reactionTypes))
+    for _, reactionType := range rules.reactionTypes {
+        fields[reactionType] = counts[reactionType]
+    }
+    err = repo.redisHashSet(reactionKey(targetType, targetID), fields, reactionCountsTTL)
+    return counts, err
+}
+
+//summarizeReactions builds the counts and the callers own reaction
+func summarizeReactions(repo repository, rules contentRules, targetType string, targetID, userID uint) (reactionSummary, error) {
+    counts, err := reactionCounts(repo, rules, targetType, targetID)
+    if err != nil {
+        return reactionSummary{}, err
+    }
+
+    mine, err := repo.getUserReaction(targetType, targetID, userID)
+    if err != nil {
+        return reactionSummary{}, err
+    }
+    return reactionSummary{Counts: counts, Reacted: mine != "", Mine: mine}, nil
+}
+
+//reactionTarget resolves the post or comment named in the route to its id
+//and the group it belongs to
+func reactionTarget(repo repository, targetType, id string) (uint, uint, error) {
+    if targetType == reactionTargetComment {
+        comment, err := repo.getComment(id)
+        if err != nil {
+            return 0, 0, err
+        }
+        if comment.Deleted {
+            return 0, 0, errors.New("Comment was deleted")
+        }
+        post, err := repo.getPost(strconv.FormatUint(uint64(comment.PostID), 10))
+        if err != nil {
+            return 0, 0, err
+        }
+        return comment.ID, post.GroupID, nil
+    }
+
+    post, err := repo.getPost(id)
+    if err != nil {
+        return 0, 0, err
+    }
+    return post.ID, post.GroupID, nil
+}
+
+func postReactionHandler(formatter *render.Render, repo repository, rules contentRules, targetType string) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        var body struct {
+            Type string `json:"type"`
+        }
+
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &body)
+        if err != nil || !rules.validReactionType(body.Type) {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse reaction.")
+            return
+        }
+
+        vars := mux.Vars(req)
+        targetID, groupID, err := reactionTarget(repo, targetType, vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, fmt.Sprintf("Failed to find %s", targetType))
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        ok, err := canWriteGroup(repo, groupID, Principal{UserID: userID})
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to check group membership.")
+            return
+        }
+        if !ok {
+            formatter.JSON(w, http.StatusForbidden, "Not a member of this group.")
+            return
+        }
+
+        reaction := Reaction{TargetType: targetType, TargetID: targetID, UserID: userID, Type: body.Type}
+        err = repo.setReaction(reaction)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to save reaction.")
+            return
+        }
+
+        // the counters are rebuilt from the database once the reaction is
+        // saved rather than adjusted, so they can't drift
+        _, err = refreshReactionCounts(repo, rules, targetType, targetID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to update reaction counts.")
+            return
+        }
+
+        summary, err := summarizeReactions(repo, rules, targetType, targetID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get reactions.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, summary)
+    }
+}
+
+func deleteReactionHandler(formatter *render.Render, repo repository, rules contentRules, targetType string) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        vars := mux.Vars(req)
+        targetID, _, err := reactionTarget(repo, targetType, vars["id"])
+        if err != nil {
+            formatter.JSON(w, http.StatusNotFound, fmt.Sprintf("Failed to find %s", targetType))
+            return
+        }
+
+        userID, err := userIDFromRequest(req)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get user from token.")
+            return
+        }
+
+        removed, err := repo.removeReaction(targetType, targetID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to remove reaction.")
+            return
+        }
+        if !removed {
+            formatter.JSON(w, http.StatusNotFound, "No reaction to remove.")
+            return
+        }
+
+        _, err = refreshReactionCounts(repo, rules, targetType, targetID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to update reaction counts.")
+            return
+        }
+
+        summary, err := summarizeReactions(repo, rules, targetType, targetID, userID)
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to get reactions.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, summary)
+    }
+}
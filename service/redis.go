@@ -1,26 +1,47 @@
 package service
 
 import (
+    "context"
     "fmt"
+    "time"
+
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
     "gopkg.in/redis.v4"
 )
 
-//REDIS client to be shared throughout service
-var REDIS *redis.Client
-
-
-//InitRedisClient returns a redis client
+//InitRedisClient returns a redis client, it fails when redis can't be reached
 func InitRedisClient(address, password string) (*redis.Client, error) {
     client := redis.NewClient(&redis.Options{
         Addr:     address,
         Password: password, // no password set
         DB:       0,
     })
-    pong, err := client.Ping().Result()
-    fmt.Println(pong, err)
+    err := client.Ping().Err()
     if err != nil {
-        fmt.Println(err)
-        return client, err
+        client.Close()
+        return nil, fmt.Errorf("Failed to connect to redis at %s: %s", address, err)
     }
     return client, nil
 }
+
+//redisCall traces and times a single redis command, redis.Nil is a normal
+//miss and doesn't fail the span
+func redisCall(ctx context.Context, tracer trace.Tracer, metrics *Metrics, command string, call func() error) error {
+    _, span := startSpan(ctx, tracer, "redis "+command,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("db.system", "redis"),
+            attribute.String("db.operation.name", command),
+        ),
+    )
+    start := time.Now()
+    err := call()
+    metrics.observeRedis(command, start, err)
+    if err == redis.Nil {
+        endSpan(span, nil)
+    } else {
+        endSpan(span, err)
+    }
+    return err
+}
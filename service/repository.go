@@ -1,89 +1,688 @@
 package service
 
 import (
+    "context"
+    "errors"
+    "strconv"
     "time"
+
+    "github.com/jinzhu/gorm"
+    "go.opentelemetry.io/otel/trace"
+    "gopkg.in/redis.v4"
+)
+
+var (
+    //errInviteUsedUp is returned when an invite has no uses left
+    errInviteUsedUp = errors.New("Invite has no uses left")
+    //errJoinRequestReviewed is returned when a join request was already reviewed
+    errJoinRequestReviewed = errors.New("Join request already reviewed")
 )
 
 type repository interface {
-    addGroup(group Group) error
-	getGroups() ([]Group, error)
+    //now is the clock the repository stamps rows with, handlers use it too
+    //so their checks agree with what is written
+    now() time.Time
+    addGroup(group Group) (Group, error)
+    createGroup(group Group) (Group, error)
+    getGroups(access groupAccess, page pageRequest) ([]Group, error)
 	getGroup(id string) (Group, error)
+    updateGroup(group Group) error
+    deleteGroup(groupID uint) error
     addPost(post Post) error
-    getPostsByGroup(groupIDs []string) ([]Post, error)
+    getPostsByGroup(groupIDs []string, page pageRequest) ([]Post, error)
     getPost(id string) (Post, error)
+    updatePost(post Post) error
+    deletePost(postID uint) error
     addComment(comment Comment) error
-    getCommentsByPost(postIDs []string) ([]Comment, error)
+    getCommentsByPost(postIDs []string, page pageRequest) ([]Comment, error)
+    getTopLevelComments(postIDs []string, page pageRequest) ([]Comment, error)
+    getCommentReplies(commentIDs []uint) ([]Comment, error)
     getComment(id string) (Comment, error)
+    updateComment(comment Comment) error
+    deleteComment(commentID uint) error
+    countReplies(commentID uint) (int, error)
+    tombstoneComment(commentID uint) error
     addGroupMember(groupID ,userID uint) error
     addGroupAdmin(groupID, userID uint) error
-    redisGetValue(key string) (string, error)
-    redisSetValue(key, value string, seconds time.Duration) error
+    isGroupMember(groupID, userID uint) (bool, error)
+    getMemberGroupIDs(userID uint) ([]uint, error)
+    getGroupMembers(groupID uint, page pageRequest) ([]GroupMember, error)
+    removeGroupMember(groupID, userID uint) error
+    isGroupAdmin(groupID, userID uint) (bool, error)
+    countGroupAdmins(groupID uint) (int, error)
+    removeGroupAdmin(groupID, userID uint) error
+    getGroupAdmins(groupID uint, page pageRequest) ([]GroupAdmin, error)
+    promoteGroupAdmin(groupID, userID, actorID uint) error
+    demoteGroupAdmin(groupID, userID, actorID uint) error
+    transferGroupOwnership(groupID, userID, actorID uint) error
+    getGroupAdminEvents(groupID uint, page pageRequest) ([]GroupAdminEvent, error)
+    addGroupInvite(invite GroupInvite) (GroupInvite, error)
+    getGroupInvite(code string) (GroupInvite, error)
+    getGroupInvites(groupID uint, page pageRequest) ([]GroupInvite, error)
+    getUserInvites(userID uint, page pageRequest) ([]GroupInvite, error)
+    acceptGroupInvite(inviteID, groupID, userID uint) error
+    declineGroupInvite(inviteID uint) error
+    revokeGroupInvite(inviteID uint) error
+    addAPIKey(key APIKey) (APIKey, error)
+    getAPIKeyByHash(hash string) (APIKey, error)
+    getAPIKeys(page pageRequest) ([]APIKey, error)
+    revokeAPIKey(id string) error
+    addJoinRequest(request GroupJoinRequest) (GroupJoinRequest, error)
+    getJoinRequest(id string) (GroupJoinRequest, error)
+    hasPendingJoinRequest(groupID, userID uint) (bool, error)
+    getJoinRequests(groupID uint, status string, page pageRequest) ([]GroupJoinRequest, error)
+    approveJoinRequest(requestID, reviewerID uint) error
+    rejectJoinRequest(requestID, reviewerID uint, reason string) error
+    setReaction(reaction Reaction) error
+    removeReaction(targetType string, targetID, userID uint) (bool, error)
+    getUserReaction(targetType string, targetID, userID uint) (string, error)
+    countReactions(targetType string, targetID uint) (map[string]int64, error)
+    redisHashGetAll(key string) (map[string]string, error)
+    redisHashSet(key string, values map[string]int64, seconds time.Duration) error
+}
+
+//repoHandler is the repository backed by postgres, with redis for counters
+type repoHandler struct {
+    db          *gorm.DB
+    cache       *redis.Client
+    metrics     *Metrics
+    tracer      trace.Tracer
+    clock       func() time.Time
+    //ctx is the request the repository is bound to, redis calls are traced
+    //as its children
+    ctx         context.Context
+}
+
+func newRepoHandler(deps Dependencies) *repoHandler {
+    deps = deps.withDefaults()
+    return &repoHandler{
+        db:      deps.DB,
+        cache:   deps.Cache,
+        metrics: deps.Metrics,
+        tracer:  deps.Tracer,
+        clock:   deps.Clock,
+        ctx:     context.Background(),
+    }
+}
+
+//withContext returns a copy of the repository bound to ctx
+func (r *repoHandler) withContext(ctx context.Context) repository {
+    bound := *r
+    bound.ctx = ctx
+    return &bound
+}
+
+func (r *repoHandler) now() time.Time {
+    return r.clock()
+}
+
+func (r *repoHandler) addGroup(group Group) (Group, error) {
+    err := r.db.Create(&group).Error
+    return group, err
+}
+
+//createGroup adds the group with its owner as a member and an admin, all or
+//nothing so a group is never left without anyone who can manage it
+func (r *repoHandler) createGroup(group Group) (Group, error) {
+    tx := r.db.Begin()
+    if err := tx.Create(&group).Error; err != nil {
+        tx.Rollback()
+        return group, err
+    }
+    if err := createGroupMember(tx, group.ID, group.OwnerID); err != nil {
+        tx.Rollback()
+        return group, err
+    }
+    if err := createGroupAdmin(tx, group.ID, group.OwnerID); err != nil {
+        tx.Rollback()
+        return group, err
+    }
+    return group, tx.Commit().Error
+}
+
+//paginate orders rows by (created_at, id) and fetches one row more than the
+//page so callers know if there is a next page
+func paginate(page pageRequest) func(*gorm.DB) *gorm.DB {
+    return func(db *gorm.DB) *gorm.DB {
+        if page.After != nil {
+            db = db.Where("(created_at, id) > (?, ?)", page.After.CreatedAt, page.After.ID)
+        }
+        return db.Order("created_at, id").Limit(page.Limit + 1)
+    }
+}
+
+//paginateNewest is paginate for lists shown newest first
+func paginateNewest(page pageRequest) func(*gorm.DB) *gorm.DB {
+    return func(db *gorm.DB) *gorm.DB {
+        if page.After != nil {
+            db = db.Where("(created_at, id) < (?, ?)", page.After.CreatedAt, page.After.ID)
+        }
+        return db.Order("created_at desc, id desc").Limit(page.Limit + 1)
+    }
 }
 
-type repoHandler struct{}
+//paginateByUser is paginate for membership rows, which have neither
+//created_at nor id and are ordered by user
+func paginateByUser(page pageRequest) func(*gorm.DB) *gorm.DB {
+    return func(db *gorm.DB) *gorm.DB {
+        if page.After != nil {
+            db = db.Where("user_id > ?", page.After.ID)
+        }
+        return db.Order("user_id").Limit(page.Limit + 1)
+    }
+}
 
-func (r *repoHandler) addGroup(group Group) error {
-    return DB.Create(&group).Error
+//groupAccess is who a list of groups is for, private groups are left out
+//unless the caller is a member, they are among groupIDs or all is set
+type groupAccess struct {
+    userID      uint
+    groupIDs    []uint
+    all         bool
 }
 
-func (r *repoHandler) getGroups() ([]Group, error) {
+//getGroups filters in the query rather than after it, so pages are full and
+//the cursor never skips over readable groups
+func (r *repoHandler) getGroups(access groupAccess, page pageRequest) ([]Group, error) {
     var groups []Group
-    err := DB.Find(&groups).Error
+    db := r.db
+    if !access.all {
+        memberOf := r.db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", access.userID).QueryExpr()
+        if len(access.groupIDs) > 0 {
+            db = db.Where("private = ? OR id IN (?) OR id IN (?)", false, memberOf, access.groupIDs)
+        } else {
+            db = db.Where("private = ? OR id IN (?)", false, memberOf)
+        }
+    }
+    err := db.Scopes(paginate(page)).Find(&groups).Error
     return groups, err
 }
 
 func (r *repoHandler) getGroup(id string) (Group, error) {
     var group Group
-    err := DB.Find(&group, id).Error
+    err := r.db.Find(&group, id).Error
     return group, err
 }
 
+func (r *repoHandler) updateGroup(group Group) error {
+    return r.db.Save(&group).Error
+}
+
+//deleteGroup soft deletes the group along with its posts and their comments
+func (r *repoHandler) deleteGroup(groupID uint) error {
+    tx := r.db.Begin()
+    postIDs := tx.Model(&Post{}).Where("group_id = ?", groupID).Select("id").QueryExpr()
+    if err := tx.Where("post_id in (?)", postIDs).Delete(Comment{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("group_id = ?", groupID).Delete(Post{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("id = ?", groupID).Delete(Group{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
 func (r *repoHandler) addPost(post Post) error {
-    return DB.Create(&post).Error
+    return r.db.Create(&post).Error
 }
 
-func (r *repoHandler) getPostsByGroup(groupIDs []string) ([]Post, error) {
+func (r *repoHandler) getPostsByGroup(groupIDs []string, page pageRequest) ([]Post, error) {
     var posts []Post
-    err := DB.Where("group_id in (?)", groupIDs).Find(&posts).Error
+    err := r.db.Where("group_id in (?)", groupIDs).Scopes(paginate(page)).Find(&posts).Error
     return posts, err
 }
 
 func (r *repoHandler) getPost(id string) (Post, error) {
     var post Post
-    err := DB.Find(&post).Error
+    err := r.db.Find(&post, id).Error
     return post, err
 }
 
+func (r *repoHandler) updatePost(post Post) error {
+    return r.db.Save(&post).Error
+}
+
+//deletePost soft deletes the post along with its comments
+func (r *repoHandler) deletePost(postID uint) error {
+    tx := r.db.Begin()
+    if err := tx.Where("post_id = ?", postID).Delete(Comment{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("id = ?", postID).Delete(Post{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
 func (r *repoHandler) addComment(comment Comment) error {
-    return DB.Create(&comment).Error
+    return r.db.Create(&comment).Error
+}
+
+func (r *repoHandler) getCommentsByPost(postIDs []string, page pageRequest) ([]Comment, error) {
+    var comments []Comment
+    err := r.db.Where("post_id in (?)", postIDs).Scopes(paginate(page)).Find(&comments).Error
+    return comments, err
 }
 
-func (r *repoHandler) getCommentsByPost(postIDs []string) ([]Comment, error) {
+//getTopLevelComments pages through the comments on the posts that aren't
+//replies
+func (r *repoHandler) getTopLevelComments(postIDs []string, page pageRequest) ([]Comment, error) {
     var comments []Comment
-    err := DB.Where("post_id in (?)", postIDs).Find(&comments).Error
+    err := r.db.Where("post_id in (?) AND parent_id IS NULL", postIDs).Scopes(paginate(page)).Find(&comments).Error
     return comments, err
 }
 
+//getCommentReplies returns every reply under the comments however deeply it
+//is nested, oldest first
+func (r *repoHandler) getCommentReplies(commentIDs []uint) ([]Comment, error) {
+    var replies []Comment
+    if len(commentIDs) == 0 {
+        return replies, nil
+    }
+    err := r.db.Raw(`WITH RECURSIVE thread AS (
+            SELECT * FROM comments WHERE parent_id IN (?) AND deleted_at IS NULL
+            UNION ALL
+            SELECT c.* FROM comments c JOIN thread t ON c.parent_id = t.id WHERE c.deleted_at IS NULL
+        ) SELECT * FROM thread ORDER BY created_at, id`, commentIDs).Scan(&replies).Error
+    return replies, err
+}
+
 func (r *repoHandler) getComment(id string) (Comment, error) {
     var comment Comment
-    err := DB.Find(&comment, id).Error
+    err := r.db.Find(&comment, id).Error
     return comment, err
 }
 
+//updateComment saves the content of a comment, where it sits in its thread
+//doesn't change and top level comments keep a NULL parent_id
+func (r *repoHandler) updateComment(comment Comment) error {
+    return r.db.Model(&comment).Update("content", comment.Content).Error
+}
+
+func (r *repoHandler) deleteComment(commentID uint) error {
+    return r.db.Where("id = ?", commentID).Delete(Comment{}).Error
+}
+
+func (r *repoHandler) countReplies(commentID uint) (int, error) {
+    var count int
+    err := r.db.Model(&Comment{}).Where("parent_id = ?", commentID).Count(&count).Error
+    return count, err
+}
+
+//tombstoneComment blanks out a comment but keeps its row so replies to it
+//stay attached to the thread
+func (r *repoHandler) tombstoneComment(commentID uint) error {
+    return r.db.Model(&Comment{}).Where("id = ?", commentID).
+        UpdateColumns(map[string]interface{}{"content": "", "deleted": true}).Error
+}
+
 func (r *repoHandler) addGroupMember(groupID, userID uint) error {
-    groupMember := GroupMember{UserID: userID, GroupID: groupID}
-    return DB.Create(&groupMember).Error
+    return createGroupMember(r.db, groupID, userID)
+}
+
+//createGroupMember is the single path for adding members so that every way
+//of joining a group writes the same rows, joining a group twice leaves the
+//existing membership alone rather than failing
+func createGroupMember(db *gorm.DB, groupID, userID uint) error {
+    return db.Exec("INSERT INTO group_members (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING", groupID, userID).Error
 }
 
 func (r *repoHandler) addGroupAdmin(groupID, userID uint) error {
+    return createGroupAdmin(r.db, groupID, userID)
+}
+
+//createGroupAdmin is addGroupAdmin for any db or transaction
+func createGroupAdmin(db *gorm.DB, groupID, userID uint) error {
+    return db.Exec("INSERT INTO group_admins (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING", groupID, userID).Error
+}
+
+func (r *repoHandler) isGroupMember(groupID, userID uint) (bool, error) {
+    var count int
+    err := r.db.Model(&GroupMember{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&count).Error
+    return count > 0, err
+}
+
+func (r *repoHandler) getMemberGroupIDs(userID uint) ([]uint, error) {
+    var groupIDs []uint
+    err := r.db.Model(&GroupMember{}).Where("user_id = ?", userID).Pluck("group_id", &groupIDs).Error
+    return groupIDs, err
+}
+
+func (r *repoHandler) getGroupMembers(groupID uint, page pageRequest) ([]GroupMember, error) {
+    var members []GroupMember
+    err := r.db.Where("group_id = ?", groupID).Scopes(paginateByUser(page)).Find(&members).Error
+    return members, err
+}
+
+func (r *repoHandler) removeGroupMember(groupID, userID uint) error {
+    return r.db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(GroupMember{}).Error
+}
+
+func (r *repoHandler) isGroupAdmin(groupID, userID uint) (bool, error) {
+    var count int
+    err := r.db.Model(&GroupAdmin{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&count).Error
+    return count > 0, err
+}
+
+func (r *repoHandler) countGroupAdmins(groupID uint) (int, error) {
+    var count int
+    err := r.db.Model(&GroupAdmin{}).Where("group_id = ?", groupID).Count(&count).Error
+    return count, err
+}
+
+func (r *repoHandler) removeGroupAdmin(groupID, userID uint) error {
+    return r.db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(GroupAdmin{}).Error
+}
+
+func (r *repoHandler) getGroupAdmins(groupID uint, page pageRequest) ([]GroupAdmin, error) {
+    var admins []GroupAdmin
+    err := r.db.Where("group_id = ?", groupID).Scopes(paginateByUser(page)).Find(&admins).Error
+    return admins, err
+}
+
+func (r *repoHandler) promoteGroupAdmin(groupID, userID, actorID uint) error {
+    tx := r.db.Begin()
     adminMember := GroupAdmin{UserID: userID, GroupID: groupID}
-    return DB.Create(&adminMember).Error
+    if err := tx.Create(&adminMember).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    event := GroupAdminEvent{GroupID: groupID, ActorID: actorID, UserID: userID, Action: adminActionPromote}
+    if err := tx.Create(&event).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
+func (r *repoHandler) demoteGroupAdmin(groupID, userID, actorID uint) error {
+    tx := r.db.Begin()
+    if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(GroupAdmin{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    event := GroupAdminEvent{GroupID: groupID, ActorID: actorID, UserID: userID, Action: adminActionDemote}
+    if err := tx.Create(&event).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
+func (r *repoHandler) transferGroupOwnership(groupID, userID, actorID uint) error {
+    tx := r.db.Begin()
+    if err := tx.Model(&Group{}).Where("id = ?", groupID).Update("owner_id", userID).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    // the owner is always an admin as well
+    var count int
+    if err := tx.Model(&GroupAdmin{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&count).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if count == 0 {
+        adminMember := GroupAdmin{UserID: userID, GroupID: groupID}
+        if err := tx.Create(&adminMember).Error; err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    event := GroupAdminEvent{GroupID: groupID, ActorID: actorID, UserID: userID, Action: adminActionTransfer}
+    if err := tx.Create(&event).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
+func (r *repoHandler) getGroupAdminEvents(groupID uint, page pageRequest) ([]GroupAdminEvent, error) {
+    var events []GroupAdminEvent
+    err := r.db.Where("group_id = ?", groupID).Scopes(paginateNewest(page)).Find(&events).Error
+    return events, err
+}
+
+func (r *repoHandler) addGroupInvite(invite GroupInvite) (GroupInvite, error) {
+    err := r.db.Create(&invite).Error
+    return invite, err
+}
+
+func (r *repoHandler) getGroupInvite(code string) (GroupInvite, error) {
+    var invite GroupInvite
+    err := r.db.Where("code = ?", code).First(&invite).Error
+    return invite, err
+}
+
+func (r *repoHandler) getGroupInvites(groupID uint, page pageRequest) ([]GroupInvite, error) {
+    var invites []GroupInvite
+    err := r.db.Where("group_id = ?", groupID).Scopes(paginateNewest(page)).Find(&invites).Error
+    return invites, err
+}
+
+func (r *repoHandler) getUserInvites(userID uint, page pageRequest) ([]GroupInvite, error) {
+    var invites []GroupInvite
+    err := r.db.Where("invitee_id = ? AND revoked_at IS NULL AND declined_at IS NULL AND uses = 0", userID).
+        Where("expires_at IS NULL OR expires_at > ?", r.now()).
+        Scopes(paginateNewest(page)).Find(&invites).Error
+    return invites, err
+}
+
+//acceptGroupInvite uses up one use of the invite and adds the member in a
+//single transaction so an invite can't be used more than it allows
+func (r *repoHandler) acceptGroupInvite(inviteID, groupID, userID uint) error {
+    tx := r.db.Begin()
+    result := tx.Model(&GroupInvite{}).
+        Where("id = ? AND (max_uses = 0 OR uses < max_uses)", inviteID).
+        UpdateColumn("uses", gorm.Expr("uses + 1"))
+    if result.Error != nil {
+        tx.Rollback()
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        tx.Rollback()
+        return errInviteUsedUp
+    }
+    if err := createGroupMember(tx, groupID, userID); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
+func (r *repoHandler) declineGroupInvite(inviteID uint) error {
+    return r.db.Model(&GroupInvite{}).Where("id = ?", inviteID).UpdateColumn("declined_at", r.now()).Error
+}
+
+func (r *repoHandler) revokeGroupInvite(inviteID uint) error {
+    return r.db.Model(&GroupInvite{}).Where("id = ?", inviteID).UpdateColumn("revoked_at", r.now()).Error
+}
+
+func (r *repoHandler) addAPIKey(key APIKey) (APIKey, error) {
+    err := r.db.Create(&key).Error
+    return key, err
+}
+
+//getAPIKeyByHash finds a key that hasn't been revoked
+func (r *repoHandler) getAPIKeyByHash(hash string) (APIKey, error) {
+    var key APIKey
+    err := r.db.Where("key_hash = ? AND revoked_at IS NULL", hash).First(&key).Error
+    return key, err
+}
+
+func (r *repoHandler) getAPIKeys(page pageRequest) ([]APIKey, error) {
+    var keys []APIKey
+    err := r.db.Scopes(paginateNewest(page)).Find(&keys).Error
+    return keys, err
+}
+
+func (r *repoHandler) revokeAPIKey(id string) error {
+    result := r.db.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id).UpdateColumn("revoked_at", r.now())
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return gorm.ErrRecordNotFound
+    }
+    return nil
+}
+
+func (r *repoHandler) addJoinRequest(request GroupJoinRequest) (GroupJoinRequest, error) {
+    err := r.db.Create(&request).Error
+    return request, err
+}
+
+func (r *repoHandler) getJoinRequest(id string) (GroupJoinRequest, error) {
+    var request GroupJoinRequest
+    err := r.db.Find(&request, id).Error
+    return request, err
+}
+
+func (r *repoHandler) hasPendingJoinRequest(groupID, userID uint) (bool, error) {
+    var count int
+    err := r.db.Model(&GroupJoinRequest{}).
+        Where("group_id = ? AND user_id = ? AND status = ?", groupID, userID, joinRequestPending).
+        Count(&count).Error
+    return count > 0, err
+}
+
+func (r *repoHandler) getJoinRequests(groupID uint, status string, page pageRequest) ([]GroupJoinRequest, error) {
+    var requests []GroupJoinRequest
+    err := r.db.Where("group_id = ? AND status = ?", groupID, status).
+        Scopes(paginate(page)).Find(&requests).Error
+    return requests, err
+}
+
+//approveJoinRequest marks the request approved and adds the member in a
+//single transaction so a request can only ever be approved once
+func (r *repoHandler) approveJoinRequest(requestID, reviewerID uint) error {
+    var request GroupJoinRequest
+    if err := r.db.Find(&request, requestID).Error; err != nil {
+        return err
+    }
+
+    tx := r.db.Begin()
+    result := tx.Model(&GroupJoinRequest{}).
+        Where("id = ? AND status = ?", requestID, joinRequestPending).
+        UpdateColumns(map[string]interface{}{
+            "status":      joinRequestApproved,
+            "reviewer_id": reviewerID,
+            "reviewed_at": r.now(),
+        })
+    if result.Error != nil {
+        tx.Rollback()
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        tx.Rollback()
+        return errJoinRequestReviewed
+    }
+    if err := createGroupMember(tx, request.GroupID, request.UserID); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit().Error
+}
+
+func (r *repoHandler) rejectJoinRequest(requestID, reviewerID uint, reason string) error {
+    result := r.db.Model(&GroupJoinRequest{}).
+        Where("id = ? AND status = ?", requestID, joinRequestPending).
+        UpdateColumns(map[string]interface{}{
+            "status":      joinRequestRejected,
+            "reason":      reason,
+            "reviewer_id": reviewerID,
+            "reviewed_at": r.now(),
+        })
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return errJoinRequestReviewed
+    }
+    return nil
+}
+
+//setReaction saves the user's reaction to a target, replacing any earlier
+//one. It is a single upsert on the one reaction per user index, so two
+//requests racing can't both insert
+func (r *repoHandler) setReaction(reaction Reaction) error {
+    now := r.now()
+    return r.db.Exec(`INSERT INTO reactions (target_type, target_id, user_id, type, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (target_type, target_id, user_id) DO UPDATE SET type = EXCLUDED.type, updated_at = EXCLUDED.updated_at`,
+        reaction.TargetType, reaction.TargetID, reaction.UserID, reaction.Type, now, now).Error
+}
+
+//removeReaction deletes the user's reaction to a target and reports if there
+//was one
+func (r *repoHandler) removeReaction(targetType string, targetID, userID uint) (bool, error) {
+    result := r.db.Where("target_type = ? AND target_id = ? AND user_id = ?", targetType, targetID, userID).
+        Delete(&Reaction{})
+    return result.RowsAffected > 0, result.Error
+}
+
+func (r *repoHandler) getUserReaction(targetType string, targetID, userID uint) (string, error) {
+    var existing Reaction
+    err := r.db.Where("target_type = ? AND target_id = ? AND user_id = ?", targetType, targetID, userID).
+        First(&existing).Error
+    if gorm.IsRecordNotFoundError(err) {
+        return "", nil
+    }
+    return existing.Type, err
+}
+
+func (r *repoHandler) countReactions(targetType string, targetID uint) (map[string]int64, error) {
+    rows, err := r.db.Model(&Reaction{}).Select("type, count(*)").
+        Where("target_type = ? AND target_id = ?", targetType, targetID).
+        Group("type").Rows()
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    counts := make(map[string]int64)
+    for rows.Next() {
+        var reactionType string
+        var count int64
+        if err := rows.Scan(&reactionType, &count); err != nil {
+            return nil, err
+        }
+        counts[reactionType] = count
+    }
+    return counts, rows.Err()
+}
+
+func (r *repoHandler) redisHashGetAll(key string) (values map[string]string, err error) {
+    err = redisCall(r.ctx, r.tracer, r.metrics, "hgetall", func() error {
+        values, err = r.cache.HGetAll(key).Result()
+        return err
+    })
+    return values, err
 }
 
-func (r *repoHandler) redisGetValue(key string) (string, error) {
-    return REDIS.Get(key).Result()
+func (r *repoHandler) redisHashSet(key string, values map[string]int64, seconds time.Duration) error {
+    fields := make(map[string]string, len(values))
+    for field, value := range values {
+        fields[field] = strconv.FormatInt(value, 10)
+    }
+    err := redisCall(r.ctx, r.tracer, r.metrics, "hmset", func() error {
+        return r.cache.HMSet(key, fields).Err()
+    })
+    if err != nil {
+        return err
+    }
+    return r.expire(key, seconds)
 }
 
-func (r *repoHandler) redisSetValue(key, value string, seconds time.Duration) error {
-    return REDIS.Set(key, value, seconds).Err()
+func (r *repoHandler) expire(key string, ttl time.Duration) error {
+    return redisCall(r.ctx, r.tracer, r.metrics, "expire", func() error {
+        return r.cache.Expire(key, ttl).Err()
+    })
 }
@@ -0,0 +1,469 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "time"
+
+    "github.com/jinzhu/gorm"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+//contextRepository is implemented by repositories that can be bound to the
+//context of a request
+type contextRepository interface {
+    withContext(ctx context.Context) repository
+}
+
+//repoFor binds repo to the request so its calls are traced as children of
+//the request span, the repository interface is too wide to take a context on
+//every method
+func repoFor(req *http.Request, repo repository) repository {
+    if bound, ok := repo.(contextRepository); ok {
+        return bound.withContext(req.Context())
+    }
+    return repo
+}
+
+//instrumentedRepository times and traces every call to repo
+type instrumentedRepository struct {
+    repo        repository
+    metrics     *Metrics
+    tracer      trace.Tracer
+    ctx         context.Context
+}
+
+func (r instrumentedRepository) withContext(ctx context.Context) repository {
+    r.ctx = ctx
+    return r
+}
+
+//start opens the span of a call and returns repo bound to it, done has to be
+//called with the result of the call
+func (r instrumentedRepository) start(method string) (repository, func(error)) {
+    ctx := r.ctx
+    if ctx == nil {
+        ctx = context.Background()
+    }
+    ctx, span := startSpan(ctx, r.tracer, "repository."+method,
+        trace.WithAttributes(attribute.String("code.function", method)),
+    )
+    start := time.Now()
+
+    repo := r.repo
+    if bound, ok := repo.(contextRepository); ok {
+        repo = bound.withContext(ctx)
+    }
+    return repo, func(err error) {
+        r.metrics.observeRepository(method, start, err)
+        if gorm.IsRecordNotFoundError(err) {
+            err = nil
+        }
+        endSpan(span, err)
+    }
+}
+
+//now isn't timed, it doesn't reach the database
+func (r instrumentedRepository) now() time.Time {
+    return r.repo.now()
+}
+
+func (r instrumentedRepository) addGroup(group Group) (Group, error) {
+    repo, done := r.start("addGroup")
+    result, err := repo.addGroup(group)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) createGroup(group Group) (Group, error) {
+    repo, done := r.start("createGroup")
+    result, err := repo.createGroup(group)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getGroups(access groupAccess, page pageRequest) ([]Group, error) {
+    repo, done := r.start("getGroups")
+    result, err := repo.getGroups(access, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getGroup(id string) (Group, error) {
+    repo, done := r.start("getGroup")
+    result, err := repo.getGroup(id)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) updateGroup(group Group) error {
+    repo, done := r.start("updateGroup")
+    err := repo.updateGroup(group)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) deleteGroup(groupID uint) error {
+    repo, done := r.start("deleteGroup")
+    err := repo.deleteGroup(groupID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) addPost(post Post) error {
+    repo, done := r.start("addPost")
+    err := repo.addPost(post)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) getPostsByGroup(groupIDs []string, page pageRequest) ([]Post, error) {
+    repo, done := r.start("getPostsByGroup")
+    result, err := repo.getPostsByGroup(groupIDs, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getPost(id string) (Post, error) {
+    repo, done := r.start("getPost")
+    result, err := repo.getPost(id)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) updatePost(post Post) error {
+    repo, done := r.start("updatePost")
+    err := repo.updatePost(post)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) deletePost(postID uint) error {
+    repo, done := r.start("deletePost")
+    err := repo.deletePost(postID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) addComment(comment Comment) error {
+    repo, done := r.start("addComment")
+    err := repo.addComment(comment)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) getTopLevelComments(postIDs []string, page pageRequest) ([]Comment, error) {
+    repo, done := r.start("getTopLevelComments")
+    result, err := repo.getTopLevelComments(postIDs, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getCommentReplies(commentIDs []uint) ([]Comment, error) {
+    repo, done := r.start("getCommentReplies")
+    result, err := repo.getCommentReplies(commentIDs)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getCommentsByPost(postIDs []string, page pageRequest) ([]Comment, error) {
+    repo, done := r.start("getCommentsByPost")
+    result, err := repo.getCommentsByPost(postIDs, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getComment(id string) (Comment, error) {
+    repo, done := r.start("getComment")
+    result, err := repo.getComment(id)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) updateComment(comment Comment) error {
+    repo, done := r.start("updateComment")
+    err := repo.updateComment(comment)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) deleteComment(commentID uint) error {
+    repo, done := r.start("deleteComment")
+    err := repo.deleteComment(commentID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) countReplies(commentID uint) (int, error) {
+    repo, done := r.start("countReplies")
+    result, err := repo.countReplies(commentID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) tombstoneComment(commentID uint) error {
+    repo, done := r.start("tombstoneComment")
+    err := repo.tombstoneComment(commentID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) addGroupMember(groupID, userID uint) error {
+    repo, done := r.start("addGroupMember")
+    err := repo.addGroupMember(groupID, userID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) addGroupAdmin(groupID, userID uint) error {
+    repo, done := r.start("addGroupAdmin")
+    err := repo.addGroupAdmin(groupID, userID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) isGroupMember(groupID, userID uint) (bool, error) {
+    repo, done := r.start("isGroupMember")
+    result, err := repo.isGroupMember(groupID, userID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getMemberGroupIDs(userID uint) ([]uint, error) {
+    repo, done := r.start("getMemberGroupIDs")
+    result, err := repo.getMemberGroupIDs(userID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getGroupMembers(groupID uint, page pageRequest) ([]GroupMember, error) {
+    repo, done := r.start("getGroupMembers")
+    result, err := repo.getGroupMembers(groupID, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) removeGroupMember(groupID, userID uint) error {
+    repo, done := r.start("removeGroupMember")
+    err := repo.removeGroupMember(groupID, userID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) isGroupAdmin(groupID, userID uint) (bool, error) {
+    repo, done := r.start("isGroupAdmin")
+    result, err := repo.isGroupAdmin(groupID, userID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) countGroupAdmins(groupID uint) (int, error) {
+    repo, done := r.start("countGroupAdmins")
+    result, err := repo.countGroupAdmins(groupID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) removeGroupAdmin(groupID, userID uint) error {
+    repo, done := r.start("removeGroupAdmin")
+    err := repo.removeGroupAdmin(groupID, userID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) getGroupAdmins(groupID uint, page pageRequest) ([]GroupAdmin, error) {
+    repo, done := r.start("getGroupAdmins")
+    result, err := repo.getGroupAdmins(groupID, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) promoteGroupAdmin(groupID, userID, actorID uint) error {
+    repo, done := r.start("promoteGroupAdmin")
+    err := repo.promoteGroupAdmin(groupID, userID, actorID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) demoteGroupAdmin(groupID, userID, actorID uint) error {
+    repo, done := r.start("demoteGroupAdmin")
+    err := repo.demoteGroupAdmin(groupID, userID, actorID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) transferGroupOwnership(groupID, userID, actorID uint) error {
+    repo, done := r.start("transferGroupOwnership")
+    err := repo.transferGroupOwnership(groupID, userID, actorID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) getGroupAdminEvents(groupID uint, page pageRequest) ([]GroupAdminEvent, error) {
+    repo, done := r.start("getGroupAdminEvents")
+    result, err := repo.getGroupAdminEvents(groupID, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) addGroupInvite(invite GroupInvite) (GroupInvite, error) {
+    repo, done := r.start("addGroupInvite")
+    result, err := repo.addGroupInvite(invite)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getGroupInvite(code string) (GroupInvite, error) {
+    repo, done := r.start("getGroupInvite")
+    result, err := repo.getGroupInvite(code)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getGroupInvites(groupID uint, page pageRequest) ([]GroupInvite, error) {
+    repo, done := r.start("getGroupInvites")
+    result, err := repo.getGroupInvites(groupID, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getUserInvites(userID uint, page pageRequest) ([]GroupInvite, error) {
+    repo, done := r.start("getUserInvites")
+    result, err := repo.getUserInvites(userID, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) acceptGroupInvite(inviteID, groupID, userID uint) error {
+    repo, done := r.start("acceptGroupInvite")
+    err := repo.acceptGroupInvite(inviteID, groupID, userID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) declineGroupInvite(inviteID uint) error {
+    repo, done := r.start("declineGroupInvite")
+    err := repo.declineGroupInvite(inviteID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) revokeGroupInvite(inviteID uint) error {
+    repo, done := r.start("revokeGroupInvite")
+    err := repo.revokeGroupInvite(inviteID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) addAPIKey(key APIKey) (APIKey, error) {
+    repo, done := r.start("addAPIKey")
+    result, err := repo.addAPIKey(key)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getAPIKeyByHash(hash string) (APIKey, error) {
+    repo, done := r.start("getAPIKeyByHash")
+    result, err := repo.getAPIKeyByHash(hash)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getAPIKeys(page pageRequest) ([]APIKey, error) {
+    repo, done := r.start("getAPIKeys")
+    result, err := repo.getAPIKeys(page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) revokeAPIKey(id string) error {
+    repo, done := r.start("revokeAPIKey")
+    err := repo.revokeAPIKey(id)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) addJoinRequest(request GroupJoinRequest) (GroupJoinRequest, error) {
+    repo, done := r.start("addJoinRequest")
+    result, err := repo.addJoinRequest(request)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getJoinRequest(id string) (GroupJoinRequest, error) {
+    repo, done := r.start("getJoinRequest")
+    result, err := repo.getJoinRequest(id)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) hasPendingJoinRequest(groupID, userID uint) (bool, error) {
+    repo, done := r.start("hasPendingJoinRequest")
+    result, err := repo.hasPendingJoinRequest(groupID, userID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getJoinRequests(groupID uint, status string, page pageRequest) ([]GroupJoinRequest, error) {
+    repo, done := r.start("getJoinRequests")
+    result, err := repo.getJoinRequests(groupID, status, page)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) approveJoinRequest(requestID, reviewerID uint) error {
+    repo, done := r.start("approveJoinRequest")
+    err := repo.approveJoinRequest(requestID, reviewerID)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) rejectJoinRequest(requestID, reviewerID uint, reason string) error {
+    repo, done := r.start("rejectJoinRequest")
+    err := repo.rejectJoinRequest(requestID, reviewerID, reason)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) setReaction(reaction Reaction) error {
+    repo, done := r.start("setReaction")
+    err := repo.setReaction(reaction)
+    done(err)
+    return err
+}
+
+func (r instrumentedRepository) removeReaction(targetType string, targetID, userID uint) (bool, error) {
+    repo, done := r.start("removeReaction")
+    result, err := repo.removeReaction(targetType, targetID, userID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) getUserReaction(targetType string, targetID, userID uint) (string, error) {
+    repo, done := r.start("getUserReaction")
+    result, err := repo.getUserReaction(targetType, targetID, userID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) countReactions(targetType string, targetID uint) (map[string]int64, error) {
+    repo, done := r.start("countReactions")
+    result, err := repo.countReactions(targetType, targetID)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) redisHashGetAll(key string) (map[string]string, error) {
+    repo, done := r.start("redisHashGetAll")
+    result, err := repo.redisHashGetAll(key)
+    done(err)
+    return result, err
+}
+
+func (r instrumentedRepository) redisHashSet(key string, values map[string]int64, seconds time.Duration) error {
+    repo, done := r.start("redisHashSet")
+    err := repo.redisHashSet(key, values, seconds)
+    done(err)
+    return err
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "github.com/unrolled/render"
+    "gopkg.in/redis.v4"
+)
+
+//postRevokeTokenHandler lets the auth service purge a token on logout, the
+//revocation secret has to be sent in the X-Revocation-Secret header and the
+//endpoint is disabled while no secret is configured
+func postRevokeTokenHandler(formatter *render.Render, store tokenStore, cfg TokenConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        secret := req.Header.Get("X-Revocation-Secret")
+        if cfg.RevocationSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.RevocationSecret)) != 1 {
+            formatter.JSON(w, http.StatusForbidden, "Not allowed to revoke tokens.")
+            return
+        }
+
+        var body struct {
+            Token string `json:"token"`
+        }
+        payload, _ := ioutil.ReadAll(req.Body)
+        err := json.Unmarshal(payload, &body)
+        if err != nil || body.Token == "" {
+            formatter.JSON(w, http.StatusBadRequest, "Failed to parse token.")
+            return
+        }
+
+        err = revokeToken(req.Context(), store, body.Token, time.Duration(cfg.RevokedTTL))
+        if err != nil {
+            formatter.JSON(w, http.StatusInternalServerError, "Failed to revoke token.")
+            return
+        }
+        formatter.JSON(w, http.StatusOK, "Token succesfully revoked.")
+    }
+}
+
+//ListenForRevocations revokes every token the auth service publishes on the
+//revocation channel until ctx is cancelled, it blocks so it should be run in
+//its own goroutine
+func ListenForRevocations(ctx context.Context, cache *redis.Client, cfg TokenConfig, logger *slog.Logger) {
+    store := redisTokenStore{client: cache}
+    for ctx.Err() == nil {
+        pubsub, err := cache.Subscribe(cfg.RevocationChannel)
+        if err != nil {
+            logger.Error("Failed to subscribe to revocations", "channel", cfg.RevocationChannel, "error", err)
+            waitOrDone(ctx, time.Second)
+            continue
+        }
+
+        // closing the subscription is the only way to stop a blocked receive
+        done := make(chan struct{})
+        go func() {
+            select {
+            case <-ctx.Done():
+                pubsub.Close()
+            case <-done:
+            }
+        }()
+
+        for {
+            msg, err := pubsub.ReceiveMessage()
+            if err != nil {
+                if ctx.Err() == nil {
+                    logger.Warn("Lost subscription to revocations", "channel", cfg.RevocationChannel, "error", err)
+                }
+                break
+            }
+            err = revokeToken(ctx, store, msg.Payload, time.Duration(cfg.RevokedTTL))
+            if err != nil {
+                logger.Error("Failed to revoke token", "error", err)
+            }
+        }
+        close(done)
+        pubsub.Close()
+        waitOrDone(ctx, time.Second)
+    }
+}
+
+//waitOrDone sleeps for wait or until ctx is cancelled
+func waitOrDone(ctx context.Context, wait time.Duration) {
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+    case <-timer.C:
+    }
+}
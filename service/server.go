@@ -1,44 +1,159 @@
 package service
 
 import (
+    "errors"
+    "log/slog"
+    "net/http"
+
     "github.com/urfave/negroni"
     "github.com/gorilla/mux"
     "github.com/unrolled/render"
 )
 
-// NewServer configures and returns a server.
-func NewServer() *negroni.Negroni {
+//Server is the http handler of the service
+type Server struct {
+    *negroni.Negroni
+    health      *Health
+    metrics     *Metrics
+}
+
+//Drain makes readiness fail so load balancers stop sending requests, it is
+//called on shutdown before the server stops accepting connections
+func (s *Server) Drain() {
+    s.health.drain()
+}
+
+//MetricsHandler serves the prometheus metrics, it is mounted on /metrics
+//unless the config asks for a separate port
+func (s *Server) MetricsHandler() http.Handler {
+    return s.metrics.Handler()
+}
+
+// NewServer configures and returns a server, it only uses the connections
+// and clients in deps so several servers can share a process.
+func NewServer(cfg Config, deps Dependencies) (*Server, error) {
     formatter := render.New(render.Options{
         IndentJSON: true,
     })
 
+    if deps.DB == nil || deps.Cache == nil {
+        return nil, errors.New("A server needs a database and a cache")
+    }
+    deps = deps.withDefaults()
+    if deps.Metrics == nil {
+        deps.Metrics = NewMetrics()
+    }
+    if deps.Auth == nil {
+        var err error
+        deps.Auth, err = newAuthClient(cfg.Auth, deps)
+        if err != nil {
+            return nil, err
+        }
+    }
+    limits := cfg.RateLimits.rateLimitOptions()
+    store := redisTokenStore{client: deps.Cache, metrics: deps.Metrics, tracer: deps.Tracer}
+    health := newHealth(cfg.Health, deps)
 
-    n := negroni.Classic()
+    recovery := negroni.NewRecovery()
+    recovery.Logger = slog.NewLogLogger(deps.Logger.Handler(), slog.LevelError)
+    n := negroni.New()
     api := mux.NewRouter().PathPrefix("/api").Subrouter().StrictSlash(true)
+    public := mux.NewRouter()
     mux := mux.NewRouter()
-    repo := &repoHandler{}
-    initRoutes(api, formatter, repo)
+    repo := instrumentedRepository{
+        repo:    newRepoHandler(deps),
+        metrics: deps.Metrics,
+        tracer:  deps.Tracer,
+    }
+    initRoutes(api, formatter, repo, newContentRules(cfg))
+    initRoutesWithoutAuth(public, formatter, store, cfg.Tokens)
+
+    // probes skip the rate limiter so load balancers are never throttled
+    initHealthRoutes(mux, formatter, health)
+    if cfg.MetricsPort == "" {
+        mux.Handle("/metrics", deps.Metrics.Handler()).Methods("GET")
+    }
     mux.PathPrefix("/api").Handler(negroni.New(
-                NewMiddleware(),
+                NewAuthFailureLimiter(limits, deps),
+                NewMiddleware(repo, store, cfg.Tokens, deps),
+                NewRateLimiter(limits, api, deps),
                 negroni.Wrap(api),
         ))
-    initRoutesWithoutAuth(mux, formatter)
+    mux.PathPrefix("/").Handler(negroni.New(
+                NewRateLimiter(limits, public, deps),
+                negroni.Wrap(public),
+        ))
+    n.Use(NewRequestTracing(deps.Tracer, api, public, mux))
+    n.Use(NewRequestLogger(deps.Logger, api, public, mux))
+    n.Use(NewRequestMetrics(deps.Metrics, api, public, mux))
+    n.Use(recovery)
     n.UseHandler(mux)
-    return n
+    return &Server{Negroni: n, health: health, metrics: deps.Metrics}, nil
+}
+
+//contentRules are the limits on what users post that come from the config,
+//handlers that need them are given them when the routes are set up
+type contentRules struct {
+    //maxCommentDepth is how deeply replies may be nested below a top level
+    //comment
+    maxCommentDepth int
+    //reactionTypes are the reactions users may leave on posts and comments
+    reactionTypes   []string
+}
+
+func newContentRules(cfg Config) contentRules {
+    return contentRules{maxCommentDepth: cfg.MaxCommentDepth, reactionTypes: cfg.ReactionTypes}
+}
+
+func initRoutes(mx *mux.Router, formatter *render.Render, repo repository, rules contentRules) {
+    mx.HandleFunc("/groups", scoped(scopeGroupsRead, getGroupsHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups", userScoped(scopeGroupsWrite, postGroupHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}", scoped(scopeGroupsRead, getGroupHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups/{id}", userScoped(scopeGroupsWrite, putGroupHandler(formatter, repo))).Methods("PUT", "PATCH")
+    mx.HandleFunc("/groups/{id}", userScoped(scopeGroupsWrite, deleteGroupHandler(formatter, repo))).Methods("DELETE")
+    mx.HandleFunc("/groups/{id}/members", userScoped(scopeGroupsRead, getGroupMembersHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups/{id}/members", userScoped(scopeGroupsWrite, postGroupMemberHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}/members/me", userScoped(scopeGroupsWrite, deleteGroupMemberHandler(formatter, repo))).Methods("DELETE")
+    mx.HandleFunc("/groups/{id}/admins", userScoped(scopeGroupsRead, getGroupAdminsHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups/{id}/admins/events", userScoped(scopeGroupsRead, getGroupAdminEventsHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups/{id}/admins/{userID}", userScoped(scopeGroupsWrite, postGroupAdminHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}/admins/{userID}", userScoped(scopeGroupsWrite, deleteGroupAdminHandler(formatter, repo))).Methods("DELETE")
+    mx.HandleFunc("/groups/{id}/owner", userScoped(scopeGroupsWrite, postGroupOwnerHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}/invites", userScoped(scopeGroupsRead, getGroupInvitesHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups/{id}/invites", userScoped(scopeGroupsWrite, postGroupInviteHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}/requests", userScoped(scopeGroupsRead, getJoinRequestsHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/groups/{id}/requests", userScoped(scopeGroupsWrite, postJoinRequestHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}/requests/{requestID}/approve", userScoped(scopeGroupsWrite, postJoinRequestApproveHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/groups/{id}/requests/{requestID}/reject", userScoped(scopeGroupsWrite, postJoinRequestRejectHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/posts", scoped(scopePostsRead, getPostsHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/posts", scoped(scopePostsWrite, postPostHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/posts/{id}", scoped(scopePostsRead, getPostHandler(formatter, repo, rules))).Methods("GET")
+    mx.HandleFunc("/posts/{id}", userScoped(scopePostsWrite, putPostHandler(formatter, repo))).Methods("PUT", "PATCH")
+    mx.HandleFunc("/posts/{id}", userScoped(scopePostsWrite, deletePostHandler(formatter, repo))).Methods("DELETE")
+    mx.HandleFunc("/posts/{id}/reactions", userScoped(scopePostsWrite, postReactionHandler(formatter, repo, rules, reactionTargetPost))).Methods("POST")
+    mx.HandleFunc("/posts/{id}/reactions", userScoped(scopePostsWrite, deleteReactionHandler(formatter, repo, rules, reactionTargetPost))).Methods("DELETE")
+    mx.HandleFunc("/comments", scoped(scopePostsRead, getCommentsHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/comments", scoped(scopePostsWrite, postCommentHandler(formatter, repo, rules))).Methods("POST")
+    mx.HandleFunc("/comments/{id}", scoped(scopePostsRead, getCommentHandler(formatter, repo, rules))).Methods("GET")
+    mx.HandleFunc("/comments/{id}", userScoped(scopePostsWrite, putCommentHandler(formatter, repo))).Methods("PUT", "PATCH")
+    mx.HandleFunc("/comments/{id}", userScoped(scopePostsWrite, deleteCommentHandler(formatter, repo))).Methods("DELETE")
+    mx.HandleFunc("/comments/{id}/reactions", userScoped(scopePostsWrite, postReactionHandler(formatter, repo, rules, reactionTargetComment))).Methods("POST")
+    mx.HandleFunc("/comments/{id}/reactions", userScoped(scopePostsWrite, deleteReactionHandler(formatter, repo, rules, reactionTargetComment))).Methods("DELETE")
+    mx.HandleFunc("/invites", userScoped(scopeGroupsRead, getUserInvitesHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/invites/{code}", userScoped(scopeGroupsWrite, deleteInviteHandler(formatter, repo))).Methods("DELETE")
+    mx.HandleFunc("/invites/{code}/accept", userScoped(scopeGroupsWrite, postInviteAcceptHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/invites/{code}/decline", userScoped(scopeGroupsWrite, postInviteDeclineHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/apikeys", userScoped(scopeAdmin, getAPIKeysHandler(formatter, repo))).Methods("GET")
+    mx.HandleFunc("/apikeys", userScoped(scopeAdmin, postAPIKeyHandler(formatter, repo))).Methods("POST")
+    mx.HandleFunc("/apikeys/{id}", userScoped(scopeAdmin, deleteAPIKeyHandler(formatter, repo))).Methods("DELETE")
 }
 
-func initRoutes(mx *mux.Router, formatter *render.Render, repo repository) {
-    mx.HandleFunc("/groups", getGroupsHandler(formatter, repo)).Methods("GET")
-    mx.HandleFunc("/groups", postGroupHandler(formatter, repo)).Methods("POST")
-    mx.HandleFunc("/groups/{id}", getGroupHandler(formatter, repo)).Methods("GET")
-    mx.HandleFunc("/posts", getPostsHandler(formatter, repo)).Methods("GET")
-    mx.HandleFunc("/posts", postPostHandler(formatter, repo)).Methods("POST")
-    mx.HandleFunc("/posts/{id}", getPostHandler(formatter, repo)).Methods("GET")
-    mx.HandleFunc("/comments", getCommentsHandler(formatter, repo)).Methods("GET")
-    mx.HandleFunc("/comments", postCommentHandler(formatter, repo)).Methods("POST")
-    mx.HandleFunc("/comments/{id}", getCommentHandler(formatter, repo)).Methods("GET")
+func initHealthRoutes(mx *mux.Router, formatter *render.Render, health *Health) {
+    mx.HandleFunc("/healthz", getHealthzHandler(formatter, health)).Methods("GET")
+    mx.HandleFunc("/readyz", getReadyzHandler(formatter, health)).Methods("GET")
 }
 
-func initRoutesWithoutAuth(mx *mux.Router, formatter *render.Render) {
+func initRoutesWithoutAuth(mx *mux.Router, formatter *render.Render, store tokenStore, tokens TokenConfig) {
     mx.HandleFunc("/ping", getPingHandler(formatter)).Methods("GET")
+    mx.HandleFunc("/tokens/revoke", postRevokeTokenHandler(formatter, store, tokens)).Methods("POST")
 }
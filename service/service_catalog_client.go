@@ -2,32 +2,66 @@ package service
 
 import (
     "bytes"
+    "context"
     "encoding/json"
+    "log/slog"
     "net/http"
-    "fmt"
-    "os"
+    "strings"
+    "time"
+
+    "go.opentelemetry.io/otel/trace"
 )
 
 type serviceCatalogClient interface {
-    publishService(name, url string)
+    PublishService(ctx context.Context)
+    DeregisterService(ctx context.Context)
 }
 
 //CatalogWebClient allows communication to registry
 type CatalogWebClient struct {
-    RootURL string
+    RootURL     string
+    //ServiceURL is the address this service is reachable at
+    ServiceURL  string
+    Logger      *slog.Logger
+    Tracer      trace.Tracer
 }
 
 //PublishService publishes name and url to service
-func (client CatalogWebClient) PublishService() {
+func (client CatalogWebClient) PublishService(ctx context.Context) {
+    client.send(ctx, "POST")
+}
+
+//DeregisterService removes name and url from the registry, it is called on
+//shutdown so no new traffic is sent our way
+func (client CatalogWebClient) DeregisterService(ctx context.Context) {
+    client.send(ctx, "DELETE")
+}
+
+func (client CatalogWebClient) send(ctx context.Context, method string) {
+    logger := client.Logger
+    if logger == nil {
+        logger = slog.Default()
+    }
+
     name := "api"
-    url := os.Getenv("URL")
-    httpclient := &http.Client{}
-    service := Service{Name: name, URL: url}
+    httpclient := &http.Client{Timeout: 5 * time.Second}
+    service := Service{Name: name, URL: client.ServiceURL}
     marshalled, _ := json.Marshal(service)
-    req, _ := http.NewRequest("POST", client.RootURL, bytes.NewBuffer(marshalled))
-    fmt.Println(req.URL)
-    _, err := httpclient.Do(req)
+    req, err := http.NewRequest(method, client.RootURL, bytes.NewBuffer(marshalled))
+    if err != nil {
+        logger.Error("Failed to build service catalog request", "error", err)
+        return
+    }
+    setRequestID(ctx, req)
+    logger = logger.With("method", method, "url", client.RootURL, "request_id", req.Header.Get(requestIDHeader))
+    _, span := startClientSpan(ctx, client.Tracer, "catalog."+strings.ToLower(method), req)
+
+    resp, err := httpclient.Do(req)
+    endClientSpan(span, resp, err)
     if err != nil {
-        fmt.Println(err.Error())
+        logger.Error("Failed to reach the service catalog", "error", err)
+        return
     }
+    resp.Body.Close()
+    logger.Info("Updated the service catalog", "status", resp.StatusCode)
 }
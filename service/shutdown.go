@@ -0,0 +1,27 @@
+package service
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "time"
+)
+
+//Serve runs server on listener until ctx is cancelled, then stops accepting
+//connections and gives in-flight requests up to timeout to finish
+func Serve(ctx context.Context, server *http.Server, listener net.Listener, timeout time.Duration) error {
+    errs := make(chan error, 1)
+    go func() {
+        errs <- server.Serve(listener)
+    }()
+
+    select {
+    case err := <-errs:
+        return err
+    case <-ctx.Done():
+    }
+
+    shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return server.Shutdown(shutdown)
+}
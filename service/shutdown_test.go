@@ -0,0 +1,107 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    started := make(chan struct{})
+    release := make(chan struct{})
+    server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        close(started)
+        <-release
+        w.WriteHeader(http.StatusOK)
+    })}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error, 1)
+    go func() {
+        served <- Serve(ctx, server, listener, time.Second)
+    }()
+
+    responses := make(chan int, 1)
+    go func() {
+        resp, err := http.Get("http://" + listener.Addr().String())
+        if err != nil {
+            responses <- 0
+            return
+        }
+        resp.Body.Close()
+        responses <- resp.StatusCode
+    }()
+
+    <-started
+    cancel()
+    time.Sleep(50 * time.Millisecond)
+    if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+        t.Error("Expected new connections to be refused while shutting down")
+    }
+    close(release)
+
+    if code := <-responses; code != http.StatusOK {
+        t.Errorf("Expected the in-flight request to finish with %v; received %v", http.StatusOK, code)
+    }
+    if err := <-served; err != nil {
+        t.Errorf("Expected a clean shutdown; received %s", err)
+    }
+}
+
+func TestServeGivesUpAfterTimeout(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    started := make(chan struct{})
+    release := make(chan struct{})
+    defer close(release)
+    server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        close(started)
+        <-release
+    })}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error, 1)
+    go func() {
+        served <- Serve(ctx, server, listener, 20*time.Millisecond)
+    }()
+    go http.Get("http://" + listener.Addr().String())
+
+    <-started
+    cancel()
+    if err := <-served; err != context.DeadlineExceeded {
+        t.Errorf("Expected %v; received %v", context.DeadlineExceeded, err)
+    }
+}
+
+func TestRetryUntilReady(t *testing.T) {
+    attempts := 0
+    err := retryUntilReady(slog.Default(), "db", time.Second, time.Millisecond, func() error {
+        attempts++
+        if attempts < 3 {
+            return errors.New("not yet")
+        }
+        return nil
+    })
+    if err != nil || attempts != 3 {
+        t.Errorf("Expected success on the third attempt; received %v after %d", err, attempts)
+    }
+
+    attempts = 0
+    err = retryUntilReady(slog.Default(), "db", 0, time.Millisecond, func() error {
+        attempts++
+        return errors.New("down")
+    })
+    if err == nil || attempts != 1 {
+        t.Errorf("Expected a single failed attempt without a timeout; received %v after %d", err, attempts)
+    }
+}
@@ -0,0 +1,52 @@
+package service
+
+//commentNode is a comment along with the replies made to it
+type commentNode struct {
+    Comment
+    ReplyCount  int             `json:"reply_count"`
+    Replies     []*commentNode  `json:"replies"`
+}
+
+//commentThreads pages through the top level comments and fills in every
+//reply under the ones on the page, so a thread is never split across pages
+func commentThreads(repo repository, postIDs []string, page pageRequest) (pageResponse, error) {
+    roots, err := repo.getTopLevelComments(postIDs, page)
+    if err != nil {
+        return pageResponse{}, err
+    }
+    response := pageOf(roots, page)
+    roots = response.Items.([]Comment)
+
+    rootIDs := make([]uint, len(roots))
+    for i, root := range roots {
+        rootIDs[i] = root.ID
+    }
+    replies, err := repo.getCommentReplies(rootIDs)
+    if err != nil {
+        return response, err
+    }
+    response.Items = buildCommentTree(append(append([]Comment{}, roots...), replies...))
+    return response, nil
+}
+
+//buildCommentTree assembles comments into threads, replies whose parent
+//isn't in the list are treated as top level so nothing goes missing
+func buildCommentTree(comments []Comment) []*commentNode {
+    nodes := make(map[uint]*commentNode, len(comments))
+    for _, comment := range comments {
+        nodes[comment.ID] = &commentNode{Comment: comment, Replies: []*commentNode{}}
+    }
+
+    roots := []*commentNode{}
+    for _, comment := range comments {
+        node := nodes[comment.ID]
+        parent, ok := nodes[comment.ParentID]
+        if comment.ParentID == 0 || !ok {
+            roots = append(roots, node)
+            continue
+        }
+        parent.Replies = append(parent.Replies, node)
+        parent.ReplyCount++
+    }
+    return roots
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "time"
+
+    "go.opentelemetry.io/otel/trace"
+    "gopkg.in/redis.v4"
+)
+
+const (
+    //invalidTokenMarker is cached for tokens the auth service rejected
+    invalidTokenMarker = "!invalid"
+    //expiredTokenMarker is cached for tokens that had expired when looked up
+    expiredTokenMarker = "!expired"
+    //revokedTokenMarker is cached for tokens revoked by the auth service
+    revokedTokenMarker = "!revoked"
+)
+
+var (
+    errTokenNotCached = errors.New("Token is not cached")
+    errRevokedToken = errors.New("Token has been revoked")
+)
+
+//tokenStore caches token lookups so the auth service isn't asked on every
+//request. add only sets keys that don't exist, so a lookup finishing late
+//can't overwrite a revocation made while it was in flight
+type tokenStore interface {
+    get(ctx context.Context, key string) (string, error)
+    set(ctx context.Context, key, value string, ttl time.Duration) error
+    add(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+    ttl(ctx context.Context, key string) (time.Duration, error)
+}
+
+type redisTokenStore struct {
+    client      *redis.Client
+    metrics     *Metrics
+    tracer      trace.Tracer
+}
+
+func (s redisTokenStore) get(ctx context.Context, key string) (value string, err error) {
+    err = redisCall(ctx, s.tracer, s.metrics, "get", func() error {
+        value, err = s.client.Get(key).Result()
+        return err
+    })
+    return value, err
+}
+
+func (s redisTokenStore) set(ctx context.Context, key, value string, ttl time.Duration) error {
+    return redisCall(ctx, s.tracer, s.metrics, "set", func() error {
+        return s.client.Set(key, value, ttl).Err()
+    })
+}
+
+func (s redisTokenStore) add(ctx context.Context, key, value string, ttl time.Duration) (added bool, err error) {
+    err = redisCall(ctx, s.tracer, s.metrics, "setnx", func() error {
+        added, err = s.client.SetNX(key, value, ttl).Result()
+        return err
+    })
+    return added, err
+}
+
+func (s redisTokenStore) ttl(ctx context.Context, key string) (ttl time.Duration, err error) {
+    err = redisCall(ctx, s.tracer, s.metrics, "pttl", func() error {
+        ttl, err = s.client.PTTL(key).Result()
+        return err
+    })
+    return ttl, err
+}
+
+//tokenCacheKey is where a token is cached, tokens are hashed so callers
+//can't pick keys outside the token: namespace and raw tokens aren't kept
+func tokenCacheKey(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return "token:" + hex.EncodeToString(sum[:])
+}
+
+//cachedPrincipal looks the token up in the store, rejected and revoked tokens
+//come back as errors and values that don't decode are treated as a miss so
+//they get refreshed from the auth service
+func cachedPrincipal(ctx context.Context, store tokenStore, key string, now time.Time) (Principal, error) {
+    var principal Principal
+    value, err := store.get(ctx, tokenCacheKey(key))
+    if err != nil {
+        return principal, errTokenNotCached
+    }
+
+    switch value {
+    case invalidTokenMarker:
+        return principal, errInvalidToken
+    case expiredTokenMarker:
+        return principal, errExpiredToken
+    case revokedTokenMarker:
+        return principal, errRevokedToken
+    }
+
+    err = json.Unmarshal([]byte(value), &principal)
+    if err != nil || principal.UserID == 0 {
+        return principal, errTokenNotCached
+    }
+    if !principal.ExpiresAt.After(now) {
+        return principal, errExpiredToken
+    }
+    return principal, nil
+}
+
+//cachePrincipal stores the principal until the token expires, tokens that
+//have already expired are not cached. Anything already cached for the token
+//is kept, it can only be a revocation or a newer lookup
+func cachePrincipal(ctx context.Context, store tokenStore, key string, principal Principal, now time.Time) error {
+    ttl := principal.ExpiresAt.Sub(now)
+    if ttl <= 0 {
+        return errExpiredToken
+    }
+
+    value, err := json.Marshal(principal)
+    if err != nil {
+        return err
+    }
+    _, err = store.add(ctx, tokenCacheKey(key), string(value), ttl)
+    return err
+}
+
+//cacheRejectedToken remembers why a token was rejected for ttl, which is kept
+//short so a token that becomes valid isn't locked out for long. Like
+//cachePrincipal it never replaces what is already cached
+func cacheRejectedToken(ctx context.Context, store tokenStore, key string, reason error, ttl time.Duration) error {
+    if ttl <= 0 {
+        return nil
+    }
+    marker := invalidTokenMarker
+    if reason == errExpiredToken {
+        marker = expiredTokenMarker
+    }
+    _, err := store.add(ctx, tokenCacheKey(key), marker, ttl)
+    return err
+}
+
+//revokeToken replaces whatever is cached for the token with a revocation,
+//which lasts as long as the cached principal would have or fallback when
+//nothing is cached
+func revokeToken(ctx context.Context, store tokenStore, key string, fallback time.Duration) error {
+    key = tokenCacheKey(key)
+    ttl, err := store.ttl(ctx, key)
+    if err != nil || ttl <= 0 {
+        ttl = fallback
+    }
+    return store.set(ctx, key, revokedTokenMarker, ttl)
+}
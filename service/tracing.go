@@ -0,0 +1,191 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+
+    "github.com/gorilla/mux"
+    "github.com/urfave/negroni"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/trace"
+    "go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+    //TracingExporterNone turns tracing off
+    TracingExporterNone = "none"
+    //TracingExporterOTLP sends spans to a collector over OTLP/HTTP
+    TracingExporterOTLP = "otlp"
+    //TracingExporterStdout writes spans as JSON to stdout or a file
+    TracingExporterStdout = "stdout"
+
+    tracerName = "github.com/mattmac4241/grouper-api/service"
+)
+
+//noopTracer is used wherever no tracer was given
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+//traceContext carries spans to and from other services in the W3C
+//traceparent and tracestate headers
+var traceContext = propagation.TraceContext{}
+
+//Tracing owns the tracer provider built from the config
+type Tracing struct {
+    provider    *sdktrace.TracerProvider
+    closer      io.Closer
+}
+
+//NewTracing builds the exporter cfg asks for, with the none exporter every
+//span is dropped
+func NewTracing(cfg TracingConfig) (*Tracing, error) {
+    var exporter sdktrace.SpanExporter
+    var closer io.Closer
+    var err error
+    switch cfg.Exporter {
+    case TracingExporterNone, "":
+        return &Tracing{}, nil
+    case TracingExporterOTLP:
+        var options []otlptracehttp.Option
+        if cfg.Endpoint != "" {
+            options = append(options, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+        }
+        exporter, err = otlptracehttp.New(context.Background(), options...)
+    case TracingExporterStdout:
+        var out io.Writer = os.Stdout
+        if cfg.File != "" {
+            file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+            if err != nil {
+                return nil, err
+            }
+            out, closer = file, file
+        }
+        exporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+    default:
+        return nil, fmt.Errorf("Unknown tracing exporter %q", cfg.Exporter)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+        sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+    )
+    return &Tracing{provider: provider, closer: closer}, nil
+}
+
+//Tracer returns the tracer spans are started with
+func (t *Tracing) Tracer() trace.Tracer {
+    if t == nil || t.provider == nil {
+        return noopTracer
+    }
+    return t.provider.Tracer(tracerName)
+}
+
+//Shutdown flushes the spans that haven't been exported yet
+func (t *Tracing) Shutdown(ctx context.Context) error {
+    if t == nil || t.provider == nil {
+        return nil
+    }
+    err := t.provider.Shutdown(ctx)
+    if t.closer != nil {
+        t.closer.Close()
+    }
+    return err
+}
+
+//startSpan starts a span with tracer, or a span that records nothing when
+//tracer is nil
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+    if tracer == nil {
+        tracer = noopTracer
+    }
+    return tracer.Start(ctx, name, opts...)
+}
+
+//endSpan marks the span as failed when err is set and ends it
+func endSpan(span trace.Span, err error) {
+    if err != nil {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+    }
+    span.End()
+}
+
+//startClientSpan starts a span for a call to another service and passes it
+//on in the headers of req
+func startClientSpan(ctx context.Context, tracer trace.Tracer, name string, req *http.Request) (context.Context, trace.Span) {
+    ctx, span := startSpan(ctx, tracer, name,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("http.request.method", req.Method),
+            attribute.String("server.address", req.URL.Host),
+        ),
+    )
+    traceContext.Inject(ctx, propagation.HeaderCarrier(req.Header))
+    return ctx, span
+}
+
+//endClientSpan records the status of a response, 5xx answers fail the span
+func endClientSpan(span trace.Span, resp *http.Response, err error) {
+    if resp != nil {
+        span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+        if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+            err = fmt.Errorf("%s answered %d", resp.Request.URL.Host, resp.StatusCode)
+        }
+    }
+    endSpan(span, err)
+}
+
+//RequestTracing starts a server span for every request, continuing the trace
+//of the caller when it sent a traceparent header
+type RequestTracing struct {
+    tracer      trace.Tracer
+    routers     []*mux.Router
+}
+
+//NewRequestTracing has to come before anything that logs or starts spans
+func NewRequestTracing(tracer trace.Tracer, routers ...*mux.Router) *RequestTracing {
+    return &RequestTracing{tracer: tracer, routers: routers}
+}
+
+// The tracing handler
+func (t *RequestTracing) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+    route := routeTemplate(req, t.routers)
+    ctx := traceContext.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+    ctx, span := startSpan(ctx, t.tracer, req.Method+" "+route,
+        trace.WithSpanKind(trace.SpanKindServer),
+        trace.WithAttributes(
+            attribute.String("http.request.method", req.Method),
+            attribute.String("http.route", route),
+            attribute.String("url.path", req.URL.Path),
+        ),
+    )
+    defer span.End()
+
+    rw, ok := w.(negroni.ResponseWriter)
+    if !ok {
+        rw = negroni.NewResponseWriter(w)
+    }
+    next(rw, req.WithContext(ctx))
+
+    status := rw.Status()
+    if status == 0 {
+        status = http.StatusOK
+    }
+    span.SetAttributes(attribute.Int("http.response.status_code", status))
+    if status >= http.StatusInternalServerError {
+        span.SetStatus(codes.Error, strconv.Itoa(status))
+    }
+}
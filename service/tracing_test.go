@@ -0,0 +1,132 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/urfave/negroni"
+    "go.opentelemetry.io/otel/codes"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+    "go.opentelemetry.io/otel/trace"
+)
+
+func newRecordingTracer() (trace.Tracer, *tracetest.SpanRecorder) {
+    recorder := tracetest.NewSpanRecorder()
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+    return provider.Tracer(tracerName), recorder
+}
+
+func spanNamed(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+    for _, span := range spans {
+        if span.Name() == name {
+            return span
+        }
+    }
+    return nil
+}
+
+func TestRequestTracingContinuesTraces(t *testing.T) {
+    tracer, recorder := newRecordingTracer()
+    repo := instrumentedRepository{repo: &repoTest{}, tracer: tracer}
+    router := mux.NewRouter()
+    router.HandleFunc("/api/groups/{id}", func(w http.ResponseWriter, req *http.Request) {
+        repo := repoFor(req, repo)
+        repo.getGroup(mux.Vars(req)["id"])
+        w.WriteHeader(http.StatusInternalServerError)
+    }).Methods("GET")
+    n := negroni.New(NewRequestTracing(tracer, router), negroni.Wrap(router))
+
+    request, _ := http.NewRequest("GET", "/api/groups/1", nil)
+    request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    n.ServeHTTP(httptest.NewRecorder(), request)
+
+    spans := recorder.Ended()
+    server := spanNamed(spans, "GET /api/groups/{id}")
+    if server == nil {
+        t.Fatalf("Expected a server span named after the route; received %d spans", len(spans))
+    }
+    if id := server.SpanContext().TraceID().String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+        t.Errorf("Expected the trace of the caller to be continued; received %s", id)
+    }
+    if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+        t.Errorf("Expected the server span to be a child of the caller; received %s", server.Parent().SpanID())
+    }
+    if server.Status().Code != codes.Error {
+        t.Errorf("Expected a 500 to fail the server span; received %v", server.Status().Code)
+    }
+
+    child := spanNamed(spans, "repository.getGroup")
+    if child == nil {
+        t.Fatal("Expected a span for the repository call")
+    }
+    if child.Parent().SpanID() != server.SpanContext().SpanID() {
+        t.Errorf("Expected the repository span to be a child of the server span")
+    }
+}
+
+func TestRepositorySpansIgnoreNotFound(t *testing.T) {
+    tracer, recorder := newRecordingTracer()
+    repo := instrumentedRepository{repo: &repoTest{}, tracer: tracer}
+
+    repo.getGroup("1")
+    repo.revokeAPIKey("1")
+
+    spans := recorder.Ended()
+    if span := spanNamed(spans, "repository.getGroup"); span == nil || span.Status().Code != codes.Error {
+        t.Errorf("Expected a failed getGroup span")
+    }
+    if span := spanNamed(spans, "repository.revokeAPIKey"); span == nil || span.Status().Code == codes.Error {
+        t.Errorf("Expected a not found revokeAPIKey span not to fail")
+    }
+}
+
+func TestAuthClientPropagatesTraces(t *testing.T) {
+    tracer, recorder := newRecordingTracer()
+    received := make(chan string, 1)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        received <- req.Header.Get("traceparent")
+        w.WriteHeader(http.StatusNotFound)
+    }))
+    defer server.Close()
+
+    client := newAuthWebClient(AuthConfig{URL: server.URL, Timeout: Duration(time.Second)})
+    client.tracer = tracer
+    ctx, parent := tracer.Start(context.Background(), "request")
+    client.getUserIDFromToken(ctx, "abc")
+    parent.End()
+
+    span := spanNamed(recorder.Ended(), "auth.getToken")
+    if span == nil {
+        t.Fatal("Expected a span for the call to the auth service")
+    }
+    if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+        t.Errorf("Expected the auth span to be a child of the request span")
+    }
+    if span.Status().Code == codes.Error {
+        t.Errorf("Expected a rejected token not to fail the span")
+    }
+    expected := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+    if header := <-received; header != expected {
+        t.Errorf("Expected the auth service to receive %q; received %q", expected, header)
+    }
+}
+
+func TestNewTracingRejectsUnknownExporters(t *testing.T) {
+    tracing, err := NewTracing(TracingConfig{Exporter: TracingExporterNone})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, span := startSpan(context.Background(), tracing.Tracer(), "nothing"); span.IsRecording() {
+        t.Errorf("Expected no spans to be recorded with tracing off")
+    }
+
+    _, err = NewTracing(TracingConfig{Exporter: "zipkin"})
+    if err == nil {
+        t.Errorf("Expected an unknown exporter to fail")
+    }
+}
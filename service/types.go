@@ -1,34 +1,104 @@
 package service
 
 import (
+    "time"
+
     "github.com/jinzhu/gorm"
 )
 
 //Group model used for all groups
 type Group struct {
     gorm.Model
-    Name        string      `json:"name";gorm:not null`
+    Name        string      `json:"name" gorm:"not null"`
     Private     bool        `json:"private"`
+    OwnerID     uint        `json:"owner_id"`
 }
 
 //GroupMember many2many for groups
 type GroupMember struct {
-    UserID      uint     `json:"user_id"`
-    GroupID     uint     `json:"group_id"`
+    UserID      uint     `json:"user_id" gorm:"primary_key;auto_increment:false"`
+    GroupID     uint     `json:"group_id" gorm:"primary_key;auto_increment:false"`
+}
+
+//GroupJoinRequest is a request to join a private group that waits for an
+//admin to approve or reject it
+type GroupJoinRequest struct {
+    gorm.Model
+    GroupID     uint        `json:"group_id"`
+    UserID      uint        `json:"user_id"`
+    Status      string      `json:"status"`
+    Reason      string      `json:"reason"`
+    ReviewerID  uint        `json:"reviewer_id"`
+    ReviewedAt  *time.Time  `json:"reviewed_at"`
 }
 
+const (
+    joinRequestPending  = "pending"
+    joinRequestApproved = "approved"
+    joinRequestRejected = "rejected"
+)
+
 //GroupAdmin denotes who is an admin on a group
 type GroupAdmin struct {
-    UserID      uint     `json:"user_id"`
-    GroupID     uint     `json:"group_id"`
+    UserID      uint     `json:"user_id" gorm:"primary_key;auto_increment:false"`
+    GroupID     uint     `json:"group_id" gorm:"primary_key;auto_increment:false"`
+}
+
+//GroupAdminEvent records a change to the admins or owner of a group
+type GroupAdminEvent struct {
+    ID          uint        `json:"id"`
+    GroupID     uint        `json:"group_id"`
+    ActorID     uint        `json:"actor_id"`
+    UserID      uint        `json:"user_id"`
+    Action      string      `json:"action"`
+    CreatedAt   time.Time   `json:"created_at"`
 }
 
+const (
+    adminActionPromote  = "promote"
+    adminActionDemote   = "demote"
+    adminActionTransfer = "transfer"
+)
+
+//GroupInvite lets someone join a group, either addressed to a single user
+//or as a shareable code with an optional expiry and number of uses
+type GroupInvite struct {
+    gorm.Model
+    GroupID     uint        `json:"group_id"`
+    Code        string      `json:"code"`
+    InviterID   uint        `json:"inviter_id"`
+    InviteeID   uint        `json:"invitee_id"`
+    ExpiresAt   *time.Time  `json:"expires_at"`
+    MaxUses     int         `json:"max_uses"`
+    Uses        int         `json:"uses"`
+    RevokedAt   *time.Time  `json:"revoked_at"`
+    DeclinedAt  *time.Time  `json:"declined_at"`
+}
+
+//APIKey lets batch jobs and bots call the api without a user token, only a
+//hash of the key is stored
+type APIKey struct {
+    gorm.Model
+    Name        string      `json:"name"`
+    Prefix      string      `json:"prefix"`
+    KeyHash     string      `json:"-"`
+    Scopes      string      `json:"scopes"`
+    GroupIDs    string      `json:"group_ids"`
+    CreatorID   uint        `json:"creator_id"`
+    RevokedAt   *time.Time  `json:"revoked_at"`
+}
+
+//maxContentLength is the most characters the content of a post or comment
+//can have, the database enforces it as well
+const maxContentLength = 500
+
 //Post used for group posts
 type Post struct {
     gorm.Model
     GroupID     uint     `json:"group_id"`
     UserID      uint     `json:"user_id"`
-    Content     string  `json:"content";gorm:"type:varchar(500)`
+    BotID       uint     `json:"bot_id,omitempty"`
+    Content     string  `json:"content" gorm:"type:varchar(500)"`
     Title       string  `json:"title"`
 }
 
@@ -36,8 +106,23 @@ type Post struct {
 type Comment struct {
     gorm.Model
     PostID      uint     `json:"post_id"`
-    Content     string  `json:"content";gorm:"type:varchar(500)`
+    ParentID    uint    `json:"parent_id" gorm:"default:null"`
+    Depth       int     `json:"depth"`
+    Content     string  `json:"content" gorm:"type:varchar(500)"`
     UserID      uint    `json:"user_id"`
+    BotID       uint    `json:"bot_id,omitempty"`
+    Deleted     bool    `json:"deleted"`
+}
+
+//Reaction is a single user's reaction to a post or comment
+type Reaction struct {
+    ID          uint        `json:"id"`
+    TargetType  string      `json:"target_type"`
+    TargetID    uint        `json:"target_id"`
+    UserID      uint        `json:"user_id"`
+    Type        string      `json:"type"`
+    CreatedAt   time.Time   `json:"created_at"`
+    UpdatedAt   time.Time   `json:"updated_at"`
 }
 
 //Token struct handles authentication
@@ -45,6 +130,7 @@ type Token struct {
     Key         string   `json:"token"`
     UserID      uint     `json:"user_id"`
     ExpiresAt   int64    `json:"expires_at"`
+    Scopes      []string `json:"scopes"`
 }
 
 type Service struct {